@@ -0,0 +1,89 @@
+// OpenActa - Benchmarks
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+/*
+Run with: go test -run=- -bench=. -benchmem
+Tracing is switched off, otherwise that's all we'd be measuring.
+*/
+
+// A generated query with lots of conditions, as tooling might produce
+func large_query(conditions int) string {
+	var b strings.Builder
+
+	b.WriteString("FIND src_ip, dest_ip, COUNT(*) AS n MATCHING ")
+	for i := 0; i < conditions; i++ {
+		if i > 0 {
+			if i%3 == 0 {
+				b.WriteString(" OR ")
+			} else {
+				b.WriteString(" AND ")
+			}
+		}
+		fmt.Fprintf(&b, "dest_port=%d", i)
+	}
+	b.WriteString(" SINCE 2 DAYS AGO | GROUP src_ip, dest_ip HAVING n > 10 | SORT n DESC")
+
+	return b.String()
+}
+
+func BenchmarkLexer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, statement := range statements {
+			lexer(statement)
+		}
+	}
+}
+
+func BenchmarkParser(b *testing.B) {
+	defer func(w io.Writer) { trace = w }(trace)
+	trace = io.Discard
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, statement := range statements {
+			Parse(statement)
+		}
+	}
+}
+
+func BenchmarkLargeQuery(b *testing.B) {
+	defer func(w io.Writer) { trace = w }(trace)
+	trace = io.Discard
+
+	query := large_query(500)
+	if _, error := Parse(query); error != nil {
+		b.Fatalf("Parse error: %s", error)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Parse(query)
+	}
+}
+
+// EOF
@@ -0,0 +1,126 @@
+// OpenActa - Query Cache
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"container/list"
+	"sync"
+)
+
+/*
+REPLs and dashboards tend to run the same saved searches over and over.
+The Cache keeps the parsed statement around, so a repeat only has to redo the
+temporal clause: LAST HOUR means something else every time it's run, so
+resolved times are never cached.
+*/
+
+// Cache holds the most recently parsed statements, it's safe for concurrent use
+type Cache struct {
+	mutex   sync.Mutex
+	size    int
+	options Options
+	lru     *list.List               // most recently used at the front, of *cache_entry
+	entries map[string]*list.Element // statement -> element in lru
+}
+
+type cache_entry struct {
+	query  string
+	parser *Parser // state after parsing, only ever copied from
+}
+
+// Statements parsed by ParseCached()
+var default_cache = NewCache(256, DefaultOptions())
+
+// NewCache returns a cache for up to size statements, parsed with the given options
+func NewCache(size int, options Options) *Cache {
+	return &Cache{size: size, options: options, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// ParseCached is Parse, through a package-wide Cache
+func ParseCached(query string) (*Query, error) {
+	return default_cache.Parse(query)
+}
+
+// Parse returns the Query for a statement, parsing it only if it's not in the cache.
+// Relative temporal references are resolved again on every call.
+// Statements with errors aren't cached, nor are those comparing with a relative point in time
+// in MATCHING (last_seen > 1 HOUR AGO) as only the temporal clause is resolved again.
+func (c *Cache) Parse(query string) (*Query, error) {
+	c.mutex.Lock()
+	element, hit := c.entries[query]
+	if hit {
+		c.lru.MoveToFront(element)
+	}
+	c.mutex.Unlock()
+
+	if hit {
+		p := *element.Value.(*cache_entry).parser // work on a copy, the cached state stays as it was
+		if error := p.redo_temporal(); error != nil {
+			return nil, error
+		}
+		if error := p.check_warnings(); error != nil {
+			return nil, error
+		}
+		return p.make_query(), nil
+	}
+
+	tokens, error := lexer(query)
+	if error != nil {
+		return nil, error
+	}
+	p := &Parser{query: query, tokens: tokens, num_tokens: len(tokens), options: c.options}
+	if error := p.parser(); error != nil {
+		return nil, error
+	}
+	if p.relative_conditions {
+		return p.make_query(), nil
+	}
+
+	c.mutex.Lock()
+	if _, exists := c.entries[query]; !exists { // might have been added meanwhile
+		c.entries[query] = c.lru.PushFront(&cache_entry{query: query, parser: p})
+		for c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			delete(c.entries, oldest.Value.(*cache_entry).query)
+			c.lru.Remove(oldest)
+		}
+	}
+	c.mutex.Unlock()
+
+	return p.make_query(), nil
+}
+
+// Len returns the number of statements in the cache
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+// Resolve the temporal clause of an already parsed statement against the clock again.
+// Only the time range and the warnings from the temporal clause on are redone.
+func (p *Parser) redo_temporal() error {
+	p.now = p.clock()
+	p.token_index = p.temporal_token
+	p.warnings = append([]string(nil), p.warnings[:p.temporal_warnings]...)
+
+	return p.do_temp_cond()
+}
+
+// EOF
@@ -0,0 +1,84 @@
+// OpenActa - Query Cache tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	options := DefaultOptions()
+	options.Now = func() time.Time { return now }
+
+	cache := NewCache(2, options)
+	const statement = "FIND src_ip, COUNT(*) AS n MATCHING dest_port=443 BETWEEN '2024-05-14' AND LAST HOUR | GROUP src_ip"
+
+	first, error := cache.Parse(statement)
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	element := cache.entries[statement]
+
+	now = now.Add(3 * time.Hour)
+	second, error := cache.Parse(statement)
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if cache.Len() != 1 || cache.entries[statement] != element {
+		t.Errorf("second parse didn't come from the cache")
+	}
+
+	// Same structure, but the time range moved with the clock
+	if first.TimeTo == second.TimeTo {
+		t.Errorf("LAST HOUR resolved to %d both times", first.TimeTo)
+	}
+	if first.TimeFrom != second.TimeFrom || len(first.Warnings()) != len(second.Warnings()) {
+		t.Errorf("absolute start or warnings differ: %d %v, %d %v", first.TimeFrom, first.Warnings(), second.TimeFrom, second.Warnings())
+	}
+	uncached, error := ParseWithOptions(statement, options)
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if !second.Equal(uncached) {
+		t.Errorf("cached parse\n%+v\ndiffers from\n%+v", second, uncached)
+	}
+
+	// Changing a result doesn't change the cache
+	second.Fields[0] = "changed"
+	if third, _ := cache.Parse(statement); third.Fields[0] != "src_ip" {
+		t.Errorf("cached fields changed to %v", third.Fields)
+	}
+
+	// Errors aren't cached, the least recently used statement goes first
+	if _, error := cache.Parse("FIND"); error == nil {
+		t.Errorf("expected a parse error")
+	}
+	for i := 0; i < 2; i++ {
+		if _, error := cache.Parse(fmt.Sprintf("FIND x%d SINCE YESTERDAY", i)); error != nil {
+			t.Fatalf("Parse error: %s", error)
+		}
+	}
+	if _, exists := cache.entries[statement]; exists || cache.Len() != 2 {
+		t.Errorf("%d statements cached, expected the first one evicted", cache.Len())
+	}
+}
+
+// EOF
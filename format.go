@@ -0,0 +1,191 @@
+// OpenActa - Formatter
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"io"
+	"strings"
+)
+
+/*
+Saved searches get written by different people in different ways. Laying them all out
+the same way makes them easier to read, and a diff between two versions only shows
+what actually changed.
+*/
+
+// FormatQuery returns the statement laid out the one way: keywords in upper case, a single
+// space between tokens, and every clause and pipe stage on a line of its own:
+//
+//	find src_ip,count(*)  matching dest_port==443 since yesterday|group src_ip
+//
+// becomes
+//
+//	FIND src_ip, COUNT(*)
+//	MATCHING dest_port == 443
+//	SINCE YESTERDAY
+//	| GROUP src_ip
+//
+// Fields, strings and numbers stay as written, and so do comments: one on a line of its own
+// stays on a line of its own, one following a token stays after it. Formatting the result
+// again gives the same result. A statement that doesn't parse is an error.
+func FormatQuery(query string) (string, error) {
+	tokens, error := lexer(query)
+	if error != nil {
+		return "", error
+	}
+
+	// The parser knows which words are keywords here (SAMPLE, COUNT, ...) and where the clauses start
+	p := Parser{query: query, tokens: tokens, num_tokens: len(tokens), options: DefaultOptions(), validate_only: true}
+	if error := p.parser(); error != nil {
+		return "", error
+	}
+
+	words := make(map[int]bool, len(p.words))
+	for _, index := range p.words {
+		words[index] = true
+	}
+
+	clauses := map[int]bool{0: true}
+	for index, token := range p.tokens[:p.num_tokens] {
+		switch {
+		case token.token == sym_matching, token.token == sym_pipe, token.token == sym_order && token.val == "ORDER":
+			clauses[index] = true
+		case words[index] && strings.EqualFold(token.val, "SAMPLE"):
+			clauses[index] = true
+		}
+	}
+	if p.temporal_start != p.temporal_end {
+		clauses[p.temporal_token] = true
+	}
+
+	// Go through the tokens again, comments and all. Other than the comments, they're the tokens the parser had.
+	var f formatter
+	l := NewLexer(query).KeepComments()
+	for index := 0; ; {
+		token, error := l.NextToken()
+		if error == io.EOF {
+			break
+		}
+		if error != nil {
+			return "", error
+		}
+
+		if token.Tag == "comment" {
+			f.comment(token.Value, starts_line(query, token.Pos))
+			continue
+		}
+
+		text := token.Value // keywords and operators, in upper case
+		switch {
+		case words[index]:
+			text = strings.ToUpper(query[token.Pos:token.End])
+		case token.Tag == "ident", token.Tag == "string", token.Tag == "int", token.Tag == "float", token.Tag == "duration":
+			text = query[token.Pos:token.End]
+		}
+
+		before, after := p.spacing(index, words)
+		f.token(text, clauses[index], before, after)
+		index++
+	}
+
+	return f.out.String(), nil
+}
+
+// Whether the token at index wants a space before it and after it
+func (p *Parser) spacing(index int, words map[int]bool) (before bool, after bool) {
+	token := &p.tokens[index]
+	before, after = true, true
+
+	switch token.tag {
+	case "comma", "rparen":
+		before = false
+	case "lparen":
+		before = index == 0 || p.tokens[index-1].tag != "ident" // COUNT(*), time(5m)
+		after = false
+	case "mod": // SAMPLE 10%
+		before = token.val != "%" || index < 2 || !words[index-2]
+	case "minus": // unary: -(bytes / 1024)
+		unary := index == 0 || !is_operand(&p.tokens[index-1])
+		after = !unary || p.tokens[index+1].tag == "minus" // - -x, --x would be a comment at the start of a line
+	case "not":
+		after = token.val != "!"
+	}
+
+	return before, after
+}
+
+// Something a binary operator can follow
+func is_operand(token *lexer_token) bool {
+	switch token.tag {
+	case "ident", "string", "int", "float", "duration", "rparen":
+		return true
+	}
+	return false
+}
+
+// Whether only whitespace comes before pos on its line
+func starts_line(query string, pos int) bool {
+	before := query[:pos]
+	if newline := strings.LastIndexByte(before, '\n'); newline >= 0 {
+		before = before[newline+1:]
+	} else {
+		before = strings.TrimPrefix(before, "\uFEFF")
+	}
+	return strings.TrimSpace(before) == ""
+}
+
+// Output of FormatQuery(), a token or comment at a time
+type formatter struct {
+	out     strings.Builder
+	newline bool // the next token goes on a new line, after a line comment
+	tight   bool // no space after the last token, after ( or a unary minus
+}
+
+// A token, on a new line if it starts a clause. The same clause continuing on
+// a new line (after a line comment) is indented.
+func (f *formatter) token(text string, clause bool, before bool, after bool) {
+	switch {
+	case f.out.Len() == 0:
+	case clause:
+		f.out.WriteByte('\n')
+	case f.newline:
+		f.out.WriteString("\n  ")
+	case before && !f.tight:
+		f.out.WriteByte(' ')
+	}
+
+	f.out.WriteString(text)
+	f.newline, f.tight = false, !after
+}
+
+// A comment, as written. Other than a block comment following a token, it has a line to itself.
+func (f *formatter) comment(text string, own_line bool) {
+	switch {
+	case f.out.Len() == 0:
+	case own_line, f.newline:
+		f.out.WriteByte('\n')
+	default:
+		f.out.WriteByte(' ')
+	}
+
+	f.out.WriteString(text)
+	f.newline = own_line || !strings.HasPrefix(text, "/*")
+	f.tight = false
+}
+
+// EOF
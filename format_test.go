@@ -0,0 +1,88 @@
+// OpenActa - Formatter
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"testing"
+)
+
+func TestFormatQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		formatted string
+	}{
+		{"find src_ip,count(*)  matching dest_port==443 since yesterday|group src_ip",
+			"FIND src_ip, COUNT(*)\nMATCHING dest_port == 443\nSINCE YESTERDAY\n| GROUP src_ip"},
+		{"-- name: test\nfind a, b // fields\n, [user agent] matching x=1 and not exists y /* block */ or z contains 'q' since last day sample 10% order by a nulls first | limit 5",
+			"-- name: test\nFIND a, b // fields\n  , [user agent]\nMATCHING x = 1 AND NOT EXISTS y /* block */ OR z CONTAINS 'q'\nSINCE LAST DAY\nSAMPLE 10%\nORDER BY a NULLS FIRST\n| LIMIT 5"},
+		{"find a, count(*) matching -(bytes/2)> -3 since 2 days ago until yesterday or on '2024-01-01' | group time(5m), a having count_star > 3",
+			"FIND a, COUNT(*)\nMATCHING -(bytes / 2) > -3\nSINCE 2 DAYS AGO UNTIL YESTERDAY OR ON '2024-01-01'\n| GROUP TIME(5m), a HAVING count_star > 3"},
+		{"FIND [sample], Random\n  /* the lot */\n  MATCHING netflow:bytes > 1 SORT BY", ""}, // doesn't parse
+		{"FIND sample, rows MATCHING sample > 1 SINCE YESTERDAY | SORT rows",
+			"FIND sample, rows\nMATCHING sample > 1\nSINCE YESTERDAY\n| SORT rows"}, // just fields
+	}
+
+	for _, test := range tests {
+		formatted, error := FormatQuery(test.query)
+		if test.formatted == "" {
+			if error == nil {
+				t.Errorf("%q: expected error, got %q", test.query, formatted)
+			}
+			continue
+		}
+		if error != nil {
+			t.Errorf("%q: %s", test.query, error)
+			continue
+		}
+		if formatted != test.formatted {
+			t.Errorf("%q: formatted as\n%s\nexpected\n%s", test.query, formatted, test.formatted)
+		}
+		if again, _ := FormatQuery(formatted); again != formatted {
+			t.Errorf("%q: formatted again as\n%s", test.query, again)
+		}
+	}
+}
+
+// Formatting what's been formatted changes nothing, and the statement still means the same
+func TestFormatIdempotent(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	for _, statement := range statements {
+		formatted, error := FormatQuery(statement)
+		if error != nil {
+			continue // not all test statements parse
+		}
+		again, error := FormatQuery(formatted)
+		if error != nil {
+			t.Errorf("%q: formatted as %q, which doesn't format: %s", statement, formatted, error)
+			continue
+		}
+		if again != formatted {
+			t.Errorf("%q: formatted as\n%s\nand then as\n%s", statement, formatted, again)
+		}
+
+		q1, error1 := ParseWithOptions(statement, options)
+		q2, error2 := ParseWithOptions(formatted, options)
+		if error1 != nil || error2 != nil || !q1.Equal(q2) {
+			t.Errorf("%q: formatted as %q, which parses differently", statement, formatted)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,61 @@
+// OpenActa - Lexer and parser fuzz tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"io"
+	"testing"
+)
+
+/*
+Queries may come from untrusted sources, so whatever we're fed,
+the lexer and parser must return an error rather than panic (or hang).
+Run with: go test -run=- -fuzz=FuzzParser
+*/
+
+func FuzzLexer(f *testing.F) {
+	for _, statement := range statements {
+		f.Add(statement)
+	}
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, statement string) {
+		lexer(statement) // errors are fine, panics are not
+	})
+}
+
+func FuzzParser(f *testing.F) {
+	for _, statement := range statements {
+		f.Add(statement)
+	}
+	// truncated statements, these used to panic or hang
+	f.Add("")
+	f.Add("FIND src_ip")
+	f.Add("FIND src_ip MATCHING")
+	f.Add("FIND src_ip = 1 SINCE")
+	f.Add("FIND 1 SINCE YESTERDAY")
+	f.Add("FIND src_ip SINCE YESTERDAY |")
+
+	defer func(w io.Writer) { trace = w }(trace)
+	trace = io.Discard // the fuzzer doesn't keep up with all the tracing
+	f.Fuzz(func(t *testing.T, statement string) {
+		Parse(statement) // errors are fine, panics are not
+	})
+}
+
+// EOF
@@ -0,0 +1,125 @@
+// OpenActa - Syntax highlighting
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+/*
+An editor colouring a query as it's typed needs to know what each bit of it is,
+but has no use for a parse: half a query doesn't parse. So this only goes by the
+lexer, and copes with whatever it's given.
+*/
+
+type HighlightCategory int
+
+const (
+	HighlightKeyword    HighlightCategory = iota // FIND, MATCHING, ORDER BY, LIMIT, ...
+	HighlightOperator                            // =, AND, MOD, ... and punctuation: comma, parentheses, pipe
+	HighlightIdentifier                          // field names, including words that aren't reserved (COUNT, SAMPLE, PERCENT)
+	HighlightString                              // quoted string, quotes included
+	HighlightNumber                              // integer, floating point value or duration (500ms)
+	HighlightComment                             // // ..., -- ... or /* ... */
+	HighlightTemporal                            // SINCE, BETWEEN, LAST, WEEK, MONDAY, ...
+)
+
+func (c HighlightCategory) String() string {
+	switch c {
+	case HighlightKeyword:
+		return "keyword"
+	case HighlightOperator:
+		return "operator"
+	case HighlightIdentifier:
+		return "identifier"
+	case HighlightString:
+		return "string-literal"
+	case HighlightNumber:
+		return "number"
+	case HighlightComment:
+		return "comment"
+	case HighlightTemporal:
+		return "temporal"
+	}
+	return ""
+}
+
+// Part of the query to colour one way, Pos and End are byte offsets as in Token
+type HighlightSpan struct {
+	Category HighlightCategory
+	Pos      int
+	End      int
+}
+
+// Lexer tags of the temporal clause: SINCE, BETWEEN and ON are tag "temporal", the rest refer to a time
+var highlight_temporal_tags = map[string]bool{
+	"temporal":  true,
+	"relative":  true,
+	"clocks":    true,
+	"clock":     true,
+	"calendars": true,
+	"calendar":  true,
+	"weekdays":  true,
+	"weekday":   true,
+	"months":    true,
+	"mon":       true,
+}
+
+// Highlight returns a span for every token and comment in the query, in order. Whitespace is
+// left out, so there may be gaps between spans. Nothing is parsed, so a query that doesn't
+// make sense (yet) is highlighted all the same. When the lexer gets stuck, on an unterminated
+// string for instance, the spans up to there are returned along with the error.
+func Highlight(query string) ([]HighlightSpan, error) {
+	var spans []HighlightSpan
+
+	l := NewLexer(query).KeepComments()
+	for {
+		token, ok, error := l.next()
+		if error != nil {
+			return spans, error
+		}
+		if !ok {
+			return spans, nil
+		}
+
+		spans = append(spans, HighlightSpan{Category: highlight_category(&token), Pos: token.stmt_pos, End: token.stmt_end})
+	}
+}
+
+func highlight_category(token *lexer_token) HighlightCategory {
+	switch token.tag {
+	case "comment":
+		return HighlightComment
+	case "string":
+		return HighlightString
+	case "int", "float", "duration":
+		return HighlightNumber
+	case "ident":
+		return HighlightIdentifier
+	}
+
+	switch {
+	case highlight_temporal_tags[token.tag]:
+		return HighlightTemporal
+	case is_operator(token.token):
+		return HighlightOperator
+	}
+	switch token.token {
+	case sym_comma, sym_lparen, sym_rparen, sym_pipe:
+		return HighlightOperator
+	}
+	return HighlightKeyword
+}
+
+// EOF
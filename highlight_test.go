@@ -0,0 +1,89 @@
+// OpenActa - Syntax highlighting tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	const query = "FIND src_ip, COUNT(*) // per source\nMATCHING dest_port>=443 AND name='admin' SINCE 2 DAYS AGO | LIMIT 10"
+
+	expected := []struct {
+		text     string
+		category string
+	}{
+		{"FIND", "keyword"},
+		{"src_ip", "identifier"},
+		{",", "operator"},
+		{"COUNT", "identifier"}, // only a function to the parser
+		{"(", "operator"},
+		{"*", "operator"},
+		{")", "operator"},
+		{"// per source", "comment"},
+		{"MATCHING", "keyword"},
+		{"dest_port", "identifier"},
+		{">=", "operator"},
+		{"443", "number"},
+		{"AND", "operator"},
+		{"name", "identifier"},
+		{"=", "operator"},
+		{"'admin'", "string-literal"},
+		{"SINCE", "temporal"},
+		{"2", "number"},
+		{"DAYS", "temporal"},
+		{"AGO", "temporal"},
+		{"|", "operator"},
+		{"LIMIT", "keyword"},
+		{"10", "number"},
+	}
+
+	spans, error := Highlight(query)
+	if error != nil {
+		t.Fatalf("Highlight error: %s", error)
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("%d spans, expected %d: %v", len(spans), len(expected), spans)
+	}
+	for i, span := range spans {
+		if text := query[span.Pos:span.End]; text != expected[i].text || span.Category.String() != expected[i].category {
+			t.Errorf("span %d: %q %s, expected %q %s", i, text, span.Category, expected[i].text, expected[i].category)
+		}
+	}
+}
+
+func TestHighlightInvalid(t *testing.T) {
+	// Doesn't parse, but that's no reason not to highlight it
+	spans, error := Highlight("FIND MATCHING SINCE")
+	if error != nil || len(spans) != 3 {
+		t.Errorf("incomplete query: %v %v", spans, error)
+	}
+
+	// The lexer can't get past the unterminated string, everything before it is highlighted
+	const query = "FIND ALL MATCHING name='admin SINCE YESTERDAY"
+	spans, error = Highlight(query)
+	if error == nil || !strings.Contains(error.Error(), "unknown token or unquoted string at ''admin SINCE YESTERDAY'") {
+		t.Errorf("expected an error at the string, got %v", error)
+	}
+	if len(spans) != 5 || spans[4].Category != HighlightOperator || query[spans[4].Pos:spans[4].End] != "=" {
+		t.Errorf("spans up to the error: %v", spans)
+	}
+}
+
+// EOF
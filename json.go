@@ -0,0 +1,108 @@
+// OpenActa - Query JSON
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"time"
+)
+
+/*
+A Query can be stored as JSON and loaded again later, for saved searches.
+The time range is stored as resolved: a query saved with SINCE LAST WEEK
+still covers that same week when it's loaded, whenever that is.
+*/
+
+// What's stored, the exported fields of the Query plus its warnings and inferred types
+type query_json struct {
+	*Query
+	Warnings      []string             `json:",omitempty"`
+	InferredTypes map[string]FieldType `json:",omitempty"`
+}
+
+// ToJSON returns the query as JSON, for FromJSON() to load again
+func (q *Query) ToJSON() ([]byte, error) {
+	return json.Marshal(query_json{Query: q, Warnings: q.warnings, InferredTypes: q.inferred})
+}
+
+// FromJSON loads a query stored with Query.ToJSON().
+// The statement text isn't stored, so ExpandTemporal() has nothing to work with.
+func FromJSON(data []byte) (*Query, error) {
+	stored := query_json{Query: &Query{}}
+	if error := json.Unmarshal(data, &stored); error != nil {
+		return nil, fmt.Errorf("query from JSON: %w", error)
+	}
+
+	q := stored.Query
+	q.warnings = stored.Warnings
+	q.inferred = stored.InferredTypes
+	for _, conditions := range [][][]Predicate{q.Conditions, q.Having} {
+		for _, group := range conditions {
+			for i := range group {
+				if error := group[i].restore_typed(); error != nil {
+					return nil, error
+				}
+			}
+		}
+	}
+	for _, tree := range []*Condition{q.MatchingTree, q.HavingTree} {
+		for _, predicate := range tree.predicates() {
+			if error := predicate.restore_typed(); error != nil {
+				return nil, error
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// JSON turns Typed into a plain string or number, take it from Value again
+func (p *Predicate) restore_typed() error {
+	if p.Typed == nil {
+		return nil
+	}
+
+	if p.Op == OpMatches {
+		pattern := p.Value
+		if p.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("query from JSON: %w", err)
+		}
+		p.Typed = compiled
+	} else if addr, err := netip.ParseAddr(p.Value); err == nil {
+		p.Typed = addr
+	} else if prefix, err := netip.ParsePrefix(p.Value); err == nil {
+		p.Typed = prefix
+	} else if duration, err := time.ParseDuration(p.Value); err == nil {
+		p.Typed = duration
+	} else if t, err := time.Parse(time.RFC3339Nano, p.Value); err == nil {
+		p.Typed = t.UnixNano()
+	} else {
+		return fmt.Errorf("query from JSON: unknown typed value '%s'", p.Value)
+	}
+
+	return nil
+}
+
+// EOF
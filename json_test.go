@@ -0,0 +1,70 @@
+// OpenActa - Query JSON tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestJSON(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	for _, statement := range []string{
+		"FIND src_ip, COUNT(*) AS n MATCHING src_ip='10.0.0.1' AND latency > 500ms OR dest_ip='10.0.0.0/8' AND dest_port MOD 2 = 0 SINCE LAST WEEK | GROUP src_ip HAVING n > 5 | SORT n DESC",
+		"FIND ALL MATCHING bytes BETWEEN 10 AND 20 EXCLUSIVE BETWEEN '2024-05-01' AND '2024-05-02' | DISTINCT | LIMIT 10 | FORMAT json",
+		"FIND ALL SINCE FOREVER | SORT RANDOM",
+		"FIND ALL MATCHING user_agent =~ '(?i)curl|wget' OR path MATCHES '^/admin' SINCE YESTERDAY",
+	} {
+		query, error := ParseWithOptions(statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", statement, error)
+		}
+
+		data, error := query.ToJSON()
+		if error != nil {
+			t.Fatalf("%s: ToJSON error: %s", statement, error)
+		}
+		loaded, error := FromJSON(data)
+		if error != nil {
+			t.Fatalf("%s: FromJSON error: %s", statement, error)
+		}
+		if !loaded.Equal(query) {
+			t.Errorf("%s: round trip through JSON\n%s\ngives %+v\nexpected %+v", statement, data, loaded, query)
+		}
+	}
+
+	// The relative time range was stored as resolved
+	query, _ := ParseWithOptions("FIND ALL MATCHING src_ip='10.0.0.1' AND latency > 500ms SINCE YESTERDAY", options)
+	data, _ := query.ToJSON()
+	loaded, _ := FromJSON(data)
+	if from := time.Unix(0, loaded.TimeFrom).UTC().Format(time.DateTime); from != "2024-05-14 00:00:00" {
+		t.Errorf("time from %s", from)
+	}
+	if loaded.Conditions[0][0].Typed != netip.MustParseAddr("10.0.0.1") || loaded.Conditions[0][1].Typed != 500*time.Millisecond {
+		t.Errorf("typed values %#v %#v", loaded.Conditions[0][0].Typed, loaded.Conditions[0][1].Typed)
+	}
+
+	if _, error := FromJSON([]byte(`{"Fields": 1}`)); error == nil {
+		t.Errorf("expected an error for malformed JSON")
+	}
+}
+
+// EOF
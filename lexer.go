@@ -18,9 +18,14 @@
 package openacta
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"regexp"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 /*
@@ -30,74 +35,335 @@ The regex, symbol and token tables are in lexer_symbols.go
 
 // The Go runtime will execute this once at startup, before calling main()
 func init() {
-	// Compile spacing and comments regexes
-	for i := range lexer_pre_table {
-		lexer_pre_table[i].compiled = regexp.MustCompile(lexer_pre_table[i].regex)
-	}
-
 	// Compile our syntax regexes
 	for i := range lexer_regex_table {
 		lexer_regex_table[i].compiled = regexp.MustCompile(lexer_regex_table[i].regex)
 	}
 }
 
-// token lexer using regular expressions
-func lexer(s string) ([]lexer_token, error) {
-	// first get rid of comment fluff, and take out special spacing and CR/LF
-	for i := range lexer_pre_table {
-		s = lexer_pre_table[i].compiled.ReplaceAllLiteralString(s, lexer_pre_table[i].replace)
+// Skip whitespace and comments up to the next token.
+// This is only ever called between tokens, so a // or /* inside a quoted string
+// is part of the string token and never mistaken for a comment.
+// Nothing is replaced, only skipped, so token positions refer to the query as the user wrote it.
+// Whitespace is anything Unicode says it is, so a non-breaking space pasted from a web page is fine.
+// SQL style -- comments only count at the start of a line, as a--1 is a minus minus one.
+// line_start says whether s starts a line. On error, the string returned starts where the trouble is.
+func lexer_skip(s string, line_start bool) (string, error) {
+	for {
+		s, line_start = lexer_space(s, line_start)
+
+		end, error := lexer_comment(s, line_start)
+		if error != nil {
+			return s, error
+		}
+		if end == 0 {
+			return s, nil
+		}
+		s = s[end:]
+		line_start = false // a line comment stops short of its newline, the next lexer_space() takes that
 	}
+}
 
-	// Remove leading and trailing whitespaces
-	s = strings.TrimSpace(s)
+// Skip whitespace, line_start says whether what's returned starts a line
+func lexer_space(s string, line_start bool) (string, bool) {
+	trimmed := strings.TrimLeftFunc(s, unicode.IsSpace)
+	return trimmed, line_start || strings.ContainsRune(s[:len(s)-len(trimmed)], '\n')
+}
 
-	// Tokenise the statement
-	var tokens []lexer_token
-	var stmt_pos int
+// Length of the comment s starts with, 0 if it doesn't start with one.
+// A line comment goes up to the newline or the end of the query, the newline isn't part of it.
+func lexer_comment(s string, line_start bool) (int, error) {
+	switch {
+	case strings.HasPrefix(s, "//"), line_start && strings.HasPrefix(s, "--"):
+		if end := strings.IndexByte(s, '\n'); end >= 0 {
+			return end, nil
+		}
+		return len(s), nil
+	case strings.HasPrefix(s, "/*"):
+		end := strings.Index(s[2:], "*/")
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated comment at '%s'", s)
+		}
+		return 2 + end + 2, nil
+	}
+	return 0, nil
+}
 
-	// Tokenise statement(s)
-	for len(s) > 0 {
-		// Try match each regular expression pattern, in order
-		match := false
-		for i := range lexer_regex_table {
-			if result := lexer_regex_table[i].compiled.FindString(s); result != "" {
-				var newtoken lexer_token
-
-				switch lexer_regex_table[i].tag {
-				case "string": // remove quotes
+// Directives that may be given in line comments ahead of the statement, see lexer_directives()
+var lexer_directive_names = map[string]bool{
+	"name":        true,
+	"description": true,
+}
+
+// Metadata from "key: value" line comments before the first token, for saved searches:
+//
+//	-- name: failed-logins
+//	-- description: logins that didn't work out, by source
+//	FIND src_ip, COUNT(*) MATCHING event='login' AND outcome='failure' SINCE LAST DAY | GROUP src_ip
+//
+// Keys are case insensitive and returned in lower case. Other comments, and
+// directives further down in the statement, are just comments.
+func lexer_directives(query string) map[string]string {
+	var directives map[string]string
+
+	s := strings.TrimPrefix(query, "\uFEFF")
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+
+		var line string
+		switch {
+		case strings.HasPrefix(s, "//"), strings.HasPrefix(s, "--"):
+			line, s, _ = strings.Cut(s[2:], "\n")
+		case strings.HasPrefix(s, "/*"):
+			_, rest, found := strings.Cut(s[2:], "*/")
+			if !found {
+				return directives
+			}
+			s = rest
+			continue
+		default:
+			return directives
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !found || !lexer_directive_names[key] {
+			continue
+		}
+		if directives == nil {
+			directives = make(map[string]string)
+		}
+		directives[key] = strings.TrimSpace(value)
+	}
+}
+
+// Lexer hands out the tokens of a query one at a time, rather than all in one go.
+// Handy for tooling going through huge (generated) queries, the parser uses lexer() instead.
+type Lexer struct {
+	query         string // the whole query, for error messages
+	s             string // what's left of the query
+	stmt_pos      int    // position of s in the original query
+	started       bool   // leading whitespace and comments have been skipped
+	keep_comments bool   // comments are tokens, see KeepComments()
+	line_start    bool   // s starts a line, for -- comments when they're kept
+}
+
+// Token as seen from outside the package
+type Token struct {
+	Tag    string // regex tag from lexer_symbols.go ("command", "ident", "string", "int", ...), or "comment"
+	Value  string // keyword (upper case), operator or literal - strings without quotes, identifiers without brackets, comments as written
+	Pos    int    // byte offset of this token in the original query string
+	End    int    // byte offset just past this token, including quotes or brackets
+	Source string // source of a qualified identifier: netflow for netflow:src_ip, Value is then src_ip
+}
+
+// NewLexer prepares to tokenise a query, call NextToken() to get the tokens
+func NewLexer(query string) *Lexer {
+	return &Lexer{query: query, s: query}
+}
+
+// KeepComments has NextToken() return comments as well, tagged "comment", in between the other
+// tokens - for a formatter that has to put them back where they were. Call it before NextToken().
+// The parser doesn't use this, it never sees a comment.
+func (l *Lexer) KeepComments() *Lexer {
+	l.keep_comments = true
+	return l
+}
+
+// NextToken returns the next token of the query, or io.EOF once there are no more
+func (l *Lexer) NextToken() (Token, error) {
+	token, ok, error := l.next()
+	if error != nil {
+		return Token{}, error
+	}
+	if !ok {
+		return Token{}, io.EOF
+	}
+
+	return Token{Tag: token.tag, Value: token.val, Source: token.source, Pos: token.stmt_pos, End: token.stmt_end}, nil
+}
+
+// Keywords returns every keyword the lexer recognises, sorted - for autocompletion and the like.
+// Word operators (AND, MOD, LIKE, ...) are in Operators() instead.
+func Keywords() []string {
+	return symbol_names(func(symbol int) bool { return !is_operator(symbol) })
+}
+
+// Operators returns every comparison, arithmetic and logical operator the lexer recognises,
+// in all spellings (=, ==, <>, !=, AND, MOD, ...), sorted.
+func Operators() []string {
+	return symbol_names(is_operator)
+}
+
+func is_operator(symbol int) bool {
+	switch symbol {
+	case sym_and, sym_or, sym_not, sym_like, sym_regex, sym_in:
+		return true
+	}
+	_, comparison := operator_table[symbol]
+	_, arithmetic := arithmetic_table[symbol]
+	return comparison || arithmetic
+}
+
+// Names in the symbol table for which want() is true, punctuation left out.
+// Map keys are unique, so there's no need to deduplicate - DAY and DAYS are both
+// in there as users may type either.
+func symbol_names(want func(symbol int) bool) []string {
+	var names []string
+	for name, symbol := range lexer_symbol_table {
+		switch symbol {
+		case sym_comma, sym_lparen, sym_rparen, sym_pipe:
+			continue
+		}
+		if want(symbol) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Match the next token using regular expressions, ok is false at the end of the query
+func (l *Lexer) next() (lexer_token, bool, error) {
+	var newtoken lexer_token
+
+	if !l.started { // Skip a byte order mark some editors put in, and any leading whitespace and comments
+		if error := l.skip(strings.TrimPrefix(l.s, "\uFEFF"), true); error != nil {
+			return newtoken, false, error
+		}
+		l.started = true
+	}
+
+	s := l.s
+	if len(s) == 0 {
+		return newtoken, false, nil
+	}
+
+	if l.keep_comments {
+		end, error := lexer_comment(s, l.line_start)
+		if error != nil {
+			return newtoken, false, l.error_at(l.stmt_pos, error)
+		}
+		if end > 0 {
+			newtoken = lexer_token{tag: "comment", val: s[:end], stmt_pos: l.stmt_pos, stmt_end: l.stmt_pos + end}
+			if error := l.skip(s[end:], false); error != nil {
+				return newtoken, false, error
+			}
+			return newtoken, true, nil
+		}
+	}
+
+	// Try match each regular expression pattern, in order.
+	// The patterns are anchored, so a match starts at 0 and ends where the token does:
+	// stmt_end comes from the match itself, whatever is taken off result later on.
+	for i := range lexer_regex_table {
+		if match := lexer_regex_table[i].compiled.FindStringIndex(s); match != nil && match[1] > 0 {
+			result := s[:match[1]]
+			newtoken.stmt_end = l.stmt_pos + match[1] // before taking off quotes or brackets
+
+			switch lexer_regex_table[i].tag {
+			case "string": // remove quotes
+				result = result[1 : len(result)-1]
+			case "ident": // values and identifiers are not in the token table
+				if result[0] == '[' { // remove brackets
 					result = result[1 : len(result)-1]
-				case "ident": // values and identifiers are not in the token table
-					result = strings.Trim(result, "[]") // remove brackets - would also accept [[field]] but meh
-				case "int":
-				case "float":
-				default: // the rest are (or should be!) in the token table
-					token, exists := lexer_symbol_table[result]
-					if exists {
-						newtoken.token = token
-					} else {
-						// This can only happen if someone stuffs up in the lexer_symbols.go file
-						return nil, fmt.Errorf("lexer: token '%s' from regex table unknown in symbol table", result)
-					}
+				} else if source, field, qualified := strings.Cut(result, ":"); qualified {
+					newtoken.source = source
+					result = field
+				}
+			case "int":
+			case "float":
+			case "duration":
+			default: // the rest are (or should be!) in the token table
+				// Keywords are case insensitive, and normalised to upper case: find is FIND.
+				// Identifiers and strings keep whatever case the user wrote them in.
+				result = strings.ToUpper(result)
+				token, exists := lexer_symbol_table[result]
+				if exists {
+					newtoken.token = token
+				} else {
+					// This can only happen if someone stuffs up in the lexer_symbols.go file
+					return newtoken, false, fmt.Errorf("lexer: token '%s' from regex table unknown in symbol table", result)
 				}
+			}
 
-				newtoken.tag = lexer_regex_table[i].tag
-				newtoken.val = result
-				newtoken.stmt_pos = stmt_pos
+			newtoken.tag = lexer_regex_table[i].tag
+			newtoken.val = result
+			newtoken.stmt_pos = l.stmt_pos
 
-				tokens = append(tokens, newtoken)
+			if error := l.skip(s[newtoken.stmt_end-l.stmt_pos:], false); error != nil { // remove this token
+				return newtoken, false, error
+			}
 
-				s2 := lexer_regex_table[i].compiled.ReplaceAllString(s, "") // remove this token
-				s2 = strings.TrimSpace(s2)                                  // remove surrounding whitespace (if applicable)
-				stmt_pos += len(s) - len(s2)                                // start of next token
-				s = s2
+			return newtoken, true, nil // we found a match
+		}
+	}
 
-				match = true // we found a match
-				break
-			}
+	return newtoken, false, l.error_at(l.stmt_pos, fmt.Errorf("unknown token or unquoted string at '%s'", s))
+}
+
+// Move on to s, the rest of the query after a token, skipping whitespace and comments up to the
+// next token - or only whitespace when comments are kept, they're tokens then.
+// line_start says whether s starts a line.
+func (l *Lexer) skip(s string, line_start bool) error {
+	var s2 string
+	if l.keep_comments {
+		s2, l.line_start = lexer_space(s, line_start)
+	} else {
+		var error error
+		if s2, error = lexer_skip(s, line_start); error != nil {
+			return l.error_at(len(l.query)-len(s2), error)
+		}
+	}
+
+	l.stmt_pos += len(l.s) - len(s2) // start of next token
+	l.s = s2
+	return nil
+}
+
+// The error, with the line of the query it's on and a caret under the character at pos:
+//
+//	unknown token or unquoted string at '#443 SINCE YESTERDAY'
+//	FIND ALL MATCHING dest_port=#443 SINCE YESTERDAY
+//	                            ^
+func (l *Lexer) error_at(pos int, error error) error {
+	_, size := utf8.DecodeRuneInString(l.query[pos:])
+	return fmt.Errorf("%w\n%s", error, underline(l.query, pos, pos+size))
+}
+
+// How many tokens the lexer and parser get through between looking at the context,
+// checking it for every token would be wasted effort for the usual short query
+const context_check_interval = 256
+
+// token lexer using regular expressions
+func lexer(s string) ([]lexer_token, error) {
+	return lexer_context(context.Background(), s)
+}
+
+// token lexer that gives up when ctx is cancelled, for ParseContext()
+func lexer_context(ctx context.Context, s string) ([]lexer_token, error) {
+	// Rough estimate of the number of tokens, so we don't keep growing the slice.
+	// One extra for the end of statement token appended by the parser.
+	tokens := make([]lexer_token, 0, len(s)/5+2)
+
+	// Tokenise statement(s)
+	l := NewLexer(s)
+	for {
+		newtoken, ok, error := l.next()
+		if error != nil {
+			return nil, error
+		}
+		if !ok {
+			break
 		}
 
-		if !match {
-			return nil, fmt.Errorf("unknown token or unquoted string at '%s'", s)
+		tokens = append(tokens, newtoken)
+
+		if len(tokens)%context_check_interval == 0 {
+			if error := ctx.Err(); error != nil {
+				return nil, error
+			}
 		}
 	}
 
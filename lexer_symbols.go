@@ -26,20 +26,8 @@ As you see, there are multiple tables you need to add to.
 Any keyword or operator in a regex needs to also be added to the symbol tables in this file
 */
 
-type lexer_pre struct {
-	regex    string
-	replace  string
-	compiled *regexp.Regexp
-}
-
-// Taking out line comments, block comments and distinct spacing.
-// The order of these regexes can be important, so we have to use a Go slice rather than a map!
-// Add new entries with care.
-var lexer_pre_table = []lexer_pre{
-	{regex: "//{.}\n", replace: " "},
-	{regex: `/\*{.|\*}\*/`, replace: " "},
-	{regex: "[\t\r\n]", replace: " "},
-}
+// Whitespace and comments (// line and /* block */) between tokens are skipped by lexer_skip() in lexer.go,
+// unless Lexer.KeepComments() asks for them as tokens
 
 /*
 The tags are mainly for debugging purposes, so we can tell which regex a match comes from.
@@ -57,57 +45,74 @@ type lexer_regex struct {
 var lexer_regex_table = []lexer_regex{
 	{tag: "command", regex: `(?i)^(FIND)\b`},
 	{tag: "cmdspec", regex: `(?i)^(ALL)\b`},
-	{tag: "command2", regex: `(?i)^(SORT|GROUP|DISTINCT)\b`},
+	{tag: "command2", regex: `(?i)^(SORT|GROUP|DISTINCT|LIMIT|FORMAT)\b`},
+	{tag: "or", regex: `^[|][|]`}, // || is OR rather than two pipes, so it has to go first
 	{tag: "pipe", regex: `^[|]`},
+	{tag: "order", regex: `(?i)^(ORDER|BY)\b`},
+	{tag: "direction", regex: `(?i)^(ASC|DESC)\b`},
+	{tag: "having", regex: `(?i)^(HAVING)\b`},
 	{tag: "condition", regex: `(?i)^MATCHING\b`},
 	// temporal base
-	{tag: "temporal", regex: `(?i)^(SINCE|BETWEEN)\b`},
+	{tag: "temporal", regex: `(?i)^(SINCE|UNTIL|BETWEEN|ON)\b`},
+	{tag: "exclusive", regex: `(?i)^(EXCLUSIVE)\b`},
 	// temporal scope
-	{tag: "relative", regex: `(?i)^(YESTERDAY|BEFORE|LAST|PREVIOUS|AGO)\b`},
+	{tag: "relative", regex: `(?i)^(FOREVER|YESTERDAY|BEFORE|LAST|PREVIOUS|NEXT|AGO)\b`},
 	{tag: "clocks", regex: `(?i)^(SECONDS|MINUTES|HOURS)\b`},
 	{tag: "clock", regex: `(?i)^(SECOND|MINUTE|HOUR)\b`},
 	{tag: "calendars", regex: `(?i)^(DAYS|WEEKS|FORTNIGHTS|MONTHS|QUARTERS|YEARS|CENTURIES)\b`},
 	{tag: "calendar", regex: `(?i)^(DAY|WEEK|FORTNIGHT|MONTH|QUARTER|YEAR|CENTURY)\b`},
 	{tag: "weekdays", regex: `(?i)^(MONDAYS|TUESDAYS|WEDNESDAYS|THURSDAYS|FRIDAYS|SATURDAYS|SUNDAYS)\b`},
 	{tag: "weekday", regex: `(?i)^(MONDAY|TUESDAY|WEDNESDAY|THURSDAY|FRIDAY|SATURDAY|SUNDAY)\b`},
-	{tag: "months", regex: `(?i)^(JANUARY|FEBRUARY|MARCH|APRIL|MAY|JUNE|JULY|AUGUST|SEPTEMBER|OCTOBER|NOVEMBER|DECEMBER)`},
-	{tag: "mon", regex: `(?i)^(JAN|FEB|MAR|APR|MAY|JUN|JUL|AUG|SEP|OCT|NOV|DEC)`},
+	{tag: "months", regex: `(?i)^(JANUARY|FEBRUARY|MARCH|APRIL|MAY|JUNE|JULY|AUGUST|SEPTEMBER|OCTOBER|NOVEMBER|DECEMBER)\b`},
+	{tag: "mon", regex: `(?i)^(JAN|FEB|MAR|APR|MAY|JUN|JUL|AUG|SEP|OCT|NOV|DEC)\b`},
 	// comma and parentheses
 	{tag: "comma", regex: `^,`},       // comma
 	{tag: "as", regex: `(?i)^(AS)\b`}, // AS alias
 	{tag: "lparen", regex: `^[(]`},    // opening parenthesis
 	{tag: "rparen", regex: `^[)]`},    // closing parenthesis
-	// integers and floating point values - not in symbols list (sym_none)
-	{tag: "int", regex: `(?i)^([-+]?\d+([E]+?\d+)?)`},            // integers, optional E notation
-	{tag: "float", regex: `(?i)^([-+]?\d*\.?\d+([E][-+]?\d+)?)`}, // floating point values
+	// durations, floating point values and integers - not in symbols list (sym_none)
+	// a duration is a number with a unit stuck to it, as for Go's time.ParseDuration: 500ms, 1.5s, 1h30m
+	{tag: "duration", regex: `^(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+\b`},
+	// float goes first and needs a decimal point or a signed exponent (2.5, .5, 1e-3, 1e+3),
+	// otherwise -2.5 would lex as int -2 and float .5
+	{tag: "float", regex: `(?i)^([-+]?(\d*\.\d+(E[-+]?\d+)?|\d+E[-+]\d+))`}, // floating point values
+	{tag: "int", regex: `(?i)^([-+]?\d+(E\d+)?)`},                           // integers, optional E notation (1e3)
+	// Regular expression match, ahead of equal as =~ would otherwise lex as = and an unknown ~
+	{tag: "matches", regex: `(?i)^(=~|MATCHES\b)`},
 	// Binary operands
 	{tag: "minus", regex: `^-`},           // minus
 	{tag: "plus", regex: `^[+]`},          // plus
 	{tag: "mul", regex: `^\*`},            // multiply
-	{tag: "div", regex: `(?i)^(/|DIV)\b`}, // divide
-	{tag: "mod", regex: `(?i)^(%|MOD)\b`}, // modulo
+	{tag: "div", regex: `(?i)^(/|DIV\b)`}, // divide
+	{tag: "mod", regex: `(?i)^(%|MOD\b)`}, // modulo
 	{tag: "less_equal", regex: `^<=`},     // lesser or equal
 	{tag: "greater_equal", regex: `^>=`},  // greater or equal
 	{tag: "equal", regex: `^(==|=)`},      // equal
 	{tag: "not_equal", regex: `^(!=|<>)`}, // not equal
 	{tag: "less", regex: `^<`},            // less
 	{tag: "greater", regex: `^>`},         // greater
+	// Spelled out comparison, ahead of ident as it'd otherwise lex as EQUALS - IGNORE - CASE
+	{tag: "equal_ci", regex: `(?i)^(EQUALS-IGNORE-CASE)\b`}, // equal, ignoring case
 	// Binary operators
-	{tag: "and", regex: `(?i)^(AND)\b`}, // AND
-	{tag: "or", regex: `(?i)^(OR)\b`},   // OR
+	{tag: "and", regex: `(?i)^(AND\b|&&)`}, // AND
+	{tag: "or", regex: `(?i)^(OR)\b`},      // OR
 	// Unary operator
-	{tag: "not", regex: `(?i)^(!|NOT)\b`}, // NOT
+	{tag: "not", regex: `(?i)^(!|NOT\b)`}, // NOT
 	// pattern matchers
 	{tag: "like", regex: `(?i)^(LIKE)\b`},
 	{tag: "regex", regex: `(?i)^(REGEX)\b`},
+	{tag: "contains", regex: `(?i)^(CONTAINS)\b`},
 	// language constructs
 	{tag: "in", regex: `(?i)^(IN)\b`},
 	// strings not in symbols list (sym_none) - (single or double quotes)
 	{tag: "string", regex: `^('[^']*'|"[^"]*")`},
 	// identifiers not in symbols list (sym_none) - always last after all keywords
+	// may start with @ or $ (@timestamp, $meta) and contain periods (user.name)
+	// in [brackets] anything but brackets and newlines goes: [user agent], [k8s.pod/name]
+	// may be qualified by a source, netflow:src_ip - brackets can't be, [a:b] is just a name
 	// functions() check with lookahead(1) that there's a '(' following the function name
 	// ...
-	{tag: "ident", regex: `^([a-zA-Z_][a-zA-Z_.@$]*)|(\[[a-zA-Z_][a-zA-Z_.@$]*)\]`},
+	{tag: "ident", regex: `^(([a-zA-Z_@$][a-zA-Z0-9_.@$]*:)?[a-zA-Z_@$][a-zA-Z0-9_.@$]*|\[[^\[\]\n]+\])`},
 }
 
 // Enumeration of all symbols, order doesn't matter as long as "sym_none = iota" is first
@@ -118,15 +123,27 @@ const (
 	sym_sort
 	sym_group
 	sym_distinct
+	sym_limit
+	sym_format
 	sym_all
 	sym_pipe
+	sym_order
+	sym_by
+	sym_asc
+	sym_desc
+	sym_having
 	sym_matching
 	sym_since
+	sym_until
 	sym_between
+	sym_exclusive
+	sym_on
+	sym_forever
 	sym_yesterday
 	sym_before
 	sym_last
 	sym_previous
+	sym_next
 	sym_ago
 	sym_second
 	sym_minute
@@ -172,12 +189,16 @@ const (
 	sym_not_equal
 	sym_less
 	sym_greater
+	sym_equal_ci
 	sym_and
 	sym_or
 	sym_not
 	sym_like
 	sym_regex
+	sym_contains
+	sym_matches
 	sym_in
+	sym_eof // end of statement, appended by the parser - not in the tables, never lexed
 )
 
 // string -> symbol look-up, order does not matter as long as everything is in here.
@@ -188,13 +209,20 @@ var lexer_symbol_table = map[string]int{
 	"SORT":     sym_sort,
 	"GROUP":    sym_group,
 	"DISTINCT": sym_distinct,
+	"LIMIT":    sym_limit,
+	"FORMAT":   sym_format,
 	"ALL":      sym_all,
 	"|":        sym_pipe,
+	"ORDER":    sym_order,
+	"BY":       sym_by,
+	"ASC":      sym_asc,
+	"DESC":     sym_desc,
+	"HAVING":   sym_having,
 	"MATCHING": sym_matching,
 	// Temporals
-	"SINCE": sym_since, "BETWEEN": sym_between,
-	"YESTERDAY": sym_yesterday, "BEFORE": sym_before, "LAST": sym_last,
-	"PREVIOUS": sym_previous, "AGO": sym_ago,
+	"SINCE": sym_since, "UNTIL": sym_until, "BETWEEN": sym_between, "EXCLUSIVE": sym_exclusive, "ON": sym_on,
+	"FOREVER": sym_forever, "YESTERDAY": sym_yesterday, "BEFORE": sym_before, "LAST": sym_last,
+	"PREVIOUS": sym_previous, "NEXT": sym_next, "AGO": sym_ago,
 	"SECOND": sym_second, "MINUTE": sym_minute, "HOUR": sym_hour,
 	"SECONDS": sym_second, "MINUTES": sym_minute, "HOURS": sym_hour,
 	"DAY": sym_day, "WEEK": sym_week, "FORTNIGHT": sym_fortnight, "MONTH": sym_month,
@@ -211,33 +239,49 @@ var lexer_symbol_table = map[string]int{
 	"APR": sym_april, "MAY": sym_may, "JUN": sym_june,
 	"JUL": sym_july, "AUG": sym_august, "SEP": sym_september,
 	"OCT": sym_october, "NOV": sym_november, "DEC": sym_december,
-	"JANUARY": sym_january, "FEBUARY": sym_february, "MARCH": sym_march,
+	"JANUARY": sym_january, "FEBRUARY": sym_february, "MARCH": sym_march,
 	"APRIL": sym_april /* MAY dup */, "JUNE": sym_june,
 	"JULY": sym_july, "AUGUST": sym_august, "SEPTEMBER": sym_september,
 	"OCTOBER": sym_october, "NOVEMBER": sym_november, "DECEMBER": sym_december,
 	// Operands/operators
-	",": sym_comma, "(": sym_lparen, ")": sym_rparen,
+	",": sym_comma, "AS": sym_as, "(": sym_lparen, ")": sym_rparen,
 	"-": sym_minus, "+": sym_plus,
 	"*": sym_mul, "/": sym_div, "DIV": sym_div, "%": sym_mod, "MOD": sym_mod,
 	"<=": sym_less_equal, ">=": sym_greater_equal,
-	"=": sym_equal, "<>": sym_not_equal, "!=": sym_not_equal,
-	"<": sym_less, ">": sym_greater,
-	"AND": sym_and, "OR": sym_or,
+	"=": sym_equal, "==": sym_equal, "<>": sym_not_equal, "!=": sym_not_equal,
+	"<": sym_less, ">": sym_greater, "EQUALS-IGNORE-CASE": sym_equal_ci,
+	"AND": sym_and, "&&": sym_and, "OR": sym_or, "||": sym_or,
 	"NOT": sym_not, "!": sym_not,
 	// Pattern matchers
 	"LIKE":  sym_like,
 	"REGEX": sym_regex,
+	// Substring
+	"CONTAINS": sym_contains,
+	// Regular expression
+	"MATCHES": sym_matches, "=~": sym_matches,
 	// Language constructs
 	"IN": sym_in,
 	// Functions
 }
 
+// Aggregate functions are lexed as identifiers, the parser recognises them by
+// name when followed by '(' - so a field can still be called "count".
+var aggregate_functions = map[string]bool{
+	"COUNT": true,
+	"SUM":   true,
+	"MIN":   true,
+	"MAX":   true,
+	"AVG":   true,
+}
+
 // Lexer token structure, an array of these is passed to the parser
 type lexer_token struct {
 	tag      string // regex tag from the regex pattern array
 	token    int    // token, or 0 for literals and identifiers
 	val      string // value for literals and identifiers, or ""
-	stmt_pos int    // position of this token in the query string
+	stmt_pos int    // byte offset of this token in the original query string
+	stmt_end int    // byte offset just past this token
+	source   string // source of a qualified identifier: netflow for netflow:src_ip, val is then src_ip
 }
 
 // EOF
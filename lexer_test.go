@@ -18,6 +18,10 @@
 package openacta
 
 import (
+	"io"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -33,4 +37,555 @@ func TestLexer(t *testing.T) {
 	}
 }
 
+func TestLexerIdents(t *testing.T) {
+	idents := []string{"@timestamp", "user.name", "$meta", "src_ip2", "[@timestamp]"}
+
+	for _, ident := range idents {
+		tokens, error := lexer(ident)
+		if error != nil {
+			t.Fatalf("Lexer error: %s", error)
+		}
+		if len(tokens) != 1 || tokens[0].tag != "ident" {
+			t.Errorf("%s: expected a single ident token, got %v", ident, tokens)
+		}
+	}
+}
+
+func TestLexerBracketedIdents(t *testing.T) {
+	idents := map[string]string{
+		"[user agent]":    "user agent",
+		"[k8s.pod/name]":  "k8s.pod/name",
+		"[http-status%]":  "http-status%",
+		"[FIND]":          "FIND",
+		"[  padded  ]":    "  padded  ",
+		"[@timestamp]":    "@timestamp",
+		"[héllo wörld]":   "héllo wörld",
+		"[a, b] [c d]":    "a, b",
+		"[x]=1":           "x",
+		"[select * from]": "select * from",
+	}
+
+	for ident, expected := range idents {
+		tokens, error := lexer(ident)
+		if error != nil {
+			t.Fatalf("%s: Lexer error: %s", ident, error)
+		}
+		if tokens[0].tag != "ident" || tokens[0].val != expected || tokens[0].stmt_pos != 0 {
+			t.Errorf("%s: got %v, expected ident %q", ident, tokens[0], expected)
+		}
+	}
+
+	// The closing bracket is required, and brackets don't nest
+	for _, ident := range []string{"[user agent", "[]", "[[x]]", "[a\nb]"} {
+		if tokens, error := lexer(ident); error == nil && len(tokens) > 0 && tokens[0].tag == "ident" {
+			t.Errorf("%s: expected an error, got %v", ident, tokens)
+		}
+	}
+
+	query, error := Parse("FIND [user agent], [k8s.pod/name] MATCHING [http status]=404 SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if !reflect.DeepEqual(query.Fields, []string{"user agent", "k8s.pod/name"}) || query.Conditions[0][0].Field != "http status" {
+		t.Errorf("fields %v, condition on %s", query.Fields, query.Conditions[0][0].Field)
+	}
+}
+
+func TestLexerComments(t *testing.T) {
+	tests := []struct {
+		statement string
+		vals      []string // token values we expect, comments gone
+	}{
+		{"FIND src_ip SINCE YESTERDAY // trailing comment", []string{"FIND", "src_ip", "SINCE", "YESTERDAY"}},
+		{"// leading\nFIND src_ip\nSINCE YESTERDAY", []string{"FIND", "src_ip", "SINCE", "YESTERDAY"}},
+		{"FIND /* block */ src_ip /* multi\nline */ SINCE YESTERDAY", []string{"FIND", "src_ip", "SINCE", "YESTERDAY"}},
+		{"FIND src_ip MATCHING url='http://example.com/*x*/'", []string{"FIND", "src_ip", "MATCHING", "url", "=", "http://example.com/*x*/"}},
+		{"FIND a /2", []string{"FIND", "a", "/", "2"}},
+	}
+
+	for _, test := range tests {
+		tokens, error := lexer(test.statement)
+		if error != nil {
+			t.Fatalf("Lexer error: %s", error)
+		}
+
+		var vals []string
+		for _, token := range tokens {
+			vals = append(vals, token.val)
+		}
+		if !reflect.DeepEqual(vals, test.vals) {
+			t.Errorf("%q: tokens %q, expected %q", test.statement, vals, test.vals)
+		}
+	}
+
+	if _, error := lexer("FIND src_ip /* never closed"); error == nil {
+		t.Errorf("unterminated block comment accepted")
+	}
+}
+
+func TestLexerPositions(t *testing.T) {
+	const statement = "FIND\tsrc_ip,\r\n\tdest_ip\nMATCHING dest_port=443\n\tSINCE YESTERDAY"
+
+	tokens, error := lexer(statement)
+	if error != nil {
+		t.Fatalf("Lexer error: %s", error)
+	}
+	for _, token := range tokens {
+		if !strings.HasPrefix(statement[token.stmt_pos:], token.val) {
+			t.Errorf("token %q at %d, original has %q there", token.val, token.stmt_pos, statement[token.stmt_pos:])
+		}
+	}
+
+	// Error excerpts quote the original text, tabs and newlines included
+	_, error = lexer("FIND src_ip\n\tMATCHING dest_port=443 ~\n\tSINCE YESTERDAY")
+	if error == nil || !strings.Contains(error.Error(), "at '~\n\tSINCE YESTERDAY'") {
+		t.Errorf("lexer error excerpt doesn't match the original text: %v", error)
+	}
+
+	_, error = Parse("FIND src_ip\n\tMATCHING dest_port=443\n\tSORTED BY\tsrc_ip")
+	if error == nil || !strings.Contains(error.Error(), "at 'SORTED BY\tsrc_ip'") {
+		t.Errorf("parser error excerpt doesn't match the original text: %v", error)
+	}
+}
+
+func TestLexerIterator(t *testing.T) {
+	for _, statement := range statements {
+		tokens, error := lexer(statement)
+		if error != nil {
+			t.Fatalf("Lexer error: %s", error)
+		}
+
+		l := NewLexer(statement)
+		for i := 0; ; i++ {
+			token, error := l.NextToken()
+			if error == io.EOF {
+				if i != len(tokens) {
+					t.Errorf("%s: iterator stopped after %d tokens, expected %d", statement, i, len(tokens))
+				}
+				break
+			}
+			if error != nil {
+				t.Fatalf("Lexer error: %s", error)
+			}
+			if i >= len(tokens) {
+				t.Fatalf("%s: iterator returned more than %d tokens", statement, len(tokens))
+			}
+
+			expected := Token{Tag: tokens[i].tag, Value: tokens[i].val, Source: tokens[i].source, Pos: tokens[i].stmt_pos, End: tokens[i].stmt_end}
+			if token != expected {
+				t.Errorf("%s: token %d is %v, expected %v", statement, i, token, expected)
+			}
+		}
+	}
+
+	// Errors turn up when the iterator gets to them, not before
+	l := NewLexer("FIND src_ip ~")
+	for _, tag := range []string{"command", "ident"} {
+		if token, error := l.NextToken(); error != nil || token.Tag != tag {
+			t.Errorf("expected %s token, got %v %v", tag, token, error)
+		}
+	}
+	if _, error := l.NextToken(); error == nil || error == io.EOF {
+		t.Errorf("expected lexer error, got %v", error)
+	}
+}
+
+func TestLexerSpans(t *testing.T) {
+	const statement = "FIND src_ip, [user.name] MATCHING proto='tcp' BETWEEN 2 DAYS AGO AND YESTERDAY"
+
+	l := NewLexer(statement)
+	for {
+		token, error := l.NextToken()
+		if error == io.EOF {
+			break
+		}
+		if error != nil {
+			t.Fatalf("Lexer error: %s", error)
+		}
+
+		expected := token.Value
+		switch token.Value {
+		case "BETWEEN":
+			if token.End-token.Pos != len("BETWEEN") {
+				t.Errorf("BETWEEN spans %d-%d", token.Pos, token.End)
+			}
+		case "tcp":
+			expected = "'tcp'"
+		case "user.name":
+			expected = "[user.name]"
+		}
+		if span := statement[token.Pos:token.End]; span != expected {
+			t.Errorf("token %q spans %q", token.Value, span)
+		}
+	}
+}
+
+// The lexer's output, pinned down so that optimising it can't change it unnoticed
+func TestLexerOutput(t *testing.T) {
+	const statement = "FIND src_ip, [user.name] AS 'User', COUNT(*) MATCHING bytes / 1024 >= -2 // note\n" +
+		"\tAND dest_port BETWEEN 1 AND 1024 SINCE 2 DAYS AGO | SORT src_ip DESC"
+
+	expected := []lexer_token{
+		{"command", sym_find, "FIND", 0, 4, ""},
+		{"ident", sym_none, "src_ip", 5, 11, ""},
+		{"comma", sym_comma, ",", 11, 12, ""},
+		{"ident", sym_none, "user.name", 13, 24, ""},
+		{"as", sym_as, "AS", 25, 27, ""},
+		{"string", sym_none, "User", 28, 34, ""},
+		{"comma", sym_comma, ",", 34, 35, ""},
+		{"ident", sym_none, "COUNT", 36, 41, ""},
+		{"lparen", sym_lparen, "(", 41, 42, ""},
+		{"mul", sym_mul, "*", 42, 43, ""},
+		{"rparen", sym_rparen, ")", 43, 44, ""},
+		{"condition", sym_matching, "MATCHING", 45, 53, ""},
+		{"ident", sym_none, "bytes", 54, 59, ""},
+		{"div", sym_div, "/", 60, 61, ""},
+		{"int", sym_none, "1024", 62, 66, ""},
+		{"greater_equal", sym_greater_equal, ">=", 67, 69, ""},
+		{"int", sym_none, "-2", 70, 72, ""},
+		{"and", sym_and, "AND", 82, 85, ""},
+		{"ident", sym_none, "dest_port", 86, 95, ""},
+		{"temporal", sym_between, "BETWEEN", 96, 103, ""},
+		{"int", sym_none, "1", 104, 105, ""},
+		{"and", sym_and, "AND", 106, 109, ""},
+		{"int", sym_none, "1024", 110, 114, ""},
+		{"temporal", sym_since, "SINCE", 115, 120, ""},
+		{"int", sym_none, "2", 121, 122, ""},
+		{"calendars", sym_day, "DAYS", 123, 127, ""},
+		{"relative", sym_ago, "AGO", 128, 131, ""},
+		{"pipe", sym_pipe, "|", 132, 133, ""},
+		{"command2", sym_sort, "SORT", 134, 138, ""},
+		{"ident", sym_none, "src_ip", 139, 145, ""},
+		{"direction", sym_desc, "DESC", 146, 150, ""},
+	}
+
+	tokens, error := lexer(statement)
+	if error != nil {
+		t.Fatalf("Lexer error: %s", error)
+	}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("tokens differ:\n%v\nexpected\n%v", tokens, expected)
+	}
+}
+
+func TestLexerNumbers(t *testing.T) {
+	tests := []struct {
+		statement string
+		tags      []string
+		vals      []string
+	}{
+		{"x=1e+3", []string{"ident", "equal", "float"}, []string{"x", "", "1e+3"}},
+		{"x=1e-3", []string{"ident", "equal", "float"}, []string{"x", "", "1e-3"}},
+		{"1E-3<x", []string{"float", "less", "ident"}, []string{"1E-3", "", "x"}},
+		{"-1e+3>=x", []string{"float", "greater_equal", "ident"}, []string{"-1e+3", "", "x"}},
+		{"x>-2.5E-3", []string{"ident", "greater", "float"}, []string{"x", "", "-2.5E-3"}},
+		{"x=-2.5", []string{"ident", "equal", "float"}, []string{"x", "", "-2.5"}},
+		{"x=.5", []string{"ident", "equal", "float"}, []string{"x", "", ".5"}},
+		{"x=1e3", []string{"ident", "equal", "int"}, []string{"x", "", "1e3"}},
+		{"x=-42", []string{"ident", "equal", "int"}, []string{"x", "", "-42"}},
+	}
+
+	for _, test := range tests {
+		tokens, error := lexer(test.statement)
+		if error != nil {
+			t.Fatalf("%s: Lexer error: %s", test.statement, error)
+		}
+
+		var tags, vals []string
+		for _, token := range tokens {
+			tags = append(tags, token.tag)
+			val := token.val
+			if token.token != sym_none {
+				val = ""
+			}
+			vals = append(vals, val)
+		}
+		if !reflect.DeepEqual(tags, test.tags) || !reflect.DeepEqual(vals, test.vals) {
+			t.Errorf("%s: %v %q, expected %v %q", test.statement, tags, vals, test.tags, test.vals)
+		}
+	}
+}
+
+func TestLexerSymbolicBooleans(t *testing.T) {
+	tests := map[string][]int{
+		"a=1 && b=2":       {sym_none, sym_equal, sym_none, sym_and, sym_none, sym_equal, sym_none},
+		"a=1||b=2":         {sym_none, sym_equal, sym_none, sym_or, sym_none, sym_equal, sym_none},
+		"YESTERDAY | SORT": {sym_yesterday, sym_pipe, sym_sort},
+		"YESTERDAY|SORT":   {sym_yesterday, sym_pipe, sym_sort},
+		"a ||| b":          {sym_none, sym_or, sym_pipe, sym_none},
+	}
+
+	for statement, expected := range tests {
+		tokens, error := lexer(statement)
+		if error != nil {
+			t.Fatalf("%s: Lexer error: %s", statement, error)
+		}
+		var symbols []int
+		for _, token := range tokens {
+			symbols = append(symbols, token.token)
+		}
+		if !reflect.DeepEqual(symbols, expected) {
+			t.Errorf("%s: symbols %v, expected %v", statement, symbols, expected)
+		}
+	}
+
+	symbolic, error := Parse("FIND x MATCHING a=1 && b=2 || c=3 SINCE YESTERDAY | SORT x")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	words, error := Parse("FIND x MATCHING a=1 AND b=2 OR c=3 SINCE YESTERDAY | SORT x")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if !reflect.DeepEqual(symbolic.Conditions, words.Conditions) || !reflect.DeepEqual(symbolic.Sort, words.Sort) {
+		t.Errorf("&& and || parse differently from AND and OR: %v, %v", symbolic.Conditions, words.Conditions)
+	}
+}
+
+func TestLexerCase(t *testing.T) {
+	tokens, error := lexer("find Src_IP, [User Agent] matching Dest_Port = 443 And host='Web01' since Last Week | Sort Src_IP desc")
+	if error != nil {
+		t.Fatalf("Lexer error: %s", error)
+	}
+
+	var vals []string
+	for _, token := range tokens {
+		vals = append(vals, token.val)
+	}
+	expected := []string{"FIND", "Src_IP", ",", "User Agent", "MATCHING", "Dest_Port", "=", "443", "AND", "host", "=", "Web01",
+		"SINCE", "LAST", "WEEK", "|", "SORT", "Src_IP", "DESC"}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Errorf("values %q, expected %q", vals, expected)
+	}
+
+	query, error := Parse("find Src_IP, dest_IP matching Dest_Port=443 since yesterday | group Src_IP, dest_IP")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if !reflect.DeepEqual(query.Fields, []string{"Src_IP", "dest_IP"}) || query.Conditions[0][0].Field != "Dest_Port" ||
+		!reflect.DeepEqual(query.Group, []string{"Src_IP", "dest_IP"}) {
+		t.Errorf("fields %q, condition on %q, group %q", query.Fields, query.Conditions[0][0].Field, query.Group)
+	}
+
+	// A keyword has to be the whole word: these are fields that start with a month (MAR, JUN, DEC, MAY)
+	query, error = Parse("FIND marker, junk, Mayday MATCHING decimal=1 AND march_total > 2 SINCE yesterday")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if !reflect.DeepEqual(query.Fields, []string{"marker", "junk", "Mayday"}) || !reflect.DeepEqual(query.ReferencedFields(), []string{"Mayday", "decimal", "junk", "march_total", "marker"}) {
+		t.Errorf("fields %q, referenced %q", query.Fields, query.ReferencedFields())
+	}
+}
+
+func TestLexerUnicodeSpace(t *testing.T) {
+	tests := []string{
+		"\uFEFFFIND src_ip SINCE YESTERDAY",
+		"\uFEFF  \n FIND src_ip SINCE YESTERDAY",
+		"FIND\u00A0src_ip\u00A0SINCE\u00A0YESTERDAY",
+		"\u00A0FIND src_ip\u2003SINCE YESTERDAY\u00A0",
+	}
+
+	for _, statement := range tests {
+		tokens, error := lexer(statement)
+		if error != nil {
+			t.Fatalf("%q: Lexer error: %s", statement, error)
+		}
+		if len(tokens) != 4 || tokens[0].token != sym_find || tokens[1].val != "src_ip" {
+			t.Errorf("%q: tokens %v", statement, tokens)
+		}
+		// Positions still point into the query as given
+		for _, token := range tokens {
+			if !strings.EqualFold(statement[token.stmt_pos:token.stmt_end], token.val) {
+				t.Errorf("%q: token %v is %q in the query", statement, token, statement[token.stmt_pos:token.stmt_end])
+			}
+		}
+
+		if _, error := Parse(statement); error != nil {
+			t.Errorf("%q: Parse error: %s", statement, error)
+		}
+	}
+
+	// Only at the start, elsewhere it's not whitespace
+	if _, error := lexer("FIND src_ip \uFEFFSINCE YESTERDAY"); error == nil {
+		t.Errorf("byte order mark in the middle: expected an error")
+	}
+}
+
+func TestLexerErrorCaret(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string // last two lines of the error
+	}{
+		{"FIND ALL MATCHING dest_port=#443 SINCE YESTERDAY",
+			"FIND ALL MATCHING dest_port=#443 SINCE YESTERDAY\n                            ^"},
+		{"FIND ALL\n\tMATCHING name=\"x\" AND ~y SINCE YESTERDAY",
+			"\tMATCHING name=\"x\" AND ~y SINCE YESTERDAY\n\t                      ^"},
+		{"FIND ALL /* never closed SINCE YESTERDAY",
+			"FIND ALL /* never closed SINCE YESTERDAY\n         ^"},
+		{"FIND ALL MATCHING name='naïve' AND x=¬1",
+			"FIND ALL MATCHING name='naïve' AND x=¬1\n" + strings.Repeat(" ", 37) + "^"},
+	}
+
+	for _, test := range tests {
+		_, error := lexer(test.query)
+		if error == nil {
+			t.Errorf("%s: expected an error", test.query)
+			continue
+		}
+		if !strings.HasSuffix(error.Error(), "\n"+test.expected) {
+			t.Errorf("%q: error\n%s\nexpected to end in\n%s", test.query, error, test.expected)
+		}
+	}
+}
+
+func TestLexerSQLComments(t *testing.T) {
+	tests := []struct {
+		query  string
+		values []string
+	}{
+		{"-- comment\nFIND ALL", []string{"FIND", "ALL"}},
+		{"FIND ALL\n  -- comment\nSINCE", []string{"FIND", "ALL", "SINCE"}},
+		{"FIND ALL /* block */ \n-- comment", []string{"FIND", "ALL"}},
+		{"a--1", []string{"a", "-", "-1"}}, // not at the start of a line
+		{"a -- 1", []string{"a", "-", "-", "1"}},
+	}
+
+	for _, test := range tests {
+		tokens, error := lexer(test.query)
+		if error != nil {
+			t.Errorf("%q: lexer error: %s", test.query, error)
+			continue
+		}
+		var values []string
+		for _, token := range tokens {
+			values = append(values, token.val)
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%q: tokens %q, expected %q", test.query, values, test.values)
+		}
+	}
+}
+
+// Quotes and brackets come off the value, but not off the position of the token
+func TestTokenPositions(t *testing.T) {
+	const statement = "FIND [user agent], x MATCHING [k8s.pod/name] = \"a 'b' c\" AND msg = 'café' SINCE YESTERDAY"
+
+	tests := []struct {
+		value string
+		text  string // the token as written
+	}{
+		{"user agent", "[user agent]"},
+		{"k8s.pod/name", "[k8s.pod/name]"},
+		{"a 'b' c", "\"a 'b' c\""},
+		{"café", "'café'"},
+		{"YESTERDAY", "YESTERDAY"},
+	}
+
+	tokens, error := lexer(statement)
+	if error != nil {
+		t.Fatalf("Lexer error: %s", error)
+	}
+	for _, test := range tests {
+		found := false
+		for _, token := range tokens {
+			if token.val != test.value {
+				continue
+			}
+			found = true
+			if text := statement[token.stmt_pos:token.stmt_end]; text != test.text {
+				t.Errorf("%s: at %d to %d is %s, expected %s", test.value, token.stmt_pos, token.stmt_end, text, test.text)
+			}
+		}
+		if !found {
+			t.Errorf("no token %s", test.value)
+		}
+	}
+}
+
+func TestLexerKeepComments(t *testing.T) {
+	const statement = "-- name: test\nFIND src_ip /* block */ MATCHING a--1 // trailing"
+
+	tokens := func(l *Lexer) []Token {
+		var tokens []Token
+		for {
+			token, error := l.NextToken()
+			if error == io.EOF {
+				return tokens
+			}
+			if error != nil {
+				t.Fatalf("Lexer error: %s", error)
+			}
+			tokens = append(tokens, token)
+		}
+	}
+
+	var comments []string
+	for _, token := range tokens(NewLexer(statement).KeepComments()) {
+		if token.Tag != "comment" {
+			continue
+		}
+		if span := statement[token.Pos:token.End]; span != token.Value {
+			t.Errorf("comment %q spans %q", token.Value, span)
+		}
+		comments = append(comments, token.Value)
+	}
+	expected := []string{"-- name: test", "/* block */", "// trailing"}
+	if !reflect.DeepEqual(comments, expected) {
+		t.Errorf("comments %q, expected %q", comments, expected)
+	}
+
+	for _, token := range tokens(NewLexer(statement)) {
+		if token.Tag == "comment" {
+			t.Errorf("comment token %q without KeepComments()", token.Value)
+		}
+	}
+
+	if _, error := NewLexer("FIND src_ip /* never closed").KeepComments().NextToken(); error != nil {
+		t.Errorf("error before getting to the comment: %s", error)
+	}
+	l := NewLexer("FIND /* never closed").KeepComments()
+	l.NextToken()
+	if _, error := l.NextToken(); error == nil || error == io.EOF {
+		t.Errorf("unterminated block comment accepted")
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	keywords := Keywords()
+	operators := Operators()
+
+	for _, list := range [][]string{keywords, operators} {
+		if !sort.StringsAreSorted(list) {
+			t.Errorf("not sorted: %v", list)
+		}
+		for i := 1; i < len(list); i++ {
+			if list[i] == list[i-1] {
+				t.Errorf("duplicate %s", list[i])
+			}
+		}
+	}
+
+	for _, keyword := range []string{"FIND", "MATCHING", "SINCE", "DAY", "DAYS", "FEBRUARY", "HAVING"} {
+		if !in_list(keyword, keywords) {
+			t.Errorf("keyword %s missing", keyword)
+		}
+	}
+	for _, operator := range []string{"=", "<>", "AND", "MOD", "+"} {
+		if !in_list(operator, operators) {
+			t.Errorf("operator %s missing", operator)
+		}
+		if in_list(operator, keywords) {
+			t.Errorf("operator %s in keywords", operator)
+		}
+	}
+
+	// Everything we hand out has to lex back to a single token
+	for _, name := range append(keywords, operators...) {
+		tokens, error := lexer(name)
+		if error != nil || len(tokens) != 1 || tokens[0].token == sym_none {
+			t.Errorf("%s: lexes to %v (error %v)", name, tokens, error)
+		}
+	}
+}
+
 // EOF
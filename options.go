@@ -0,0 +1,128 @@
+// OpenActa - Parser options
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import "time"
+
+/*
+Options change how a statement is parsed, they're passed to ParseWithOptions().
+Parse() uses the defaults.
+*/
+
+type Options struct {
+	// Relative temporal references (LAST WEEK, 2 DAYS AGO) are resolved against this clock.
+	// Defaults to time.Now, tests pin it to a known date.
+	Now func() time.Time
+
+	// Every statement needs a temporal clause (SINCE or BETWEEN), on by default.
+	// Without it, a statement that has none runs from now on with no end, for a live tail.
+	RequireTemporal bool
+
+	// How far back SINCE goes when there's nothing after it, "FIND ALL SINCE | SORT @timestamp".
+	// 0 (default) makes that an error.
+	DefaultLookback time.Duration
+
+	// Calendar references (YESTERDAY, LAST MONDAY, a date without a timezone) are in this location,
+	// whatever location the clock or the machine is in. Defaults to UTC.
+	Location *time.Location
+
+	// Month, quarter and year arithmetic stays within the target month,
+	// so LAST MONTH on 31 March is 29 February (leap year) rather than 2 March.
+	StrictCalendar bool
+
+	// What LAST QUARTER, 2 QUARTERS AGO etc. refer to, see QuarterMode.
+	QuarterMode QuarterMode
+
+	// A statement may start with MATCHING, SINCE or BETWEEN, implying FIND ALL.
+	// Handy in a REPL, off by default.
+	ImplicitFindAll bool
+
+	// Canonical name for a field, e.g. "sip" -> "src_ip", applied to every field reference.
+	// Aliases are left as they are: "FIND sip AS source" gives field src_ip, alias source.
+	// Fields without an alias keep the name as written for their alias.
+	FieldResolver func(field string) string
+
+	// Quoted strings in MATCHING and HAVING compare without regard to case, so name='Admin' also matches admin.
+	// Sets IgnoreCase on those predicates, EQUALS-IGNORE-CASE does the same for a single comparison.
+	CaseInsensitiveStrings bool
+
+	// Known field names. When set and AllowUnknownFields is false, fields in the
+	// field list and MATCHING clause have to be in here.
+	Schema []string
+
+	// Type of value per field. A comparison against a value that doesn't fit is an error,
+	// dest_port='abc' with dest_port a FieldInt. Fields that aren't in here take anything.
+	FieldTypes map[string]FieldType
+
+	// Accept fields that aren't in the Schema (default).
+	// Without a Schema this has no effect, as there's nothing to check against.
+	AllowUnknownFields bool
+
+	// Seed for SORT RANDOM, handed on as Query.RandomSeed so the order can be reproduced,
+	// in tests for instance. 0 leaves it to whoever runs the query.
+	RandomSeed int64
+
+	// Limits on MATCHING and HAVING, so a generated or hostile query can't swamp whatever
+	// evaluates it. MaxConditions counts the comparisons in both clauses together,
+	// MaxConditionDepth is how deep parentheses and signs may nest. 0 is no limit.
+	MaxConditions     int
+	MaxConditionDepth int
+
+	// Reject statements that would have the backend go through everything: a time range
+	// that's open at either end (SINCE FOREVER), or longer than MaxScanWindow if that's set.
+	// A live tail without a temporal clause (RequireTemporal off) only looks at new data, that's fine.
+	ForbidFullScan bool
+	MaxScanWindow  time.Duration
+
+	// Any warning (a date without a time of day in BETWEEN, a field compared with both a number
+	// and a string, ...) fails the parse, for checking saved searches before they go live.
+	// Otherwise warnings are only advice, see Query.Warnings().
+	WarningsAsErrors bool
+
+	// A time range that ends before it starts, BETWEEN YESTERDAY AND LAST WEEK, is an error rather
+	// than quietly turned around, so a typo in a date doesn't go unnoticed.
+	StrictRange bool
+}
+
+type QuarterMode int
+
+const (
+	// A quarter is 3 months back from now, wherever that lands (default).
+	QuarterRolling QuarterMode = iota
+	// A quarter is a calendar quarter: Jan-Mar, Apr-Jun, Jul-Sep or Oct-Dec.
+	// On 15 May, LAST QUARTER is 1 Jan through 31 Mar.
+	QuarterCalendar
+)
+
+type FieldType int
+
+const (
+	FieldAny    FieldType = iota // anything goes
+	FieldInt                     // integer, or a quoted integer
+	FieldFloat                   // integer or floating point value, or quoted
+	FieldString                  // anything goes, but it's compared as a string
+	FieldIP                      // quoted IP address or CIDR range, '10.0.0.0/8'
+)
+
+// DefaultOptions returns the options Parse() uses.
+// Start from these rather than Options{}, as not every default is a zero value.
+func DefaultOptions() Options {
+	return Options{AllowUnknownFields: true, RequireTemporal: true, MaxConditions: 1000, MaxConditionDepth: 32}
+}
+
+// EOF
@@ -0,0 +1,497 @@
+// OpenActa - Parser options tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A clock stopped at the given time, for Options.Now
+func pinned_clock(layout string) func() time.Time {
+	t, err := time.Parse(time.DateTime, layout)
+	if err != nil {
+		panic(err)
+	}
+	return func() time.Time { return t }
+}
+
+func TestStrictCalendar(t *testing.T) {
+	tests := []struct {
+		now       string
+		statement string
+		loose     string // time.AddDate normalisation
+		strict    string // StrictCalendar
+	}{
+		// leap year February
+		{"2024-03-31 12:00:00", "FIND x SINCE LAST MONTH", "2024-03-02", "2024-02-29"},
+		{"2024-02-29 12:00:00", "FIND x SINCE LAST YEAR", "2023-03-01", "2023-02-28"},
+		// 31 day month into a 30 day month
+		{"2023-05-31 12:00:00", "FIND x SINCE LAST MONTH", "2023-05-01", "2023-04-30"},
+		{"2023-05-31 12:00:00", "FIND x SINCE LAST QUARTER", "2023-03-03", "2023-02-28"},
+		// nothing to clamp
+		{"2023-05-15 12:00:00", "FIND x SINCE LAST MONTH", "2023-04-15", "2023-04-15"},
+	}
+
+	for _, test := range tests {
+		for _, strict := range []bool{false, true} {
+			query, error := ParseWithOptions(test.statement, Options{Now: pinned_clock(test.now), StrictCalendar: strict})
+			if error != nil {
+				t.Fatalf("Parse error: %s", error)
+			}
+
+			expected := test.loose
+			if strict {
+				expected = test.strict
+			}
+			if from := time.Unix(0, query.TimeFrom).UTC().Format(time.DateOnly); from != expected {
+				t.Errorf("%s at %s (strict %v): starts %s, expected %s", test.statement, test.now, strict, from, expected)
+			}
+		}
+	}
+}
+
+func TestAllowUnknownFields(t *testing.T) {
+	schema := []string{"src_ip", "dest_ip", "dest_port", "bytes"}
+
+	tests := []string{
+		"FIND src_ip MATCHING typofield=1 SINCE YESTERDAY",
+		"FIND src_ip, typofield SINCE YESTERDAY",
+		"FIND SUM(typofield) SINCE YESTERDAY",
+	}
+
+	for _, statement := range tests {
+		options := DefaultOptions()
+		options.Schema = schema
+		if _, error := ParseWithOptions(statement, options); error != nil {
+			t.Errorf("%s: unknown field rejected by default: %s", statement, error)
+		}
+
+		options.AllowUnknownFields = false
+		_, error := ParseWithOptions(statement, options)
+		if error == nil || !strings.Contains(error.Error(), "unknown field typofield") {
+			t.Errorf("%s: expected unknown field error, got %v", statement, error)
+		}
+	}
+
+	// Known fields, function names and aliases are all fine
+	options := Options{Schema: schema}
+	if _, error := ParseWithOptions("FIND src_ip AS source, SUM(bytes) AS total MATCHING dest_port=443 SINCE YESTERDAY | GROUP src_ip", options); error != nil {
+		t.Errorf("known fields rejected: %s", error)
+	}
+}
+
+func TestQuarterMode(t *testing.T) {
+	tests := []struct {
+		statement string
+		mode      QuarterMode
+		from      string
+		to        string
+	}{
+		{"FIND x SINCE LAST QUARTER", QuarterRolling, "2024-02-15 00:00:00", "2024-05-15 12:00:00"},
+		{"FIND x SINCE LAST QUARTER", QuarterCalendar, "2024-01-01 00:00:00", "2024-05-15 12:00:00"},
+		{"FIND x BETWEEN LAST QUARTER AND LAST QUARTER", QuarterCalendar, "2024-01-01 00:00:00", "2024-03-31 23:59:59"},
+		{"FIND x BETWEEN 2 QUARTERS AGO AND LAST QUARTER", QuarterCalendar, "2023-10-01 00:00:00", "2024-03-31 23:59:59"},
+		{"FIND x SINCE 5 QUARTERS AGO", QuarterCalendar, "2023-01-01 00:00:00", "2024-05-15 12:00:00"},
+	}
+
+	for _, test := range tests {
+		options := DefaultOptions()
+		options.Now = pinned_clock("2024-05-15 12:00:00")
+		options.QuarterMode = test.mode
+
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Fatalf("Parse error: %s", error)
+		}
+
+		from := time.Unix(0, query.TimeFrom).UTC().Format(time.DateTime)
+		to := time.Unix(0, query.TimeTo).UTC().Format(time.DateTime)
+		if from != test.from || to != test.to {
+			t.Errorf("%s (mode %d): %s to %s, expected %s to %s", test.statement, test.mode, from, to, test.from, test.to)
+		}
+		if query.TimeTo%temp_second != 0 { // the last second of a quarter, as for a day or a month
+			t.Errorf("%s (mode %d): end %d is not on a whole second", test.statement, test.mode, query.TimeTo)
+		}
+	}
+}
+
+func TestImplicitFindAll(t *testing.T) {
+	options := DefaultOptions()
+	options.ImplicitFindAll = true
+
+	for _, statement := range []string{"SINCE LAST HOUR", "MATCHING dest_port=443 SINCE LAST HOUR", "BETWEEN 2 DAYS AGO AND YESTERDAY"} {
+		query, error := ParseWithOptions(statement, options)
+		if error != nil {
+			t.Fatalf("Parse error: %s", error)
+		}
+		explicit, error := ParseWithOptions("FIND ALL "+statement, options)
+		if error != nil {
+			t.Fatalf("Parse error: %s", error)
+		}
+		if !query.All || !reflect.DeepEqual(query.Conditions, explicit.Conditions) {
+			t.Errorf("%s: %+v, expected the same as FIND ALL: %+v", statement, query, explicit)
+		}
+
+		if _, error := Parse(statement); error == nil || !strings.Contains(error.Error(), "expected statement") {
+			t.Errorf("%s: expected error without ImplicitFindAll, got %v", statement, error)
+		}
+	}
+
+	// Only the temporal and MATCHING clauses imply FIND ALL
+	if _, error := ParseWithOptions("src_ip SINCE LAST HOUR", options); error == nil {
+		t.Errorf("statement starting with a field accepted")
+	}
+}
+
+func TestFieldResolver(t *testing.T) {
+	synonyms := map[string]string{"sip": "src_ip", "dip": "dest_ip", "dport": "dest_port"}
+
+	options := DefaultOptions()
+	options.FieldResolver = func(field string) string {
+		if canonical, exists := synonyms[field]; exists {
+			return canonical
+		}
+		return field
+	}
+
+	query, error := ParseWithOptions("FIND sip, dip AS destination, COUNT(DISTINCT dport) MATCHING sip='10.0.0.1' OR dport % 2 = 0 "+
+		"SINCE YESTERDAY | GROUP sip, dip HAVING count_distinct_dest_port > 1 | SORT dip", options)
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+
+	if expected := []string{"src_ip", "dest_ip"}; !reflect.DeepEqual(query.Fields, expected) {
+		t.Errorf("fields %v, expected %v", query.Fields, expected)
+	}
+	if expected := []string{"sip", "destination"}; !reflect.DeepEqual(query.Aliases, expected) {
+		t.Errorf("aliases %v, expected %v", query.Aliases, expected)
+	}
+	if field := query.Aggregates[0].Field; field != "dest_port" {
+		t.Errorf("aggregate field %s, expected dest_port", field)
+	}
+	if field := query.Conditions[0][0].Field; field != "src_ip" {
+		t.Errorf("condition field %s, expected src_ip", field)
+	}
+	if field := query.Conditions[1][0].Expr.Left.Field; field != "dest_port" {
+		t.Errorf("condition expression field %s, expected dest_port", field)
+	}
+	if expected := []string{"src_ip", "dest_ip"}; !reflect.DeepEqual(query.Group, expected) {
+		t.Errorf("group %v, expected %v", query.Group, expected)
+	}
+	if field := query.Sort[0].Field; field != "dest_ip" {
+		t.Errorf("sort field %s, expected dest_ip", field)
+	}
+}
+
+func TestCaseInsensitiveStrings(t *testing.T) {
+	tests := []struct {
+		statement string
+		option    bool
+		expected  []bool // IgnoreCase per predicate
+	}{
+		{"FIND x MATCHING name='Admin' SINCE YESTERDAY", false, []bool{false}},
+		{"FIND x MATCHING name='Admin' SINCE YESTERDAY", true, []bool{true}},
+		{"FIND x MATCHING name EQUALS-IGNORE-CASE 'Admin' SINCE YESTERDAY", false, []bool{true}},
+		{"FIND x MATCHING name EQUALS-IGNORE-CASE 'Admin' AND role='Ops' SINCE YESTERDAY", false, []bool{true, false}},
+		// only quoted strings
+		{"FIND x MATCHING dest_port=443 AND name!='Admin' SINCE YESTERDAY", true, []bool{false, true}},
+		{"FIND x MATCHING name BETWEEN 'a' AND 'm' SINCE YESTERDAY", true, []bool{true}},
+	}
+
+	for _, test := range tests {
+		options := DefaultOptions()
+		options.CaseInsensitiveStrings = test.option
+
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", test.statement, error)
+		}
+
+		var ignore_case []bool
+		for _, predicate := range query.Conditions[0] {
+			ignore_case = append(ignore_case, predicate.IgnoreCase)
+		}
+		if !reflect.DeepEqual(ignore_case, test.expected) {
+			t.Errorf("%s (option %v): ignore case %v, expected %v", test.statement, test.option, ignore_case, test.expected)
+		}
+	}
+}
+
+func TestConditionLimits(t *testing.T) {
+	defer func(w io.Writer) { trace = w }(trace)
+	trace = io.Discard
+
+	options := DefaultOptions()
+	options.MaxConditions = 10
+	options.MaxConditionDepth = 4
+
+	conditions := func(n int) string {
+		var list []string
+		for i := 0; i < n; i++ {
+			list = append(list, fmt.Sprintf("dest_port=%d", i))
+		}
+		return "FIND x MATCHING " + strings.Join(list, " OR ") + " SINCE YESTERDAY"
+	}
+	nested := func(n int) string {
+		return "FIND x MATCHING " + strings.Repeat("(", n) + "bytes" + strings.Repeat(")", n) + " > 1 SINCE YESTERDAY"
+	}
+
+	tests := []struct {
+		statement string
+		error     string
+	}{
+		{conditions(10), ""},
+		{conditions(11), "too many conditions"},
+		{"FIND x, COUNT(*) AS n MATCHING dest_port=1 SINCE YESTERDAY | GROUP x HAVING " + strings.Repeat("n > 1 AND ", 9) + "n > 1", "too many conditions"},
+		{nested(4), ""},
+		{nested(5), "nested too deep"},
+		{"FIND x MATCHING - - - -bytes > 1 SINCE YESTERDAY", ""},
+		{"FIND x MATCHING - - - - -bytes > 1 SINCE YESTERDAY", "nested too deep"},
+		// depth is per condition, not added up
+		{"FIND x MATCHING ((((a)))) = 1 AND ((((b)))) = 2 SINCE YESTERDAY", ""},
+	}
+
+	for _, test := range tests {
+		_, error := ParseWithOptions(test.statement, options)
+		if test.error == "" && error != nil {
+			t.Errorf("%s: Parse error: %s", test.statement, error)
+		}
+		if test.error != "" && (error == nil || !strings.Contains(error.Error(), test.error)) {
+			t.Errorf("%s: expected error %q, got %v", test.statement, test.error, error)
+		}
+	}
+
+	// No limits
+	if _, error := ParseWithOptions(conditions(2000), Options{}); error != nil {
+		t.Errorf("without limits: Parse error: %s", error)
+	}
+}
+
+func TestLocation(t *testing.T) {
+	// Whatever timezone the machine is in, calendar references are in UTC
+	saved := time.Local
+	time.Local = time.FixedZone("AEST", 10*3600)
+	defer func() { time.Local = saved }()
+
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		statement string
+		location  *time.Location
+		from, to  string // in UTC
+	}{
+		{"FIND ALL SINCE YESTERDAY", nil, "2024-05-14 00:00:00", "2024-05-15 12:00:00"},
+		{"FIND ALL BETWEEN DAY BEFORE YESTERDAY AND YESTERDAY", nil, "2024-05-13 00:00:00", "2024-05-14 23:59:59"},
+		{"FIND ALL SINCE LAST MONDAY", nil, "2024-05-13 00:00:00", "2024-05-15 12:00:00"},
+		{"FIND ALL SINCE LAST APRIL", nil, "2024-04-01 00:00:00", "2024-05-15 12:00:00"},
+		{"FIND ALL BETWEEN '2024-05-01' AND '2024-05-02 06:00:00'", nil, "2024-05-01 00:00:00", "2024-05-02 06:00:00"},
+		// Taken in another timezone when asked for, it's 22:00 on the 15th in Brisbane
+		{"FIND ALL SINCE YESTERDAY", time.Local, "2024-05-13 14:00:00", "2024-05-15 12:00:00"},
+		{"FIND ALL BETWEEN '2024-05-01' AND '2024-05-02 06:00:00'", time.Local, "2024-04-30 14:00:00", "2024-05-01 20:00:00"},
+	}
+
+	for _, test := range tests {
+		options := DefaultOptions()
+		options.Now = func() time.Time { return now.In(time.Local) } // clock in the machine's timezone
+		options.Location = test.location
+
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Errorf("%s: Parse error: %s", test.statement, error)
+			continue
+		}
+		from := time.Unix(0, query.TimeFrom).UTC().Format(time.DateTime)
+		to := time.Unix(0, query.TimeTo).UTC().Format(time.DateTime)
+		if from != test.from || to != test.to {
+			t.Errorf("%s: %s to %s, expected %s to %s", test.statement, from, to, test.from, test.to)
+		}
+	}
+}
+
+func TestRequireTemporal(t *testing.T) {
+	statements := []string{
+		"FIND ALL MATCHING severity='high'",
+		"FIND src_ip MATCHING severity='high' | SORT src_ip",
+		"FIND src_ip",
+	}
+
+	for _, statement := range statements {
+		if _, error := Parse(statement); error == nil || !strings.Contains(error.Error(), "expected temporal clause") {
+			t.Errorf("%s: expected a temporal clause error, got %v", statement, error)
+		}
+	}
+
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+	options.RequireTemporal = false
+	now := options.Now().UnixNano()
+	for _, statement := range statements {
+		query, error := ParseWithOptions(statement, options)
+		if error != nil {
+			t.Errorf("%s: Parse error: %s", statement, error)
+			continue
+		}
+		if query.TimeFrom != now || query.TemporalPredicate().ToBounded {
+			t.Errorf("%s: range %v, expected from now without an end", statement, query.TemporalPredicate())
+		}
+	}
+
+	// A clause that is there still counts
+	query, error := ParseWithOptions("FIND ALL SINCE YESTERDAY", options)
+	if error != nil || query.TimeTo != now {
+		t.Errorf("SINCE YESTERDAY: %v, time to %d", error, query.TimeTo)
+	}
+
+	// The range it ran with can be put in
+	query, _ = ParseWithOptions("FIND src_ip MATCHING severity='high' | SORT src_ip", options)
+	if expanded := query.ExpandTemporal(); expanded != "FIND src_ip MATCHING severity='high' BETWEEN '2024-05-15T12:00:00Z' AND FOREVER | SORT src_ip" {
+		t.Errorf("expanded to %s", expanded)
+	}
+	query, _ = ParseWithOptions("FIND src_ip", options)
+	if expanded := query.ExpandTemporal(); expanded != "FIND src_ip BETWEEN '2024-05-15T12:00:00Z' AND FOREVER" {
+		t.Errorf("expanded to %s", expanded)
+	}
+}
+
+func TestDefaultLookback(t *testing.T) {
+	statements := []string{
+		"FIND ALL SINCE",
+		"FIND ALL MATCHING severity='high' SINCE | SORT @timestamp",
+		"FIND src_ip SINCE ORDER BY src_ip",
+	}
+
+	for _, statement := range statements {
+		if _, error := Parse(statement); error == nil {
+			t.Errorf("%s: expected an error without DefaultLookback", statement)
+		}
+	}
+
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+	options.DefaultLookback = 15 * time.Minute
+	for _, statement := range statements {
+		query, error := ParseWithOptions(statement, options)
+		if error != nil {
+			t.Errorf("%s: Parse error: %s", statement, error)
+			continue
+		}
+		from := time.Unix(0, query.TimeFrom).UTC().Format(time.DateTime)
+		to := time.Unix(0, query.TimeTo).UTC().Format(time.DateTime)
+		if from != "2024-05-15 11:45:00" || to != "2024-05-15 12:00:00" {
+			t.Errorf("%s: %s to %s", statement, from, to)
+		}
+	}
+
+	// An explicit reference still counts
+	query, error := ParseWithOptions("FIND ALL SINCE YESTERDAY", options)
+	if error != nil || time.Unix(0, query.TimeFrom).UTC().Format(time.DateTime) != "2024-05-14 00:00:00" {
+		t.Errorf("SINCE YESTERDAY: %v", error)
+	}
+}
+
+func TestForbidFullScan(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+	options.ForbidFullScan = true
+
+	for _, statement := range []string{
+		"FIND ALL SINCE 1 HOUR AGO",
+		"FIND ALL BETWEEN '2024-05-01' AND '2024-05-02'",
+		"FIND ALL SINCE 2 MONTHS AGO", // no MaxScanWindow yet
+	} {
+		if _, error := ParseWithOptions(statement, options); error != nil {
+			t.Errorf("%s: Parser error: %s", statement, error)
+		}
+	}
+
+	options.MaxScanWindow = 30 * 24 * time.Hour
+	tests := []struct {
+		statement string
+		expected  string
+	}{
+		{"FIND ALL SINCE FOREVER", "time range is open-ended, a full scan is not allowed at 'SINCE FOREVER'"},
+		{"FIND ALL BETWEEN LAST WEEK AND FOREVER | SORT src_ip", "time range is open-ended, a full scan is not allowed at 'BETWEEN LAST WEEK AND FOREVER'"},
+		{"FIND ALL SINCE 2 MONTHS AGO", "time range of 1476h0m0s is longer than the 720h0m0s allowed at 'SINCE 2 MONTHS AGO'"},
+	}
+	for _, test := range tests {
+		if _, error := ParseWithOptions(test.statement, options); error == nil || !strings.Contains(error.Error(), test.expected) {
+			t.Errorf("%s: error %v, expected %s", test.statement, error, test.expected)
+		}
+	}
+	if _, error := ParseWithOptions("FIND ALL SINCE 1 HOUR AGO", options); error != nil {
+		t.Errorf("1 hour within the window: Parser error: %s", error)
+	}
+
+	// A live tail only sees new data
+	options.RequireTemporal = false
+	if _, error := ParseWithOptions("FIND ALL MATCHING severity='high'", options); error != nil {
+		t.Errorf("live tail: Parser error: %s", error)
+	}
+}
+
+func TestWarningsAsErrors(t *testing.T) {
+	const statement = "FIND ALL BETWEEN '2024-05-01' AND '2024-05-02'"
+
+	options := DefaultOptions()
+	query, error := ParseWithOptions(statement, options)
+	if error != nil || len(query.Warnings()) == 0 {
+		t.Fatalf("expected a warning without WarningsAsErrors, got %v %v", query, error)
+	}
+
+	options.WarningsAsErrors = true
+	if _, error := ParseWithOptions(statement, options); error == nil || !strings.Contains(error.Error(), "warning treated as error: date '2024-05-01' in BETWEEN has no time of day") {
+		t.Errorf("expected the warning as an error, got %v", error)
+	}
+	if _, error := ParseWithOptions("FIND ALL BETWEEN '2024-05-01 00:00:00' AND '2024-05-02 00:00:00'", options); error != nil {
+		t.Errorf("no warnings: Parser error: %s", error)
+	}
+
+	cache := NewCache(10, options)
+	for i := 0; i < 2; i++ {
+		if _, error := cache.Parse(statement); error == nil {
+			t.Errorf("cache: warning not treated as an error")
+		}
+	}
+}
+
+func TestStrictRange(t *testing.T) {
+	const statement = "FIND ALL BETWEEN '2024-05-02 00:00:00' AND '2024-05-01 00:00:00'"
+
+	options := DefaultOptions()
+	query, error := ParseWithOptions(statement, options)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if query.TimeFrom >= query.TimeTo {
+		t.Errorf("reversed range not swapped: from %d to %d", query.TimeFrom, query.TimeTo)
+	}
+
+	options.StrictRange = true
+	if _, error := ParseWithOptions(statement, options); error == nil || !strings.Contains(error.Error(), "range end precedes start at 'BETWEEN '2024-05-02 00:00:00'") {
+		t.Errorf("expected range end precedes start, got %v", error)
+	}
+	if _, error := ParseWithOptions("FIND ALL BETWEEN '2024-05-01 00:00:00' AND '2024-05-02 00:00:00'", options); error != nil {
+		t.Errorf("range in order: Parser error: %s", error)
+	}
+}
+
+// EOF
@@ -18,11 +18,17 @@
 package openacta
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"io"
+	"math"
+	"net/netip"
+	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 /*
@@ -31,43 +37,150 @@ import (
 	Each function works from a named state in the EBNF grammar (see docs/grammar.txt)
 */
 
+// Parser tracing goes here, os.Stderr to follow a parse step by step
+var trace io.Writer = io.Discard
+
 type Parser struct {
 	query       string        // Original query string, for error reporting and tracing
 	tokens      []lexer_token // Token slice from the lexer
 	num_tokens  int           // Number of tokens in the statement
 	token_index int           // token index of the parser, during processing
 
-	fields        []string // List of fields to return from query
-	field_aliases []string // List of field aliases to return from query
-	find_flags    byte     // ALL fields
+	fields        []string    // List of fields to return from query
+	field_aliases []string    // List of field aliases to return from query
+	field_sources []string    // Source per field, "" if it's not qualified (netflow:src_ip)
+	find_flags    byte        // ALL fields
+	aggregates    []aggregate // Aggregate functions in the list of fields
+
+	time_from         int64 // Earliest time we want
+	time_to           int64 // Latest time we want
+	time_to_exclusive bool  // EXCLUSIVE: time_to itself is not included
+	exclusive_end     bool  // resolving an end with EXCLUSIVE, from the start of what it refers to
+	relative_time     bool  // resolved against the clock: LAST WEEK, or SINCE without UNTIL
+
+	relative_conditions bool // MATCHING compares with a point in time resolved against the clock: 1 HOUR AGO
+
+	// The ranges of a temporal clause with OR, or just the one. time_from and time_to span them all.
+	time_ranges []TimeRange
 
-	time_from int64 // Earliest time we want
-	time_to   int64 // Latest time we want
+	// Where the temporal clause is: byte offsets in the query for Query.ExpandTemporal(),
+	// token index and the number of warnings before it for the Cache
+	temporal_start    int
+	temporal_end      int
+	temporal_token    int
+	temporal_warnings int
+
+	sample Sample // SAMPLE clause after the temporal clause
+
+	words []int // tokens taken as words rather than fields: COUNT, SAMPLE, NULLS, ... see take_word()
 
 	or_list []*or_item // base of item slice
+
+	// MATCHING and HAVING as written, parentheses and all, for Query.MatchingTree and Query.HavingTree.
+	// or_list and having_list have them multiplied out, the OR of AND groups that Query.Conditions
+	// and Query.Having are - as long as that doesn't come to too many, see do_matching_cond().
+	matching_tree *cond_node
+	having_tree   *cond_node
+	unexpanded    bool // MATCHING or HAVING had too many AND groups to multiply out
+
+	sort_keys       []sort_key // SORT stage or ORDER BY clause
+	sort_random     bool       // SORT RANDOM, instead of sort_keys
+	group_fields    []string   // GROUP stage
+	time_bucket     int64      // GROUP time(<duration>), bucket size in nanoseconds
+	having_list     []*or_item // HAVING conditions on the GROUP stage
+	distinct_fields []string   // DISTINCT stage
+	distinct_row    bool       // DISTINCT stage without fields, over the whole selected row
+	limit           int        // LIMIT stage, 0 for none
+	limit_by        []string   // LIMIT ... BY fields: the limit is per distinct combination of these
+	format          Format     // FORMAT stage
+	stage_flags     byte       // which secondary statements we've seen
+
+	warnings []string // Non-fatal issues found while parsing
+
+	always_empty bool // MATCHING or HAVING can never be true, see never_matches()
+
+	inferred map[string]FieldType // field types going by the MATCHING clause, see infer_types()
+
+	conditions int // comparisons so far, for Options.MaxConditions
+	depth      int // current nesting, for Options.MaxConditionDepth
+
+	options       Options   // How to parse, see options.go
+	now           time.Time // Reference time for relative temporal references
+	validate_only bool      // Syntax check only, see Validate()
+
+	ctx       context.Context // Cancellation, see ParseContext() - nil if not cancellable
+	ctx_count int             // calls to check_context() so far
 }
 
 const (
-	find_flags_all = 0b_00000001
+	find_flags_all      = 0b_00000001
+	find_flags_distinct = 0b_00000010 // FIND DISTINCT, SQL style
+)
+
+const (
+	stage_flags_sort     = 0b_00000001
+	stage_flags_order_by = 0b_00000010
+	stage_flags_group    = 0b_00000100
+	stage_flags_distinct = 0b_00001000
+	stage_flags_format   = 0b_00010000
+	stage_flags_limit    = 0b_00100000
 )
 
+type aggregate struct { // COUNT(*), SUM(bytes) AS total, ...
+	function  string // upper case function name
+	field     string // argument, "*" for COUNT(*)
+	alias     string // AS alias, generated if there's none
+	generated bool   // alias was generated rather than given with AS
+	distinct  bool   // COUNT(DISTINCT src_ip): only count each value once
+}
+
+type sort_key struct { // SORT / ORDER BY keys
+	field       string
+	desc        bool   // DESC, default is ASC
+	nulls_first bool   // NULLS FIRST, default is NULLS LAST whichever the direction
+	collation   string // COLLATE name, "" if there's none
+}
+
 type item struct { // item leaves
 	lexer_sym int
 	lexer_tag *string
 	lexer_val *string
+	source    string      // source of a qualified field, netflow for netflow:src_ip
+	op        Operator    // for comparison items
+	typed     interface{} // value as netip.Addr or netip.Prefix for IP literals, nil otherwise
+}
+
+type expr struct { // <num-val-expr> tree: dest_port MOD 2, bytes / 1024, ...
+	op    Operator // arithmetic operator, or OpNone for a leaf
+	value item     // leaf: field or literal
+	left  *expr
+	right *expr
+}
+
+type comparison struct { // <left> <this> <right>, or <left> BETWEEN <right> AND <upper>
+	this      item
+	left      item  // left-hand side, or its first value if computed
+	left_expr *expr // computed left-hand side (dest_port MOD 2), nil for a plain value
+	right     item
+	upper     item // BETWEEN upper bound
+	exclusive bool // BETWEEN ... EXCLUSIVE, upper bound not included
+
+	ignore_case bool // string comparison without regard to case
 }
 
 type or_item struct { // OR items
-	this     item
-	left     item
-	right    item
+	comparison
 	and_list []*and_item
 }
 
 type and_item struct { // AND items (within OR)
-	this  item
-	left  item
-	right item
+	comparison
+}
+
+type cond_node struct { // conditions as written: a comparison, or AND or OR over other nodes
+	conjunction Conjunction // ConjunctionAnd or ConjunctionOr, ConjunctionNone for a comparison
+	comparison  *comparison
+	children    []*cond_node
 }
 
 const ( // We use the int64 unix epoch: nanoseconds since 1 Jan 1970
@@ -77,13 +190,22 @@ const ( // We use the int64 unix epoch: nanoseconds since 1 Jan 1970
 	temp_day       = temp_hour * 24
 	temp_week      = temp_day * 7
 	temp_fortnight = temp_day * 14
-	temp_month     = temp_day * 30  // rough approximation is close enough
+	temp_month     = temp_day * 30  // rough approximation is close enough - calendar arithmetic uses add_months()
 	temp_quarter   = temp_day * 90  // also approx
 	temp_year      = temp_day * 365 // approx, since we don't care for leap year hopping
 	temp_century   = temp_year * 100
 )
 
+const ( // FOREVER leaves a range open-ended
+	temp_forever_past   = math.MinInt64 // as start of a range
+	temp_forever_future = math.MaxInt64 // as end of a range
+)
+
 func CurrentFunctionName() string {
+	if trace == io.Discard { // nobody's looking, and looking up the name allocates
+		return ""
+	}
+
 	pc, _, _, _ := runtime.Caller(1)
 	currentFunction := runtime.FuncForPC(pc).Name()
 	return currentFunction
@@ -93,540 +215,2611 @@ func (p *Parser) do_val_expr(newitem *item) error {
 	(*newitem).lexer_sym = p.tokens[p.token_index].token
 	(*newitem).lexer_tag = &(p.tokens[p.token_index].tag)
 	(*newitem).lexer_val = &(p.tokens[p.token_index].val)
+	(*newitem).source = p.tokens[p.token_index].source
+	if p.tokens[p.token_index].tag == "ident" && p.options.FieldResolver != nil {
+		field := p.resolve_field(p.tokens[p.token_index].val)
+		(*newitem).lexer_val = &field
+	}
+	(*newitem).op = operator_table[p.tokens[p.token_index].token]
+	(*newitem).typed = typed_value(&p.tokens[p.token_index])
 
 	return nil
 }
 
-func (p *Parser) do_and_cond() error {
-	var new_and_item and_item
-
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
-
-	or_ofs := len(p.or_list) - 1
-	if p.or_list[or_ofs].and_list != nil {
-		p.or_list[or_ofs].and_list = append(p.or_list[or_ofs].and_list, &and_item{})
-	} else {
-		p.or_list[or_ofs].and_list = make([]*and_item, 1, 10)
+// Only the field list and the field a condition compares keep the source of a qualified
+// field, anywhere else netflow:src_ip would quietly become src_ip, so it's an error there
+func (p *Parser) unqualified(index int, use string) error {
+	token := &p.tokens[index]
+	if token.tag != "ident" || token.source == "" {
+		return nil
 	}
+	return fmt.Errorf("qualified field %s:%s can't be used %s at '%s'", token.source, token.val, use, p.query[token.stmt_pos:])
+}
 
-	if err := p.do_val_expr(&new_and_item.left); err != nil {
-		return err
+// Canonical name of a field, through the FieldResolver option if there is one
+func (p *Parser) resolve_field(field string) string {
+	if p.options.FieldResolver == nil {
+		return field
 	}
-	p.token_index++
+	return p.options.FieldResolver(field)
+}
 
-	if p.token_index+2 >= p.num_tokens {
-		return fmt.Errorf("MATCHING statement cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+// Quoted IP addresses and CIDR ranges, and durations are parsed here, so users of the Query don't have to.
+// Anything else stays as the string in lexer_val.
+func typed_value(token *lexer_token) interface{} {
+	if token.tag == "duration" {
+		if duration, err := time.ParseDuration(token.val); err == nil {
+			return duration
+		}
 	}
-
-	switch p.tokens[p.token_index].token {
-	case sym_equal:
-		break
-		// others to follow, will also change errormsg below
-	default:
-		return fmt.Errorf("expected equal (=) sign at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	if token.tag == "string" {
+		if addr, err := netip.ParseAddr(token.val); err == nil {
+			return addr
+		}
+		if prefix, err := netip.ParsePrefix(token.val); err == nil {
+			return prefix
+		}
 	}
 
-	p.do_val_expr(&new_and_item.this)
-	p.token_index++ // Skip past comparison keyword/token
+	return nil
+}
 
-	if err := p.do_val_expr(&new_and_item.right); err != nil {
-		return err
+// The token offset places from the current one, without running off the end:
+// past the last token it's the end of statement token (sym_eof) that parser() appends.
+func (p *Parser) peek(offset int) *lexer_token {
+	i := p.token_index + offset
+	if i < 0 || i > p.num_tokens {
+		i = p.num_tokens
+	}
+	return &p.tokens[i]
+}
+
+// Skip past the current token if it's the given symbol, and say whether it was
+func (p *Parser) accept(symbol int) bool {
+	if p.tokens[p.token_index].token != symbol {
+		return false
 	}
 	p.token_index++
+	return true
+}
 
-	// put the and_item in the or_list
-	p.or_list[or_ofs].and_list[len(p.or_list[or_ofs].and_list)-1] = &new_and_item
+// Every so often, see whether whoever asked for the parse is still waiting for it.
+// Called from the places that repeat or recurse, so a huge or deeply nested query can't hold things up.
+func (p *Parser) check_context() error {
+	if p.ctx == nil {
+		return nil
+	}
 
-	return nil
+	p.ctx_count++
+	if p.ctx_count%context_check_interval != 0 {
+		return nil
+	}
+	return p.ctx.Err()
 }
 
-// only do "=" and "AND" for now, whole matching-cond functionality later
-func (p *Parser) do_or_cond() error {
-	var new_or_item or_item
+// <left> <comparison> <right>
+// <left> BETWEEN <right> AND <upper> [ EXCLUSIVE ]
+func (p *Parser) do_comparison(c *comparison) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.token_index+2 >= p.num_tokens {
+		return fmt.Errorf("condition cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
 
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+	p.conditions++
+	if p.options.MaxConditions > 0 && p.conditions > p.options.MaxConditions {
+		return fmt.Errorf("too many conditions, at most %d allowed, at '%s'", p.options.MaxConditions, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
 
-	if p.or_list != nil {
-		p.or_list = append(p.or_list, &or_item{})
-	} else {
-		p.or_list = make([]*or_item, 1, 10)
+	if p.is_presence() {
+		return p.do_presence(c)
 	}
 
-	if err := p.do_val_expr(&new_or_item.left); err != nil {
+	start := p.token_index
+	left, err := p.do_num_val_expr()
+	if err != nil {
 		return err
 	}
-	p.token_index++
+	if left.op == OpNone {
+		c.left = left.value
+	} else {
+		for i := start; i < p.token_index; i++ {
+			if err := p.unqualified(i, "in a computed value"); err != nil {
+				return err
+			}
+		}
+		c.left = left.first().value
+		c.left_expr = left
+	}
 
-	if p.token_index+2 >= p.num_tokens {
-		return fmt.Errorf("MATCHING statement cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	// <comparison> <right>
+	if p.token_index+1 >= p.num_tokens {
+		return fmt.Errorf("condition cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
 	}
 
-	switch p.tokens[p.token_index].token {
-	case sym_equal:
-		break
-		// others to follow, will also change errormsg below
-	default:
-		return fmt.Errorf("expected equal (=) sign at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	if p.tokens[p.token_index].token == sym_between {
+		return p.do_range(c)
+	}
+
+	if _, exists := operator_table[p.tokens[p.token_index].token]; !exists {
+		return fmt.Errorf("expected comparison (=, !=, <, >, <=, >=, EQUALS-IGNORE-CASE, CONTAINS, BETWEEN) at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
 	}
 
-	p.do_val_expr(&new_or_item.this)
+	p.do_val_expr(&c.this)
 	p.token_index++ // Skip past comparison keyword/token
 
-	if err := p.do_val_expr(&new_or_item.right); err != nil {
+	// CONTAINS looks for a piece of text, MATCHES for a regular expression
+	if c.this.op == OpContains && p.tokens[p.token_index].tag != "string" {
+		return fmt.Errorf("CONTAINS needs a quoted string at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	if c.this.op == OpMatches && p.tokens[p.token_index].tag != "string" {
+		return fmt.Errorf("MATCHES needs a regular expression in quotes at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	if p.is_temp_value() {
+		return p.do_temp_value(&c.right)
+	}
+	if err := p.unqualified(p.token_index, "on the right-hand side"); err != nil {
+		return err
+	}
+	if err := p.do_val_expr(&c.right); err != nil {
+		return err
+	}
+	if err := p.check_value(c); err != nil {
 		return err
 	}
 	p.token_index++
 
-	// put the item in the or_list
-	p.or_list[len(p.or_list)-1] = &new_or_item
-
-	// Do we have any (more) AND clauses?
-	// look-ahead(1), kinda
-	for p.tokens[p.token_index].token == sym_and {
-		p.token_index++
+	c.ignore_case = c.this.lexer_sym == sym_equal_ci || (p.options.CaseInsensitiveStrings && *c.right.lexer_tag == "string")
 
-		if err := p.do_and_cond(); err != nil {
-			return err
-		}
+	if c.this.op == OpMatches {
+		return p.compile_regex(c, &p.tokens[p.token_index-1])
 	}
 
 	return nil
 }
 
-func (p *Parser) do_matching_cond() error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
-
-	// First item in MATCHING clause is regarded as an OR, inside the parser structure
-	if err := p.do_or_cond(); err != nil {
-		return err
+// A point in time as the right-hand side of a comparison: last_seen > 1 HOUR AGO.
+// Only relative references, a number on its own is a number here rather than an epoch,
+// and a date in quotes is a string.
+func (p *Parser) is_temp_value() bool {
+	token := p.peek(0)
+	switch {
+	case token.tag == "int":
+		return is_reltime_unit(p.peek(1))
+	case token.token == sym_last, token.token == sym_previous, token.token == sym_yesterday:
+		return true
+	case is_reltime_unit(token): // HOUR AGO, DAY BEFORE YESTERDAY
+		return p.peek(1).token == sym_ago || p.peek(1).token == sym_before
 	}
+	return false
+}
 
-	// Do we have any (more) OR clauses?
-	// look-ahead(1), kinda
-	for p.tokens[p.token_index].token == sym_or {
-		p.token_index++
+// Tag of a point in time in a comparison, see do_temp_value()
+var time_value = lexer_token{tag: "time"}
 
-		if err := p.do_or_cond(); err != nil {
-			return err
-		}
+// <temp-ref> as a value, resolved the same way and against the same clock as the temporal clause.
+// It's the start of what it refers to: YESTERDAY is midnight. The item gets the unix epoch
+// nanoseconds as typed, and the timestamp in RFC 3339 form as its value.
+func (p *Parser) do_temp_value(value *item) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	var t int64
+	if error := p.do_temp_ref(&t, false); error != nil {
+		return error
 	}
+	p.relative_conditions = true // do_temp_cond() starts afresh for the temporal clause
+
+	text := time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+	*value = item{lexer_sym: sym_none, lexer_tag: &time_value.tag, lexer_val: &text, typed: t}
 
 	return nil
 }
 
-func (p *Parser) do_int_literal(int_literal *int) error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
-
-	if i, err := strconv.Atoi(p.tokens[p.token_index].val); err != nil {
-		return fmt.Errorf("not an integer literal at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
-	} else {
-		*int_literal = int(i)
+// EXISTS <field> or MISSING <field>, possibly after NOT. Neither is a keyword: followed by
+// an operator it's just a field, as in exists = 1.
+func (p *Parser) is_presence() bool {
+	offset := 0
+	if p.peek(0).token == sym_not {
+		offset = 1
 	}
+	next := p.peek(offset + 1).token
+	_, comparison := operator_table[next]
+	_, arithmetic := arithmetic_table[next]
 
-	return nil
+	return is_presence_word(p.peek(offset)) && !comparison && !arithmetic && next != sym_between
 }
 
-// Find previous specified weekday, or the one before that
-func prev_weekday(curDateTime time.Time, weekday time.Weekday, times int) time.Time {
-	curDateTime = curDateTime.AddDate(0, 0, -int(curDateTime.Weekday()-weekday+7)%7)
-	if times > 1 {
-		curDateTime = curDateTime.AddDate(0, 0, -7)
+func is_presence_word(token *lexer_token) bool {
+	return token.tag == "ident" && token.stmt_end-token.stmt_pos == len(token.val) && // not [bracketed]
+		(strings.EqualFold(token.val, "EXISTS") || strings.EqualFold(token.val, "MISSING"))
+}
+
+// Right-hand side of EXISTS and MISSING, which don't have one
+var no_value = lexer_token{tag: "none"}
+
+// Whether a row has the field at all, whatever its value: EXISTS error_code, MISSING error_code.
+// NOT turns it around, NOT EXISTS is MISSING.
+func (p *Parser) do_presence(c *comparison) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	negate := p.accept(sym_not)
+	word := strings.ToUpper(p.tokens[p.token_index].val)
+	p.take_word()
+	p.do_val_expr(&c.this)
+	c.this.op = OpExists
+	if (word == "MISSING") != negate {
+		c.this.op = OpMissing
 	}
+	p.token_index++ // skip past EXISTS or MISSING
 
-	curDateTime = curDateTime.Truncate(24 * time.Hour)
+	if p.tokens[p.token_index].tag != "ident" {
+		return fmt.Errorf("%s needs a field at '%s'", word, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.do_val_expr(&c.left)
+	p.token_index++
+	c.right = item{lexer_tag: &no_value.tag, lexer_val: &no_value.val}
 
-	return curDateTime
+	return nil
 }
 
-// Find previous specified month, or the one before that
-func prev_month(curDateTime time.Time, month time.Month, times int) time.Time {
-	curYear := curDateTime.Year()
-	curMonth := curDateTime.Month()
+// Longest regular expression for MATCHES. Go's regexp doesn't backtrack, so there's no
+// catastrophic pattern as such, but compiling and running a huge one still costs.
+const max_regex_length = 1024
 
-	// are we prior or in the desired month this year? Then we need to step back an extra year.
-	if curMonth <= month {
-		times++
+// Compile the pattern of a MATCHES comparison now, so a bad one is a syntax error
+// rather than a surprise for whoever runs the query
+func (p *Parser) compile_regex(c *comparison, token *lexer_token) error {
+	if len(token.val) > max_regex_length {
+		return fmt.Errorf("regular expression longer than %d characters at %s", max_regex_length, line_col(p.query, token.stmt_pos))
 	}
 
-	// Assemble datetime
-	curDateTime = time.Date(int(curYear), month, 1, 0, 0, 0, 0, time.UTC) // truncated to midnight
-	curDateTime = curDateTime.AddDate(-(times - 1), 0, 0)                 // hop back required # of years
+	pattern := token.val
+	if c.ignore_case {
+		pattern = "(?i)" + pattern
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression: %s, at %s", strings.TrimPrefix(err.Error(), "error parsing regexp: "), line_col(p.query, token.stmt_pos))
+	}
+	c.right.typed = compiled
 
-	return curDateTime
+	return nil
 }
 
-func (p *Parser) do_reltime_ref(clock_ref *int64, int_literal int, end bool) error {
-	var times int
-	var tok int
+// <num-val-expr> = <term> { ( <plus-sign> | <minus-sign> ) <term> }
+func (p *Parser) do_num_val_expr() (*expr, error) {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
 
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+	left, error := p.do_term()
+	if error != nil {
+		return nil, error
+	}
 
-	curDateTime := time.Now()
+	for {
+		token := &p.tokens[p.token_index]
 
-	// syntactically, these bits should be handled in do_temp_ref
-	if (p.token_index+1) < p.num_tokens &&
-		p.tokens[p.token_index].token == sym_last {
-		// LAST <reltime-ref>
-		tok = p.tokens[p.token_index+1].token
-		times = 1
-		p.token_index += 2 // skip past this whole clause, we have the necessary info in other vars
-	} else if (p.token_index+2) < p.num_tokens && // look-ahead x2
-		p.tokens[p.token_index+1].token == sym_before &&
-		p.tokens[p.token_index+2].token == sym_last {
-		// <reltime-ref> BEFORE LAST
-		tok = p.tokens[p.token_index].token
-		times = 2
-		p.token_index += 3 // skip past this whole clause, we have the necessary info in other vars
-	} else if (p.token_index+1) < p.num_tokens && // look-ahead
-		p.tokens[p.token_index+1].token == sym_ago {
-		// <int-literal> <reltime-ref> AGO
-		// <int-literal> already parsed by caller do_temp_ref()
-		times = int_literal
-		tok = p.tokens[p.token_index].token
-		p.token_index += 2 // skip past this whole clause, we have the necessary info in other vars
-	}
+		switch {
+		case token.token == sym_plus || token.token == sym_minus:
+		case (token.tag == "int" || token.tag == "float") && (token.val[0] == '-' || token.val[0] == '+'):
+			// "a -5" lexes as a and -5, but it's a subtraction all the same
+			right := &expr{value: item{lexer_sym: token.token, lexer_tag: &token.tag}}
+			number := token.val[1:]
+			right.value.lexer_val = &number
 
-	if end {
-		// TODO: Need to improve on this logic - it's more complex and needs to be, per temporal range
-		_ = times
-		//times-- // Not perfect, but it's close enough. We're looking backwards, so - instead of +.
-	}
+			op := OpAdd
+			if token.val[0] == '-' {
+				op = OpSubtract
+			}
+			p.token_index++
+			left = &expr{op: op, left: left, right: right}
+			continue
+		default:
+			return left, nil
+		}
 
-	switch tok {
-	//
-	// relative clock refs (LAST HOUR, HOUR BEFORE LAST, 2 HOURS AGO)
-	case sym_second:
-		curDateTime = curDateTime.Add(-time.Duration(times))
-	case sym_minute:
-		curDateTime = curDateTime.Add(-time.Duration(60 * times))
-		curDateTime = curDateTime.Truncate(time.Minute) // Truncate back to minutes
-	case sym_hour:
-		curDateTime = curDateTime.Add(-time.Duration(3600 * times))
-		curDateTime = curDateTime.Truncate(time.Hour) // Truncate back to hours
-		//
-		// relative weekday refs (LAST SUNDAY, SUNDAY BEFORE LAST, 2 SUNDAYS AGO), a bit more complicated
-	case sym_monday:
-		curDateTime = prev_weekday(curDateTime, time.Monday, times)
-	case sym_tuesday:
-		curDateTime = prev_weekday(curDateTime, time.Tuesday, times)
-	case sym_wednesday:
-		curDateTime = prev_weekday(curDateTime, time.Wednesday, times)
-	case sym_thursday:
-		curDateTime = prev_weekday(curDateTime, time.Thursday, times)
-	case sym_friday:
-		curDateTime = prev_weekday(curDateTime, time.Friday, times)
-	case sym_saturday:
-		curDateTime = prev_weekday(curDateTime, time.Saturday, times)
-	case sym_sunday:
-		curDateTime = prev_weekday(curDateTime, time.Sunday, times)
-		//
-		// relative month refs (LAST MAY, MAY BEFORE LAST, 2 MAYS AGO) - that last one is a bit quirky
-	case sym_january:
-		curDateTime = prev_month(curDateTime, 1, times)
-	case sym_february:
-		curDateTime = prev_month(curDateTime, 2, times)
-	case sym_march:
-		curDateTime = prev_month(curDateTime, 3, times)
-	case sym_april:
-		curDateTime = prev_month(curDateTime, 4, times)
-	case sym_may:
-		curDateTime = prev_month(curDateTime, 5, times)
-	case sym_june:
-		curDateTime = prev_month(curDateTime, 6, times)
-	case sym_july:
-		curDateTime = prev_month(curDateTime, 7, times)
-	case sym_august:
-		curDateTime = prev_month(curDateTime, 8, times)
-	case sym_september:
-		curDateTime = prev_month(curDateTime, 9, times)
-	case sym_october:
-		curDateTime = prev_month(curDateTime, 10, times)
-	case sym_november:
-		curDateTime = prev_month(curDateTime, 11, times)
-	case sym_december:
-		curDateTime = prev_month(curDateTime, 12, times)
-		//
-		// relative calendar refs
-	case sym_day:
-		curDateTime = curDateTime.AddDate(0, 0, -int(times))
-		curDateTime = curDateTime.Truncate(24 * time.Hour)
-	case sym_week:
-		curDateTime = curDateTime.AddDate(0, 0, -7*int(times))
-		curDateTime = curDateTime.Truncate(24 * time.Hour)
-	case sym_fortnight:
-		curDateTime = curDateTime.AddDate(0, 0, -14*int(times))
-		curDateTime = curDateTime.Truncate(24 * time.Hour)
-	case sym_month:
-		curDateTime = curDateTime.AddDate(0, -int(times), 0)
-		curDateTime = curDateTime.Truncate(24 * time.Hour)
-	case sym_quarter: // We take a quarter to be just 3 months anywhere within the year
-		curDateTime = curDateTime.AddDate(0, -3*int(times), 0)
-		curDateTime = curDateTime.Truncate(24 * time.Hour)
-	case sym_year:
-		curDateTime = curDateTime.AddDate(-int(times), 0, 0)
-		curDateTime = curDateTime.Truncate(24 * time.Hour)
-	case sym_century:
-		curDateTime = curDateTime.AddDate(-100*int(times), 0, 0)
-		curDateTime = curDateTime.Truncate(24 * time.Hour)
+		op := arithmetic_table[p.tokens[p.token_index].token]
+		p.token_index++ // skip past operator
 
-	default:
-		if int_literal == 0 {
-			return fmt.Errorf("unexpected symbol at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		right, error := p.do_term()
+		if error != nil {
+			return nil, error
 		}
+		left = &expr{op: op, left: left, right: right}
 	}
+}
 
-	*clock_ref = curDateTime.UnixNano()
+// <term> = <factor> { ( <asterisk> | <solidus> | DIV | <percent> | MOD ) <factor> }
+func (p *Parser) do_term() (*expr, error) {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
 
-	return nil
-}
+	left, error := p.do_factor()
+	if error != nil {
+		return nil, error
+	}
 
-// fills t with the temporal reference
-// if end=true, adjust time to end of referred range
-func (p *Parser) do_temp_ref(t *int64, end bool) error {
-	var clock_ref int64
-	var int_literal int
+	for {
+		switch p.tokens[p.token_index].token {
+		case sym_mul, sym_div, sym_mod:
+		default:
+			return left, nil
+		}
+
+		op := arithmetic_table[p.tokens[p.token_index].token]
+		p.token_index++ // skip past operator
+
+		right, error := p.do_factor()
+		if error != nil {
+			return nil, error
+		}
+		left = &expr{op: op, left: left, right: right}
+	}
+}
 
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+// <factor> = [ <sign> ] <factor> | <field-ref> | <num-val> | <string-val> | <left-paren> <num-val-expr> <right-paren>
+// The sign binds tighter than anything else: -a * b is (-a) * b, and a - -b is a - (-b)
+func (p *Parser) do_factor() (*expr, error) {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
 
-	clock_ref = time.Now().UTC().UnixNano()
+	if error := p.check_context(); error != nil {
+		return nil, error
+	}
 
 	switch p.tokens[p.token_index].token {
-	case sym_day:
-		// DAY BEFORE YESTERDAY
-		if (p.token_index+2) < p.num_tokens &&
-			p.tokens[p.token_index+1].token == sym_before &&
-			p.tokens[p.token_index+2].token == sym_yesterday {
-			clock_ref -= 2 * temp_day
-			clock_ref -= clock_ref % temp_day // round back to day
-			if end {
-				clock_ref += temp_day - temp_second
-			}
-			p.token_index += 3
-		} else {
-			return fmt.Errorf("BEFORE YESTERDAY missing at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	case sym_minus:
+		if error := p.nest(); error != nil {
+			return nil, error
 		}
-	case sym_yesterday:
-		// YESTERDAY
-		clock_ref -= temp_day
-		clock_ref -= clock_ref % temp_day // round back to day
-		if end {
-			clock_ref += temp_day - temp_second
+		defer p.unnest()
+		p.token_index++ // skip past sign
+
+		operand, error := p.do_factor()
+		if error != nil {
+			return nil, error
+		}
+		return &expr{op: OpNegate, left: operand}, nil
+	case sym_plus: // doesn't do anything
+		if error := p.nest(); error != nil {
+			return nil, error
 		}
+		defer p.unnest()
+		p.token_index++ // skip past sign
+		return p.do_factor()
+	}
+
+	switch p.tokens[p.token_index].tag {
+	case "ident", "int", "float", "string", "duration":
+		var leaf expr
+		p.do_val_expr(&leaf.value)
 		p.token_index++
-	case sym_last:
-		if error := p.do_reltime_ref(&clock_ref, int_literal, end); error != nil {
-			return error
+		return &leaf, nil
+	case "lparen":
+		if error := p.nest(); error != nil {
+			return nil, error
 		}
-	case sym_none:
-		if p.tokens[p.token_index].tag == "int" {
-			if error := p.do_int_literal(&int_literal); error != nil {
-				return error
-			}
-			p.token_index++
+		defer p.unnest()
+		p.token_index++ // skip past opening parenthesis
 
-			if error := p.do_reltime_ref(&clock_ref, int_literal, end); error != nil {
+		inner, error := p.do_num_val_expr()
+		if error != nil {
+			return nil, error
+		}
+		if p.tokens[p.token_index].token != sym_rparen {
+			return nil, fmt.Errorf("expected closing parenthesis at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		p.token_index++
+		return inner, nil
+	}
+
+	return nil, fmt.Errorf("expected field or value at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+}
+
+// Going one level deeper into a condition, up to Options.MaxConditionDepth.
+// Every successful nest() needs an unnest() on the way back out.
+func (p *Parser) nest() error {
+	if p.options.MaxConditionDepth > 0 && p.depth >= p.options.MaxConditionDepth {
+		return fmt.Errorf("condition nested too deep, at most %d levels allowed, at '%s'", p.options.MaxConditionDepth, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.depth++
+
+	return nil
+}
+
+func (p *Parser) unnest() {
+	p.depth--
+}
+
+// Left-most leaf of an expression
+func (e *expr) first() *expr {
+	for e.op != OpNone {
+		e = e.left
+	}
+	return e
+}
+
+func (e *expr) String() string {
+	switch {
+	case e == nil:
+		return "?"
+	case e.op == OpNone:
+		return e.value.String()
+	case e.op == OpNegate:
+		return fmt.Sprintf("(-%s)", e.left)
+	}
+	return fmt.Sprintf("(%s %s %s)", e.left, e.op, e.right)
+}
+
+// Field or literal as written, strings in quotes. "?" if it was never filled in.
+func (i *item) String() string {
+	switch {
+	case i.lexer_val == nil:
+		return "?"
+	case i.lexer_tag != nil && *i.lexer_tag == "string":
+		return "'" + *i.lexer_val + "'"
+	}
+	return *i.lexer_val
+}
+
+// Field name with its source if it's qualified, netflow:src_ip
+func (i *item) qualified_name() string {
+	if i.source != "" {
+		return i.source + ":" + *i.lexer_val
+	}
+	return *i.lexer_val
+}
+
+// Left-hand side of a comparison, for tracing
+func (c *comparison) left_string() string {
+	if c.left_expr != nil {
+		return c.left_expr.String()
+	}
+	return c.left.String()
+}
+
+func (c *comparison) String() string {
+	if c.this.op == OpExists || c.this.op == OpMissing {
+		return fmt.Sprintf("%s %s", c.this.op, c.left.String())
+	}
+	s := fmt.Sprintf("%s %s %s", c.left_string(), c.this.op, c.right.String())
+	if c.this.op == OpBetween {
+		s += " AND " + c.upper.String()
+		if c.exclusive {
+			s += " EXCLUSIVE"
+		}
+	}
+	if c.ignore_case {
+		s += " (ignore case)"
+	}
+	return s
+}
+
+// The AND in BETWEEN belongs to the range, not to the condition list, so we consume it here
+func (p *Parser) do_range(c *comparison) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	p.do_val_expr(&c.this)
+	c.this.op = OpBetween
+	p.token_index++ // Skip past BETWEEN keyword
+
+	// <right> AND <upper>
+	if p.token_index+2 >= p.num_tokens {
+		return fmt.Errorf("BETWEEN cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	if err := p.do_val_expr(&c.right); err != nil {
+		return err
+	}
+	if err := p.check_value(c); err != nil {
+		return err
+	}
+	p.token_index++
+
+	if p.tokens[p.token_index].token != sym_and {
+		return fmt.Errorf("missing AND in BETWEEN at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past AND keyword
+
+	if err := p.do_val_expr(&c.upper); err != nil {
+		return err
+	}
+	if err := p.check_value(c); err != nil {
+		return err
+	}
+	p.token_index++
+
+	if p.tokens[p.token_index].token == sym_exclusive {
+		c.exclusive = true
+		p.token_index++
+	}
+
+	c.ignore_case = p.options.CaseInsensitiveStrings && *c.right.lexer_tag == "string" && *c.upper.lexer_tag == "string"
+
+	return nil
+}
+
+// <value> <op> <field> <op> <value>, with both going the same way: 1024 < dest_port < 2048.
+// Comes in after do_comparison() did the first half, which is turned around to dest_port > 1024.
+// The second half, dest_port < 2048, is returned to be ANDed on. nil if there's no chain.
+func (p *Parser) do_chain(c *comparison) (*and_item, error) {
+	if _, exists := operator_table[p.tokens[p.token_index].token]; !exists || c.this.op == OpExists || c.this.op == OpMissing {
+		return nil, nil
+	}
+
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if c.left_expr != nil || *c.left.lexer_tag == "ident" || *c.right.lexer_tag != "ident" {
+		return nil, fmt.Errorf("chained comparison needs a value, a field and a value, as in 1024 < dest_port < 2048, at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	first, second := c.this.op, operator_table[p.tokens[p.token_index].token]
+	ascending := func(op Operator) bool { return op == OpLess || op == OpLessEqual }
+	descending := func(op Operator) bool { return op == OpGreater || op == OpGreaterEqual }
+	if !(ascending(first) && ascending(second)) && !(descending(first) && descending(second)) {
+		return nil, fmt.Errorf("ambiguous chained comparison, both have to be < or <=, or both > or >=, at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	p.conditions++
+	if p.options.MaxConditions > 0 && p.conditions > p.options.MaxConditions {
+		return nil, fmt.Errorf("too many conditions, at most %d allowed, at '%s'", p.options.MaxConditions, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	// Turn the first half around: 1024 < dest_port is dest_port > 1024
+	c.left, c.right = c.right, c.left
+	c.this.op = map[Operator]Operator{OpLess: OpGreater, OpLessEqual: OpGreaterEqual, OpGreater: OpLess, OpGreaterEqual: OpLessEqual}[first]
+	c.ignore_case = p.options.CaseInsensitiveStrings && *c.right.lexer_tag == "string"
+	here := p.token_index
+	p.token_index -= 3 // back to the first value, a single token as it's not an expression
+	if err := p.check_value(c); err != nil {
+		return nil, err
+	}
+	p.token_index = here
+
+	// Second half: dest_port < 2048
+	chained := &and_item{}
+	chained.left = c.left
+	p.do_val_expr(&chained.this)
+	p.token_index++ // Skip past comparison token
+
+	if p.tokens[p.token_index].tag == "ident" {
+		return nil, fmt.Errorf("chained comparison needs a value, a field and a value, as in 1024 < dest_port < 2048, at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	if err := p.do_val_expr(&chained.right); err != nil {
+		return nil, err
+	}
+	if err := p.check_value(&chained.comparison); err != nil {
+		return nil, err
+	}
+	p.token_index++
+	chained.ignore_case = p.options.CaseInsensitiveStrings && *chained.right.lexer_tag == "string"
+
+	if _, exists := operator_table[p.tokens[p.token_index].token]; exists {
+		return nil, fmt.Errorf("a chained comparison has two parts at most at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	return chained, nil
+}
+
+// <search-cond> = <boolean-term> { OR <boolean-term> }
+// AND binds tighter than OR: a=1 OR b=2 AND c=3 OR d=4 is (a=1) OR (b=2 AND c=3) OR (d=4),
+// parentheses group them the other way: (a=1 OR b=2) AND c=3.
+// The conditions as written go into tree, multiplied out into an OR of AND groups in or_list:
+// p.matching_tree and p.or_list for MATCHING, p.having_tree and p.having_list for HAVING.
+// The tree is what counts. Every (a OR b) ANDed on doubles the AND groups, so a perfectly
+// reasonable query may come to too many of those: or_list is left empty then, with a warning.
+// On a syntax error, tree has as much as was parsed, for the trace.
+func (p *Parser) do_matching_cond(tree **cond_node, or_list *[]*or_item) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	node, err := p.do_or_cond()
+	*tree = node
+	if err != nil {
+		return err
+	}
+
+	groups, expanded := multiply_out(node)
+	if !expanded {
+		p.unexpanded = true
+		p.warnings = append(p.warnings,
+			fmt.Sprintf("conditions come to more than %d AND groups multiplied out, only the condition tree has them (Query.MatchingTree, HavingTree)", max_condition_groups))
+		return nil
+	}
+	*or_list = make_or_list(groups)
+	return nil
+}
+
+// <search-cond>, terms joined by OR.
+// Like the other do_*_cond() functions, it returns what it has so far along with an error.
+func (p *Parser) do_or_cond() (*cond_node, error) {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	node, err := p.do_and_cond()
+	if err != nil {
+		return node, err
+	}
+
+	// look-ahead(1), kinda
+	for p.tokens[p.token_index].token == sym_or {
+		p.token_index++
+
+		next, err := p.do_and_cond()
+		if next != nil {
+			node = join_conditions(ConjunctionOr, node, next)
+		}
+		if err != nil {
+			return node, err
+		}
+	}
+
+	return node, nil
+}
+
+// <boolean-term>, conditions joined by AND
+func (p *Parser) do_and_cond() (*cond_node, error) {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	node, err := p.do_cond_primary()
+	if err != nil {
+		return node, err
+	}
+
+	for p.tokens[p.token_index].token == sym_and {
+		p.token_index++
+
+		next, err := p.do_cond_primary()
+		if next != nil {
+			node = join_conditions(ConjunctionAnd, node, next)
+		}
+		if err != nil {
+			return node, err
+		}
+	}
+
+	return node, nil
+}
+
+// <boolean-primary> = <predicate> | <left-paren> <search-cond> <right-paren>
+// A parenthesis may also start arithmetic, (bytes + 1) * 8 > 1024, that's up to do_comparison()
+func (p *Parser) do_cond_primary() (*cond_node, error) {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.is_cond_group() {
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer p.unnest()
+		p.token_index++ // skip past opening parenthesis
+
+		node, err := p.do_or_cond()
+		if err != nil {
+			return node, err
+		}
+		if p.tokens[p.token_index].token != sym_rparen {
+			return node, fmt.Errorf("expected closing parenthesis at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		p.token_index++
+		return node, nil
+	}
+
+	c := &comparison{}
+	node := &cond_node{comparison: c}
+	if err := p.do_comparison(c); err != nil {
+		return node, err
+	}
+	chained, err := p.do_chain(c)
+	if err != nil {
+		return node, err
+	}
+
+	if chained != nil { // 1024 < dest_port < 2048 is two comparisons
+		node = join_conditions(ConjunctionAnd, node, &cond_node{comparison: &chained.comparison})
+	}
+	return node, nil
+}
+
+// Whether the parenthesis at the current token holds conditions, (a=1 OR b=2), rather than
+// arithmetic, (bytes + 1). Arithmetic has no comparisons, AND, OR or NOT anywhere inside.
+func (p *Parser) is_cond_group() bool {
+	if p.tokens[p.token_index].token != sym_lparen {
+		return false
+	}
+
+	depth := 0
+	for i := p.token_index; i < p.num_tokens; i++ {
+		token := &p.tokens[i]
+		switch token.token {
+		case sym_lparen:
+			depth++
+		case sym_rparen:
+			depth--
+			if depth == 0 {
+				return false
+			}
+		case sym_and, sym_or, sym_not, sym_between:
+			return true
+		}
+		if _, comparison := operator_table[token.token]; comparison {
+			return true
+		}
+		if is_presence_word(token) && p.tokens[i+1].tag == "ident" { // (EXISTS error_code)
+			return true
+		}
+	}
+
+	return false // never closed, do_comparison() will say so
+}
+
+// a AND b, or a OR b. Conditions that are joined the same way already are taken in,
+// so a AND b AND c is the one node with three children.
+func join_conditions(conjunction Conjunction, a, b *cond_node) *cond_node {
+	if a.conjunction != conjunction {
+		a = &cond_node{conjunction: conjunction, children: []*cond_node{a}}
+	}
+	if b.conjunction == conjunction {
+		a.children = append(a.children, b.children...)
+	} else {
+		a.children = append(a.children, b)
+	}
+
+	return a
+}
+
+// Most AND groups the conditions may come to once multiplied out.
+// Every (a OR b) ANDed on doubles them, so it doesn't take much of a query to get there.
+const max_condition_groups = 10000
+
+// The conditions as an OR of AND groups: (a OR b) AND (c OR d) is
+// (a AND c) OR (a AND d) OR (b AND c) OR (b AND d).
+// false if that's more than max_condition_groups, there are no groups then.
+func multiply_out(node *cond_node) ([][]*comparison, bool) {
+	switch node.conjunction {
+	case ConjunctionOr:
+		var groups [][]*comparison
+		for _, child := range node.children {
+			more, expanded := multiply_out(child)
+			if !expanded || len(groups)+len(more) > max_condition_groups {
+				return nil, false
+			}
+			groups = append(groups, more...)
+		}
+		return groups, true
+	case ConjunctionAnd:
+		groups := [][]*comparison{nil}
+		for _, child := range node.children {
+			more, expanded := multiply_out(child)
+			if !expanded || len(groups)*len(more) > max_condition_groups {
+				return nil, false
+			}
+			product := make([][]*comparison, 0, len(groups)*len(more))
+			for _, left := range groups {
+				for _, right := range more {
+					product = append(product, append(append([]*comparison(nil), left...), right...))
+				}
+			}
+			groups = product
+		}
+		return groups, true
+	}
+
+	return [][]*comparison{{node.comparison}}, true
+}
+
+// Each AND group as an or_item, its first comparison with the rest attached as and_items
+func make_or_list(groups [][]*comparison) []*or_item {
+	or_list := make([]*or_item, 0, len(groups))
+	for _, group := range groups {
+		or := &or_item{comparison: *group[0]}
+		for _, c := range group[1:] {
+			or.and_list = append(or.and_list, &and_item{comparison: *c})
+		}
+		or_list = append(or_list, or)
+	}
+
+	return or_list
+}
+
+// The comparisons in the tree, in the order written
+func (n *cond_node) comparisons() []*comparison {
+	switch {
+	case n == nil:
+		return nil
+	case n.conjunction == ConjunctionNone:
+		return []*comparison{n.comparison}
+	}
+
+	var comparisons []*comparison
+	for _, child := range n.children {
+		comparisons = append(comparisons, child.comparisons()...)
+	}
+	return comparisons
+}
+
+// The conditions as written, with parentheses where a group is joined differently from its parent.
+// "?" for anything that wasn't filled in.
+func (n *cond_node) String() string {
+	switch {
+	case n == nil, n.conjunction == ConjunctionNone && n.comparison == nil:
+		return "?"
+	case n.conjunction == ConjunctionNone:
+		return n.comparison.String()
+	}
+
+	parts := make([]string, 0, len(n.children))
+	for _, child := range n.children {
+		if child != nil && child.conjunction != ConjunctionNone {
+			parts = append(parts, "("+child.String()+")")
+		} else {
+			parts = append(parts, child.String())
+		}
+	}
+	return strings.Join(parts, " "+n.conjunction.String()+" ")
+}
+
+func (p *Parser) do_int_literal(int_literal *int) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if i, err := parse_int(p.tokens[p.token_index].val); err != nil {
+		return fmt.Errorf("not an integer literal at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	} else {
+		*int_literal = int(i)
+	}
+
+	return nil
+}
+
+// Integer literal, which may be in E notation: 1e3 is 1000.
+// The lexer only hands us a positive exponent, so the result is always a whole number.
+func parse_int(s string) (int, error) {
+	e := strings.IndexAny(s, "eE")
+	if e < 0 {
+		return strconv.Atoi(s)
+	}
+
+	mantissa, err := strconv.Atoi(s[:e])
+	if err != nil {
+		return 0, err
+	}
+	exponent, err := strconv.Atoi(s[e+1:])
+	if err != nil {
+		return 0, err
+	}
+
+	for ; exponent > 0 && mantissa != 0; exponent-- {
+		if mantissa > math.MaxInt/10 || mantissa < math.MinInt/10 {
+			return 0, fmt.Errorf("integer literal %s out of range", s)
+		}
+		mantissa *= 10
+	}
+
+	return mantissa, nil
+}
+
+// Is this token a unit for <reltime-ref>? (HOUR, WEEKS, TUESDAY, MAY, ...)
+func is_reltime_unit(token *lexer_token) bool {
+	switch token.tag {
+	case "clock", "clocks", "calendar", "calendars", "weekday", "weekdays", "months", "mon":
+		return true
+	}
+	return false
+}
+
+// A bare integer as temporal reference is a unix epoch timestamp.
+// Logs carry these in seconds, milliseconds, microseconds or nanoseconds,
+// we go by magnitude: 1e11 seconds is well past the year 5000.
+func (p *Parser) do_epoch_literal(clock_ref *int64) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	epoch, err := strconv.ParseInt(p.tokens[p.token_index].val, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid epoch timestamp at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	magnitude := epoch
+	if magnitude < 0 {
+		magnitude = -magnitude
+	}
+
+	var unit int64
+	switch {
+	case magnitude < 1e11: // seconds
+		unit = temp_second
+	case magnitude < 1e14: // milliseconds
+		unit = 1000 * 1000
+	case magnitude < 1e17: // microseconds
+		unit = 1000
+	default: // nanoseconds
+		unit = 1
+	}
+	if magnitude > math.MaxInt64/unit { // 1e10 seconds is past the year 2262, as far as nanoseconds go
+		return fmt.Errorf("time reference out of range at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	*clock_ref = epoch * unit
+
+	return nil
+}
+
+// Rough length of a <reltime-ref> unit in nanoseconds, 0 if it's not one.
+// A weekday comes round once a week, a month once a year.
+var reltime_unit_length = map[int]int64{
+	sym_second: temp_second, sym_minute: temp_minute, sym_hour: temp_hour,
+	sym_day: temp_day, sym_week: temp_week, sym_fortnight: temp_fortnight,
+	sym_month: temp_month, sym_quarter: temp_quarter, sym_year: temp_year, sym_century: temp_century,
+	sym_monday: temp_week, sym_tuesday: temp_week, sym_wednesday: temp_week, sym_thursday: temp_week,
+	sym_friday: temp_week, sym_saturday: temp_week, sym_sunday: temp_week,
+	sym_january: temp_year, sym_february: temp_year, sym_march: temp_year, sym_april: temp_year,
+	sym_may: temp_year, sym_june: temp_year, sym_july: temp_year, sym_august: temp_year,
+	sym_september: temp_year, sym_october: temp_year, sym_november: temp_year, sym_december: temp_year,
+}
+
+// Whether going times units back from now stays within int64 unix epoch nanoseconds.
+// From 2024 that's about 347 years back, more than fits in an int64 (or a Duration) by itself, so the
+// room there is is worked out in uint64. Validate() has no clock, so there it's anything up to 2^64.
+// A negative count is turned away before it gets here, going forward isn't looking back.
+func (p *Parser) reltime_in_range(now time.Time, times int64, unit int64) bool {
+	room := uint64(math.MaxUint64)
+	switch {
+	case times < 0:
+		return false
+	case !p.validate_only:
+		room = uint64(now.UnixNano()) + 1<<63 // now - math.MinInt64
+	}
+	return uint64(times) <= room/uint64(unit)
+}
+
+// times units before t, for units of whole seconds. As a Duration, times * unit runs out
+// at 292 years, short of what int64 nanoseconds can go back to.
+func clock_back(t time.Time, times int64, unit time.Duration) time.Time {
+	seconds := times * int64(unit/time.Second)
+	return time.Unix(t.Unix()-seconds, int64(t.Nanosecond())).In(t.Location())
+}
+
+// Whether t can be had in int64 unix epoch nanoseconds, which go from 1677 to 2262.
+// Outside that, UnixNano() wraps around to some other time altogether.
+func in_epoch_range(t time.Time) bool {
+	return !t.Before(time.Unix(0, math.MinInt64)) && !t.After(time.Unix(0, math.MaxInt64))
+}
+
+func in_list(s string, list []string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Add (or with a negative number, subtract) months.
+// time.AddDate normalises overflowing days, so 31 May minus one month is 1 May.
+// With StrictCalendar we stay within the target month instead, ending up on 30 April.
+func (p *Parser) add_months(t time.Time, months int) time.Time {
+	if !p.options.StrictCalendar {
+		return t.AddDate(0, months, 0)
+	}
+
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+
+	return time.Date(first.Year(), first.Month(), day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// Calendar quarter (Jan-Mar, Apr-Jun, Jul-Sep, Oct-Dec) the given number of quarters back.
+// As the start of a range that's the first day of the quarter,
+// as the end of a range it's the last nanosecond of the quarter, so the whole quarter is included.
+func calendar_quarter(t time.Time, times int, end bool) time.Time {
+	year, month, _ := t.Date()
+	first_month := month - (month-1)%3 // first month of the current quarter
+
+	start := time.Date(year, first_month-time.Month(3*times), 1, 0, 0, 0, 0, t.Location())
+	if end {
+		return start.AddDate(0, 3, 0).Add(-temp_second)
+	}
+
+	return start
+}
+
+// Midnight at the start of the day, in the location of t.
+// time.Truncate would give midnight UTC, whatever the location.
+func start_of_day(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// Start of the day the given number of days back, or the last second of that day for the end of a range
+func days_back(t time.Time, days int, end bool) int64 {
+	start := start_of_day(t.AddDate(0, 0, -days))
+	if end {
+		return start.AddDate(0, 0, 1).UnixNano() - temp_second
+	}
+	return start.UnixNano()
+}
+
+// Find previous specified weekday, or the one before that
+func prev_weekday(curDateTime time.Time, weekday time.Weekday, times int) time.Time {
+	curDateTime = curDateTime.AddDate(0, 0, -int(curDateTime.Weekday()-weekday+7)%7)
+	if times > 1 {
+		curDateTime = curDateTime.AddDate(0, 0, -7)
+	}
+
+	curDateTime = start_of_day(curDateTime)
+
+	return curDateTime
+}
+
+// Find previous specified month, or the one before that
+func prev_month(curDateTime time.Time, month time.Month, times int) time.Time {
+	curYear := curDateTime.Year()
+	curMonth := curDateTime.Month()
+
+	// are we prior or in the desired month this year? Then we need to step back an extra year.
+	if curMonth <= month {
+		times++
+	}
+
+	// Assemble datetime
+	curDateTime = time.Date(int(curYear), month, 1, 0, 0, 0, 0, curDateTime.Location()) // truncated to midnight
+	curDateTime = curDateTime.AddDate(-(times - 1), 0, 0)                               // hop back required # of years
+
+	return curDateTime
+}
+
+// The first of these weekdays after today, a week ahead if it's that day today
+func next_weekday(curDateTime time.Time, weekday time.Weekday) time.Time {
+	curDateTime = curDateTime.AddDate(0, 0, int(weekday-curDateTime.Weekday()+6)%7+1)
+	curDateTime = start_of_day(curDateTime)
+
+	return curDateTime
+}
+
+// The start of the first of these months after this one, next year if it's that month now
+func next_month(curDateTime time.Time, month time.Month) time.Time {
+	year := curDateTime.Year()
+	if curDateTime.Month() >= month {
+		year++
+	}
+
+	return time.Date(year, month, 1, 0, 0, 0, 0, curDateTime.Location())
+}
+
+func (p *Parser) do_reltime_ref(clock_ref *int64, int_literal int, end bool) error {
+	var times int
+	var tok int
+
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	curDateTime := p.now
+
+	start := p.tokens[p.token_index].stmt_pos // for errors, the count if the caller had one
+	if int_literal != 0 {
+		start = p.tokens[p.token_index-1].stmt_pos
+	}
+	if int_literal < 0 { // -5 DAYS AGO would be 5 days from now
+		return fmt.Errorf("negative count of time units, that's in the future, at '%s'", p.query[start:])
+	}
+
+	// syntactically, these bits should be handled in do_temp_ref
+	if p.peek(0).token == sym_last && p.peek(1).token != sym_eof {
+		// LAST <reltime-ref>
+		tok = p.peek(1).token
+		times = 1
+		p.token_index += 2 // skip past this whole clause, we have the necessary info in other vars
+	} else if p.peek(1).token == sym_before && p.peek(2).token == sym_last { // look-ahead x2
+		// [ <int-literal> ] <reltime-ref> BEFORE LAST
+		// <int-literal> already parsed by caller do_temp_ref(), without it it's one before last
+		tok = p.peek(0).token
+		times = 2
+		if int_literal > 0 {
+			times = int_literal + 1
+		}
+		p.token_index += 3 // skip past this whole clause, we have the necessary info in other vars
+	} else if p.accept(sym_previous) {
+		// PREVIOUS [ <int-literal> ] <reltime-ref>, PREVIOUS 3 WEEKS is the same as 3 WEEKS AGO
+		times = 1
+		if p.peek(0).tag == "int" {
+			if error := p.do_int_literal(&times); error != nil {
+				return error
+			}
+			if times < 0 {
+				return fmt.Errorf("negative count of time units, that's in the future, at '%s'", p.query[p.peek(0).stmt_pos:])
+			}
+			p.token_index++
+		}
+		if !is_reltime_unit(p.peek(0)) {
+			return fmt.Errorf("expected time unit after PREVIOUS at '%s'", p.query[p.peek(0).stmt_pos:])
+		}
+		tok = p.peek(0).token
+		p.token_index++
+	} else if p.peek(1).token == sym_ago { // look-ahead
+		// <int-literal> <reltime-ref> AGO
+		// <int-literal> already parsed by caller do_temp_ref()
+		times = int_literal
+		tok = p.peek(0).token
+		p.token_index += 2 // skip past this whole clause, we have the necessary info in other vars
+	}
+
+	if end {
+		// TODO: Need to improve on this logic - it's more complex and needs to be, per temporal range
+		_ = times
+		//times-- // Not perfect, but it's close enough. We're looking backwards, so - instead of +.
+	}
+
+	// 100000000 CENTURIES AGO would overflow: going that far back from now has to stay within int64 nanoseconds.
+	// The unit lengths are on the short side, the exact check on the result is further down.
+	if unit := reltime_unit_length[tok]; unit > 0 && !p.reltime_in_range(curDateTime, int64(times), unit) {
+		return fmt.Errorf("time reference out of range at '%s'", p.query[start:])
+	}
+
+	switch tok {
+	//
+	// relative clock refs (LAST HOUR, HOUR BEFORE LAST, 2 HOURS AGO)
+	case sym_second:
+		curDateTime = clock_back(curDateTime, int64(times), time.Second)
+	case sym_minute:
+		curDateTime = clock_back(curDateTime, int64(times), time.Minute)
+		curDateTime = curDateTime.Truncate(time.Minute) // Truncate back to minutes
+	case sym_hour:
+		curDateTime = clock_back(curDateTime, int64(times), time.Hour)
+		curDateTime = curDateTime.Truncate(time.Hour) // Truncate back to hours
+		//
+		// relative weekday refs (LAST SUNDAY, SUNDAY BEFORE LAST, 2 SUNDAYS AGO), a bit more complicated
+	case sym_monday:
+		curDateTime = prev_weekday(curDateTime, time.Monday, times)
+	case sym_tuesday:
+		curDateTime = prev_weekday(curDateTime, time.Tuesday, times)
+	case sym_wednesday:
+		curDateTime = prev_weekday(curDateTime, time.Wednesday, times)
+	case sym_thursday:
+		curDateTime = prev_weekday(curDateTime, time.Thursday, times)
+	case sym_friday:
+		curDateTime = prev_weekday(curDateTime, time.Friday, times)
+	case sym_saturday:
+		curDateTime = prev_weekday(curDateTime, time.Saturday, times)
+	case sym_sunday:
+		curDateTime = prev_weekday(curDateTime, time.Sunday, times)
+		//
+		// relative month refs (LAST MAY, MAY BEFORE LAST, 2 MAYS AGO) - that last one is a bit quirky
+	case sym_january:
+		curDateTime = prev_month(curDateTime, 1, times)
+	case sym_february:
+		curDateTime = prev_month(curDateTime, 2, times)
+	case sym_march:
+		curDateTime = prev_month(curDateTime, 3, times)
+	case sym_april:
+		curDateTime = prev_month(curDateTime, 4, times)
+	case sym_may:
+		curDateTime = prev_month(curDateTime, 5, times)
+	case sym_june:
+		curDateTime = prev_month(curDateTime, 6, times)
+	case sym_july:
+		curDateTime = prev_month(curDateTime, 7, times)
+	case sym_august:
+		curDateTime = prev_month(curDateTime, 8, times)
+	case sym_september:
+		curDateTime = prev_month(curDateTime, 9, times)
+	case sym_october:
+		curDateTime = prev_month(curDateTime, 10, times)
+	case sym_november:
+		curDateTime = prev_month(curDateTime, 11, times)
+	case sym_december:
+		curDateTime = prev_month(curDateTime, 12, times)
+		//
+		// relative calendar refs
+	case sym_day:
+		curDateTime = curDateTime.AddDate(0, 0, -int(times))
+		curDateTime = start_of_day(curDateTime)
+	case sym_week:
+		curDateTime = curDateTime.AddDate(0, 0, -7*int(times))
+		curDateTime = start_of_day(curDateTime)
+	case sym_fortnight:
+		curDateTime = curDateTime.AddDate(0, 0, -14*int(times))
+		curDateTime = start_of_day(curDateTime)
+	case sym_month:
+		curDateTime = p.add_months(curDateTime, -int(times))
+		curDateTime = start_of_day(curDateTime)
+	case sym_quarter: // By default we take a quarter to be just 3 months anywhere within the year
+		if p.options.QuarterMode == QuarterCalendar {
+			curDateTime = calendar_quarter(curDateTime, times, end)
+			break
+		}
+		curDateTime = p.add_months(curDateTime, -3*int(times))
+		curDateTime = start_of_day(curDateTime)
+	case sym_year:
+		curDateTime = p.add_months(curDateTime, -12*int(times))
+		curDateTime = start_of_day(curDateTime)
+	case sym_century:
+		curDateTime = p.add_months(curDateTime, -1200*int(times))
+		curDateTime = start_of_day(curDateTime)
+
+	default:
+		if int_literal == 0 {
+			return fmt.Errorf("unexpected symbol at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+	}
+
+	// Calendar arithmetic doesn't overflow, but the nanoseconds would. Validate() has no clock to go by.
+	if !in_epoch_range(curDateTime) && !p.validate_only {
+		return fmt.Errorf("time reference out of range at '%s'", p.query[start:])
+	}
+	*clock_ref = curDateTime.UnixNano()
+
+	return nil
+}
+
+// fills t with the temporal reference
+// if end=true, adjust time to end of referred range
+func (p *Parser) do_temp_ref(t *int64, end bool) error {
+	var clock_ref int64
+	var int_literal int
+
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	clock_ref = p.now.UTC().UnixNano()
+
+	// Anything but FOREVER, an epoch or a date and time depends on when the query is run
+	switch token := p.peek(0); {
+	case token.token == sym_forever, token.tag == "string", token.tag == "int" && !is_reltime_unit(p.peek(1)):
+	default:
+		p.relative_time = true
+	}
+
+	switch p.tokens[p.token_index].token {
+	case sym_forever:
+		// FOREVER
+		if end {
+			clock_ref = temp_forever_future
+		} else {
+			clock_ref = temp_forever_past
+		}
+		p.token_index++
+	case sym_day:
+		// DAY BEFORE YESTERDAY
+		if p.peek(1).token == sym_before && p.peek(2).token == sym_yesterday {
+			clock_ref = days_back(p.now, 2, end)
+			p.token_index += 3
+		} else if error := p.do_bare_reltime_ref(&clock_ref, end); error != nil { // DAY AGO, DAY BEFORE LAST
+			return error
+		}
+	case sym_yesterday:
+		// YESTERDAY
+		clock_ref = days_back(p.now, 1, end)
+		p.token_index++
+	case sym_last:
+		if error := p.do_reltime_ref(&clock_ref, int_literal, end); error != nil {
+			return error
+		}
+	case sym_none:
+		if p.peek(0).tag == "int" && !is_reltime_unit(p.peek(1)) {
+			// <int-literal> without a unit following is an epoch timestamp
+			if error := p.do_epoch_literal(&clock_ref); error != nil {
+				return error
+			}
+			p.token_index++
+		} else if p.peek(0).tag == "int" {
+			if error := p.do_int_literal(&int_literal); error != nil {
+				return error
+			}
+			p.token_index++
+
+			if error := p.do_reltime_ref(&clock_ref, int_literal, end); error != nil {
+				return error
+			}
+		} else {
+			// Without a timezone, these are in the configured location
+			location := p.now.Location()
+			var parsed time.Time
+			if tt, err := time.ParseInLocation(time.DateTime, p.tokens[p.token_index].val, location); err == nil {
+				// Could be an ISO-8601 / RFC-3339 datetime (without timezone)
+				// See https://www.iso.org/iso-8601-date-and-time-format.html
+				// and https://www.rfc-editor.org/rfc/rfc3339
+				parsed = tt
+			} else if tt, err := time.Parse(time.RFC3339Nano, p.tokens[p.token_index].val); err == nil {
+				// With a timezone, as written by Query.ExpandTemporal()
+				parsed = tt
+			} else if tt, err := time.ParseInLocation(time.DateOnly, p.tokens[p.token_index].val, location); err == nil {
+				parsed = tt
+			} else if tt, err := time.ParseInLocation(time.TimeOnly, p.tokens[p.token_index].val, location); err == nil {
+				parsed = tt
+			} else { // Something invalid/unknown
+				return fmt.Errorf("invalid temporal reference at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+			}
+			if !in_epoch_range(parsed) { // '9999-12-31' is a valid date, but not in nanoseconds
+				return fmt.Errorf("time reference out of range at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+			}
+			clock_ref = parsed.UTC().UnixNano()
+			p.token_index++
+		}
+	case sym_previous:
+		if error := p.do_reltime_ref(&clock_ref, int_literal, end); error != nil {
+			return error
+		}
+	case sym_next:
+		if error := p.do_next_ref(&clock_ref, end); error != nil {
+			return error
+		}
+	default:
+		if error := p.do_bare_reltime_ref(&clock_ref, end); error != nil {
+			return error
+		}
+	}
+
+	*t = clock_ref
+	return nil
+}
+
+// NEXT <weekday> or NEXT <month>, for data that's dated ahead (schedules, expiry dates).
+// Looking ahead only makes sense for the end of a range, which then takes in all of that day or month.
+func (p *Parser) do_next_ref(clock_ref *int64, end bool) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if !end && !p.exclusive_end {
+		return fmt.Errorf("NEXT can only be the end of a range (UNTIL or BETWEEN ... AND) at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past NEXT keyword
+
+	tok := p.tokens[p.token_index].token
+	switch p.tokens[p.token_index].tag {
+	case "weekday", "weekdays": // sym_monday to sym_sunday are in order, time.Weekday starts at Sunday
+		day := next_weekday(p.now, time.Weekday((tok-sym_monday+1)%7))
+		*clock_ref = day.UnixNano()
+		if end {
+			*clock_ref = day.AddDate(0, 0, 1).UnixNano() - temp_second
+		}
+	case "months", "mon": // sym_january to sym_december are in order, like time.Month
+		month := next_month(p.now, time.Month(tok-sym_january+1))
+		*clock_ref = month.UnixNano()
+		if end {
+			*clock_ref = month.AddDate(0, 1, 0).UnixNano() - temp_second
+		}
+	default:
+		return fmt.Errorf("expected weekday or month after NEXT at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++
+
+	return nil
+}
+
+// <reltime-ref> AGO is one <reltime-ref> ago, <reltime-ref> BEFORE LAST is two back.
+// A unit on its own, "BETWEEN LAST MONTH AND FORTNIGHT", could mean either, so that's an error.
+func (p *Parser) do_bare_reltime_ref(clock_ref *int64, end bool) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if !is_reltime_unit(&p.tokens[p.token_index]) {
+		return fmt.Errorf("unexpected symbol at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	switch p.tokens[p.token_index+1].token {
+	case sym_ago:
+		return p.do_reltime_ref(clock_ref, 1, end)
+	case sym_before:
+		if p.tokens[p.token_index+2].token == sym_last {
+			return p.do_reltime_ref(clock_ref, 0, end)
+		}
+	}
+
+	return fmt.Errorf("ambiguous relative time, use LAST <unit> or N <unit> AGO at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+}
+
+func (p *Parser) do_temp_since() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	// SINCE on its own, with the DefaultLookback option: that far back up to now
+	switch next := p.peek(0).token; {
+	case next == sym_eof, next == sym_pipe, next == sym_order, p.is_word("SAMPLE"):
+		if p.options.DefaultLookback > 0 {
+			p.time_to = p.now.UnixNano()
+			p.relative_time = true
+			p.time_from = p.time_to - int64(p.options.DefaultLookback)
+			return nil
+		}
+	}
+
+	// decode desired start time
+	if error := p.do_temp_ref(&p.time_from, false); error != nil {
+		return error
+	}
+
+	// SINCE ... UNTIL gives an explicit end time
+	if p.token_index < p.num_tokens && p.tokens[p.token_index].token == sym_until {
+		if p.token_index+1 >= p.num_tokens {
+			return fmt.Errorf("UNTIL cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		p.token_index++ // skip past UNTIL keyword
+
+		return p.do_temp_end()
+	}
+
+	// for plain "SINCE", end time is now
+	if p.tokens[p.token_index].token == sym_exclusive {
+		return fmt.Errorf("EXCLUSIVE needs an explicit end time (UNTIL) at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.time_to = p.now.UnixNano()
+	p.relative_time = true
+
+	return nil
+}
+
+// A bare date (without time of day) in a BETWEEN is taken as midnight UTC.
+// That's rarely what's meant for the end of a range, so let the user know.
+func (p *Parser) warn_date_only() {
+	if p.tokens[p.token_index].tag != "string" {
+		return
+	}
+
+	val := p.tokens[p.token_index].val
+	if _, err := time.Parse(time.DateOnly, val); err == nil {
+		p.warnings = append(p.warnings,
+			fmt.Sprintf("date '%s' in BETWEEN has no time of day, taken as '%s 00:00:00' %s", val, val, p.now.Location()))
+	}
+}
+
+func (p *Parser) do_temp_between() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	// decode desired start time
+	p.warn_date_only()
+	if error := p.do_temp_ref(&p.time_from, false); error != nil {
+		return error
+	}
+
+	if p.tokens[p.token_index].token != sym_and {
+		return fmt.Errorf("missing AND in <temp-between> at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past AND keyword
+
+	p.warn_date_only()
+	return p.do_temp_end()
+}
+
+// With the ForbidFullScan option, each resolved time range has to be bounded at both ends,
+// and no longer than MaxScanWindow. Also run again by the Cache, as LAST 2 MONTHS may fit
+// one day and not the next.
+func (p *Parser) check_scan_window(clause string) error {
+	if p.time_from == temp_forever_past || p.time_to == temp_forever_future {
+		return fmt.Errorf("time range is open-ended, a full scan is not allowed at '%s'", clause)
+	}
+	if window := time.Duration(p.time_to - p.time_from); p.options.MaxScanWindow > 0 && window > p.options.MaxScanWindow {
+		return fmt.Errorf("time range of %s is longer than the %s allowed at '%s'", window, p.options.MaxScanWindow, clause)
+	}
+
+	return nil
+}
+
+// ON <temp-ref> is the whole day it falls on: ON '2024-01-05', ON YESTERDAY, ON LAST MONDAY.
+// The reference is decoded twice, as start and as end of a range, and each rounded to the day.
+func (p *Parser) do_temp_on() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.tokens[p.token_index].token == sym_forever {
+		return fmt.Errorf("ON needs a day, not FOREVER at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	start := p.token_index
+	if error := p.do_temp_ref(&p.time_from, false); error != nil {
+		return error
+	}
+	p.token_index = start
+	if error := p.do_temp_ref(&p.time_to, true); error != nil {
+		return error
+	}
+
+	location := p.now.Location()
+	p.time_from = start_of_day(time.Unix(0, p.time_from).In(location)).UnixNano()
+	p.time_to = start_of_day(time.Unix(0, p.time_to).In(location)).AddDate(0, 0, 1).UnixNano() - temp_second
+
+	return nil
+}
+
+// End time of a range, inclusive: the last second of what it refers to, so UNTIL YESTERDAY
+// takes in all of yesterday. EXCLUSIVE after it makes the range half-open, up to where the
+// reference starts, the same as for a date: UNTIL YESTERDAY EXCLUSIVE stops at midnight
+// at the start of yesterday, and ON YESTERDAY carries on from there.
+func (p *Parser) do_temp_end() error {
+	start := p.token_index
+	if error := p.do_temp_ref(&p.time_to, true); error != nil {
+		return error
+	}
+	if p.tokens[p.token_index].token != sym_exclusive {
+		return nil
+	}
+
+	if p.tokens[start].token != sym_forever { // FOREVER has no start to go to
+		p.token_index = start
+		p.exclusive_end = true
+		error := p.do_temp_ref(&p.time_to, false)
+		p.exclusive_end = false
+		if error != nil {
+			return error
+		}
+	}
+	p.time_to_exclusive = true
+	p.token_index++ // skip past EXCLUSIVE keyword
+
+	return nil
+}
+
+func (p *Parser) do_temp_cond() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	p.temporal_start = p.tokens[p.token_index].stmt_pos
+	p.temporal_token = p.token_index
+	p.temporal_warnings = len(p.warnings)
+	p.relative_time = false
+	p.time_ranges = nil
+
+	if !is_temporal(p.tokens[p.token_index].token) {
+		// No temporal clause, caller do_syntax() has checked that's allowed.
+		// From now on, with no end: a live tail.
+		p.time_from = p.now.UnixNano()
+		p.time_to = temp_forever_future
+		p.relative_time = true
+		p.temporal_end = p.temporal_start
+		p.time_ranges = []TimeRange{time_range(p.time_from, p.time_to, false)}
+		return nil
+	}
+
+	// One range, or several joined by OR: ON '2024-05-01' OR SINCE LAST MONDAY UNTIL LAST TUESDAY
+	for {
+		if error := p.do_temp_range(); error != nil {
+			return error
+		}
+		if p.peek(0).token != sym_or || !is_temporal(p.peek(1).token) {
+			break
+		}
+		p.token_index++ // skip past OR
+	}
+	p.temporal_end = p.tokens[p.token_index-1].stmt_end // last token of the clause
+
+	// The time range as a whole spans all of them
+	span := span_ranges(p.time_ranges)
+	p.time_from, p.time_to, p.time_to_exclusive = span.From, span.To, span.ToExclusive
+
+	return nil
+}
+
+// SINCE, BETWEEN and ON start a temporal clause, or another range of one
+func is_temporal(symbol int) bool {
+	return symbol == sym_since || symbol == sym_between || symbol == sym_on
+}
+
+// <temp-range>, a single range of the temporal clause, appended to p.time_ranges
+func (p *Parser) do_temp_range() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	start := p.tokens[p.token_index].stmt_pos
+	p.time_to_exclusive = false
+
+	switch p.tokens[p.token_index].token {
+	case sym_since:
+		p.token_index++ // skip past SINCE keyword
+		if error := p.do_temp_since(); error != nil {
+			return error
+		}
+	case sym_between:
+		p.token_index++ // skip past BETWEEN keyword
+		if error := p.do_temp_between(); error != nil {
+			return error
+		}
+	case sym_on:
+		p.token_index++ // skip past ON keyword
+		if error := p.do_temp_on(); error != nil {
+			return error
+		}
+	default:
+		return fmt.Errorf("expected SINCE, BETWEEN or ON at '%s'", p.query[start:])
+	}
+
+	if p.time_from > p.time_to { // is the end time before the start time?
+		if p.options.StrictRange {
+			return fmt.Errorf("range end precedes start at '%s'", p.query[start:])
+		}
+		p.time_from, p.time_to = p.time_to, p.time_from // swap start and end time
+	}
+
+	if p.options.ForbidFullScan {
+		if error := p.check_scan_window(p.query[start:p.tokens[p.token_index-1].stmt_end]); error != nil {
+			return error
+		}
+	}
+
+	p.time_ranges = append(p.time_ranges, time_range(p.time_from, p.time_to, p.time_to_exclusive))
+	return nil
+}
+
+// SAMPLE <num>% or SAMPLE <int> ROWS, to look at part of a huge result only.
+// How the sample is taken is up to whoever runs the query, the parser passes it on.
+func (p *Parser) do_sample() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	p.take_word()
+	p.token_index++ // skip past SAMPLE
+	size := &p.tokens[p.token_index]
+	if size.tag != "int" && size.tag != "float" {
+		return fmt.Errorf("expected percentage or number of rows after SAMPLE at '%s'", p.query[size.stmt_pos:])
+	}
+	p.token_index++
+
+	// The lexer can't tell a percent sign from modulo, but there's no arithmetic here.
+	// Still, a percent sign goes right after the number: SAMPLE 10%, or it's spelled out, SAMPLE 10 PERCENT.
+	switch token := &p.tokens[p.token_index]; {
+	case token.val == "%" && token.stmt_pos != size.stmt_end:
+		return fmt.Errorf("%% goes right after the number, as in SAMPLE %s%%, at '%s'", size.val, p.query[size.stmt_pos:])
+	case token.val == "%", p.is_word("PERCENT"): // not MOD
+		if token.tag == "ident" {
+			p.take_word()
+		}
+		percent, error := strconv.ParseFloat(size.val, 64)
+		if error != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("SAMPLE percentage has to be more than 0 and at most 100 at '%s'", p.query[size.stmt_pos:])
+		}
+		p.sample.Percent = percent
+	case p.is_word("ROWS"):
+		p.take_word()
+		rows, error := strconv.Atoi(size.val)
+		if size.tag != "int" || error != nil || rows < 1 {
+			return fmt.Errorf("SAMPLE has to be at least 1 row at '%s'", p.query[size.stmt_pos:])
+		}
+		p.sample.Rows = rows
+	default:
+		return fmt.Errorf("expected %%, PERCENT or ROWS after SAMPLE %s at '%s'", size.val, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past %, PERCENT or ROWS
+
+	return nil
+}
+
+// Predictable alias for an aggregate without AS: count_star, sum_bytes, count_distinct_src_ip
+func (agg *aggregate) generate_alias() string {
+	alias := strings.ToLower(agg.function) + "_"
+	if agg.distinct {
+		alias += "distinct_"
+	}
+	if agg.field == "*" {
+		return alias + "star"
+	}
+
+	// user.name -> user_name, so it's still a valid identifier
+	return alias + strings.Map(func(r rune) rune {
+		if r == '.' || r == '@' || r == '$' {
+			return '_'
+		}
+		return r
+	}, agg.field)
+}
+
+// <as-clause> = AS <field-name>
+// The alias may be quoted, for spaces or keywords: AS 'Source IP'
+func (p *Parser) do_as_clause(alias *string) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	p.token_index++ // skip past AS keyword
+
+	switch p.tokens[p.token_index].tag {
+	case "ident", "string":
+		if p.tokens[p.token_index].val == "" {
+			return fmt.Errorf("empty alias at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		*alias = p.tokens[p.token_index].val
+		p.token_index++
+	default:
+		return fmt.Errorf("expected alias after AS at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	return nil
+}
+
+// <aggregate> = <function> <lparen> ( <asterisk> | <field-ref> ) <rparen> [ <as-clause> ]
+func (p *Parser) do_aggregate() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	var new_aggregate aggregate
+
+	p.take_word()
+	new_aggregate.function = strings.ToUpper(p.tokens[p.token_index].val)
+	if !aggregate_functions[new_aggregate.function] {
+		return fmt.Errorf("unknown function '%s' at '%s'", p.tokens[p.token_index].val, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	// <function> ( <arg> )
+	if p.token_index+3 >= p.num_tokens {
+		return fmt.Errorf("%s() cut short at '%s'", new_aggregate.function, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index += 2 // skip past function name and opening parenthesis
+
+	// <function> ( DISTINCT <arg> )
+	if p.tokens[p.token_index].token == sym_distinct {
+		switch new_aggregate.function {
+		case "MIN", "MAX": // valid, but the smallest of the unique values is the smallest value
+			p.warnings = append(p.warnings,
+				fmt.Sprintf("DISTINCT has no effect on %s()", new_aggregate.function))
+		}
+		new_aggregate.distinct = true
+		p.token_index++
+	}
+
+	switch {
+	case p.tokens[p.token_index].token == sym_mul && new_aggregate.function == "COUNT" && !new_aggregate.distinct:
+		new_aggregate.field = "*"
+	case p.tokens[p.token_index].tag == "ident":
+		if error := p.unqualified(p.token_index, "in "+new_aggregate.function+"()"); error != nil {
+			return error
+		}
+		new_aggregate.field = p.resolve_field(p.tokens[p.token_index].val)
+	default:
+		return fmt.Errorf("expected field in %s() at '%s'", new_aggregate.function, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++
+
+	if p.tokens[p.token_index].token != sym_rparen {
+		return fmt.Errorf("expected closing parenthesis at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++
+
+	// <as-clause>
+	if p.tokens[p.token_index].token == sym_as {
+		if error := p.do_as_clause(&new_aggregate.alias); error != nil {
+			return error
+		}
+	} else { // so that it can be referred to later on
+		new_aggregate.alias = new_aggregate.generate_alias()
+		new_aggregate.generated = true
+	}
+
+	for i := range p.aggregates {
+		if p.aggregates[i].alias == new_aggregate.alias {
+			return fmt.Errorf("duplicate aggregate alias %s, use AS to name it at '%s'", new_aggregate.alias, p.query[p.tokens[p.token_index-1].stmt_pos:])
+		}
+	}
+
+	p.aggregates = append(p.aggregates, new_aggregate)
+
+	return nil
+}
+
+func (p *Parser) do_derived_field() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	switch p.tokens[p.token_index].tag {
+	case "int", "float", "string":
+		// TODO: not yet implemented
+		return fmt.Errorf("literal values in <derived-field> not yet implemented at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	case "ident":
+		// function? look-ahead(1)
+		if p.peek(1).token == sym_lparen {
+			return p.do_aggregate()
+		}
+
+		// TODO: only implemented straight retrieval of field, with optional alias (<as-clause>)
+		if p.fields == nil {
+			p.fields = make([]string, 0, 8) // a handful is typical, append grows it if need be
+		}
+		field := p.tokens[p.token_index].val
+		p.fields = append(p.fields, p.resolve_field(field))
+		p.field_sources = append(p.field_sources, p.tokens[p.token_index].source)
+
+		if p.field_aliases == nil {
+			p.field_aliases = make([]string, 0, 8)
+		}
+		p.token_index++
+		if p.peek(0).token == sym_as { // field alias?
+			var alias string
+			if error := p.do_as_clause(&alias); error != nil {
 				return error
 			}
-		} else {
-			if tt, err := time.Parse(time.DateTime, p.tokens[p.token_index].val); err == nil {
-				// Could be an ISO-8601 / RFC-3339 datetime (without timezone)
-				// See https://www.iso.org/iso-8601-date-and-time-format.html
-				// and https://www.rfc-editor.org/rfc/rfc3339
-				// TODO: test fail BETWEEN '2020-05-04' AND '2022-10-09' ends up BETWEEN 2020-05-04 10:00:00 AND 2022-10-09 10:00:00
-				clock_ref = tt.UTC().UnixNano()
-			} else if tt, err := time.Parse(time.DateOnly, p.tokens[p.token_index].val); err == nil {
-				clock_ref = tt.UTC().UnixNano()
-			} else if tt, err := time.Parse(time.TimeOnly, p.tokens[p.token_index].val); err == nil {
-				clock_ref = tt.UTC().UnixNano()
-			} else { // Something invalid/unknown
-				return fmt.Errorf("invalid temporal reference at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+			p.field_aliases = append(p.field_aliases, alias)
+		} else { // no field alias
+			p.field_aliases = append(p.field_aliases, field) // use main field name
+		}
+	default:
+		return fmt.Errorf("unexpected clause in <derived-key> at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	return nil
+}
+
+func (p *Parser) do_stmt_sublist() error {
+	var sublist int
+
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+exitloop:
+	for p.token_index < p.num_tokens {
+		switch p.tokens[p.token_index].token {
+		case sym_comma:
+			// comma before first <stmt-sublist>, two adjacent, or after last (using look-ahead)
+			if sublist < 1 || (p.token_index+1 < p.num_tokens && p.tokens[p.token_index+1].token != sym_none) {
+				return fmt.Errorf("expected <stmt-sublist> at '%s'", p.query[p.tokens[p.token_index+1].stmt_pos:])
+			}
+			p.token_index++
+		case sym_matching:
+			break exitloop // let caller deal with this
+		case sym_since:
+			break exitloop // let caller deal with this
+		case sym_between:
+			break exitloop // let caller deal with this
+		case sym_on:
+			break exitloop // let caller deal with this
+		case sym_none:
+			sublist++
+			if error := p.check_context(); error != nil {
+				return error
+			}
+			if error := p.do_derived_field(); error != nil {
+				return error
+			}
+		default:
+			if sublist < 1 {
+				return fmt.Errorf("unexpected clause in <stmt-sublist> at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
 			}
+			break exitloop // let caller deal with this
+		}
+	}
+
+	if sublist < 1 {
+		return fmt.Errorf("FIND statement cut short '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	return nil
+}
+
+func (p *Parser) do_stmt_list() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	// FIND DISTINCT src_ip, dest_ip is the same as a DISTINCT stage without fields
+	if p.tokens[p.token_index].token == sym_distinct {
+		p.token_index++
+		p.find_flags |= find_flags_distinct
+		p.distinct_row = true
+	}
+
+	// FIND FIELDS src_ip, dest_ip is just FIND src_ip, dest_ip, for tools that like to spell it out.
+	// FIELDS isn't reserved, "FIND fields SINCE ..." still asks for a field by that name.
+	if p.is_fields_word() {
+		if p.peek(1).token == sym_all {
+			return fmt.Errorf("ALL and FIELDS can not be combined at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		p.take_word()
+		p.token_index++ // skip past FIELDS
+	}
+
+	switch p.tokens[p.token_index].token {
+	case sym_all:
+		p.token_index++
+		p.find_flags |= find_flags_all // we are asked to return all keys
+		if p.is_fields_word() {
+			return fmt.Errorf("ALL and FIELDS can not be combined at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+	case sym_lparen: // FIND (src_ip, dest_ip) is just FIND src_ip, dest_ip
+		p.token_index++ // skip past opening parenthesis
+		if error := p.do_stmt_sublist(); error != nil {
+			return error
+		}
+		if p.tokens[p.token_index].token != sym_rparen {
+			return fmt.Errorf("expected closing parenthesis after field list at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		p.token_index++
+	default:
+		if error := p.do_stmt_sublist(); error != nil {
+			return error
+		}
+		if p.tokens[p.token_index].token == sym_rparen {
+			return fmt.Errorf("closing parenthesis without opening one at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+	}
+
+	return nil
+}
+
+// FIELDS ahead of the field list, rather than a field called fields: it has to be followed by
+// a field, a parenthesised field list or ALL (which is an error, but a clearer one this way)
+func (p *Parser) is_fields_word() bool {
+	if !p.is_word("FIELDS") {
+		return false
+	}
+	next := p.peek(1)
+	return next.tag == "ident" || next.token == sym_lparen || next.token == sym_all
+}
+
+// <sort-list> = <field-ref> [ ASC | DESC ] { <comma> <field-ref> [ ASC | DESC ] }
+// Used by both "| SORT" and "ORDER BY", so they end up in the same place.
+func (p *Parser) do_sort_list() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	for {
+		if p.tokens[p.token_index].tag != "ident" {
+			return fmt.Errorf("expected field to sort on at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		if p.is_word("RANDOM") {
+			return p.do_sort_random()
+		}
+		if error := p.unqualified(p.token_index, "to sort on"); error != nil {
+			return error
+		}
+		key := sort_key{field: p.resolve_field(p.tokens[p.token_index].val)}
+		p.token_index++
+
+		if error := p.do_collate(&key); error != nil {
+			return error
+		}
+		switch p.tokens[p.token_index].token {
+		case sym_asc:
 			p.token_index++
+		case sym_desc:
+			key.desc = true
+			p.token_index++
+		}
+		if error := p.do_nulls(&key); error != nil {
+			return error
+		}
+		p.sort_keys = append(p.sort_keys, key)
+
+		// look-ahead(1) for the next key
+		if p.token_index+1 >= p.num_tokens || p.tokens[p.token_index].token != sym_comma {
+			break
+		}
+		p.token_index++ // skip past comma
+	}
+
+	return nil
+}
+
+// COLLATE <name> after a sort key, a hint for whoever sorts: COLLATE nocase, COLLATE 'de_DE'.
+// COLLATE isn't a keyword, so this only looks for it where a collation can go.
+func (p *Parser) do_collate(key *sort_key) error {
+	if !p.is_word("COLLATE") {
+		return nil
+	}
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	p.take_word()
+	p.token_index++ // skip past COLLATE
+	switch token := &p.tokens[p.token_index]; token.tag {
+	case "ident", "string":
+		if token.val == "" {
+			return fmt.Errorf("empty collation name at '%s'", p.query[token.stmt_pos:])
 		}
+		key.collation = token.val
 	default:
-		// Syntactically, "... BEFORE LAST" and "... AGO" should be handled here, not in do_reltime_ref()
-		if error := p.do_reltime_ref(&clock_ref, int_literal, end); error != nil {
+		return fmt.Errorf("expected collation name after COLLATE at '%s'", p.query[token.stmt_pos:])
+	}
+	p.token_index++
+
+	return nil
+}
+
+// NULLS FIRST or NULLS LAST, for where rows without the field go.
+// Without it they go last, ascending or descending alike.
+func (p *Parser) do_nulls(key *sort_key) error {
+	if !p.is_word("NULLS") {
+		return nil
+	}
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	p.take_word()
+	p.token_index++ // skip past NULLS
+	switch {
+	case p.is_word("FIRST"):
+		p.take_word()
+		key.nulls_first = true
+	case p.tokens[p.token_index].token == sym_last:
+	default:
+		return fmt.Errorf("expected FIRST or LAST after NULLS at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++
+
+	return nil
+}
+
+// <field-list> = <field-ref> { <comma> <field-ref> }
+func (p *Parser) do_field_list(fields *[]string, clause string) error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	for {
+		if p.tokens[p.token_index].tag != "ident" {
+			return fmt.Errorf("expected field at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		if error := p.check_context(); error != nil {
+			return error
+		}
+		if error := p.unqualified(p.token_index, "in "+clause); error != nil {
 			return error
 		}
+		*fields = append(*fields, p.resolve_field(p.tokens[p.token_index].val))
+		p.token_index++
+
+		// look-ahead(1) for the next field
+		if p.token_index+1 >= p.num_tokens || p.tokens[p.token_index].token != sym_comma {
+			break
+		}
+		p.token_index++ // skip past comma
+	}
+
+	return nil
+}
+
+// Words like RANDOM and TIME aren't keywords, a field can still be called random: SORT [random]
+func (p *Parser) is_word(word string) bool {
+	token := &p.tokens[p.token_index]
+	return token.tag == "ident" && strings.EqualFold(token.val, word) && p.query[token.stmt_pos] != '['
+}
+
+// The current token is used as a word here, not a field, so FormatQuery() can upper case it
+func (p *Parser) take_word() {
+	p.words = append(p.words, p.token_index)
+}
+
+// SORT RANDOM shuffles the results, so there's nothing else to sort on
+func (p *Parser) do_sort_random() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if len(p.sort_keys) > 0 {
+		return fmt.Errorf("RANDOM can not be combined with other sort keys at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.take_word()
+	p.token_index++ // skip past RANDOM
+
+	switch p.tokens[p.token_index].token {
+	case sym_asc, sym_desc:
+		return fmt.Errorf("RANDOM has no direction at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	case sym_comma:
+		return fmt.Errorf("RANDOM can not be combined with other sort keys at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.sort_random = true
+
+	return nil
+}
+
+func (p *Parser) do_order_by() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.token_index+2 >= p.num_tokens || p.tokens[p.token_index+1].token != sym_by {
+		return fmt.Errorf("expected ORDER BY <field> at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index += 2 // skip past ORDER BY keywords
+
+	p.stage_flags |= stage_flags_order_by
+	return p.do_sort_list()
+}
+
+func (p *Parser) do_sort() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.stage_flags&stage_flags_order_by != 0 {
+		return fmt.Errorf("SORT can not be combined with ORDER BY at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	if p.stage_flags&stage_flags_sort != 0 {
+		return fmt.Errorf("duplicate SORT at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	if p.token_index+1 >= p.num_tokens {
+		return fmt.Errorf("SORT statement cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past SORT keyword
+
+	p.stage_flags |= stage_flags_sort
+	return p.do_sort_list()
+}
+
+func (p *Parser) do_group() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.stage_flags&stage_flags_group != 0 {
+		return fmt.Errorf("duplicate GROUP at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	if p.token_index+1 >= p.num_tokens {
+		return fmt.Errorf("GROUP statement cut short at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past GROUP keyword
+
+	p.stage_flags |= stage_flags_group
+	if error := p.do_group_list(); error != nil {
+		return error
+	}
+
+	// With aggregates, any plain field is ambiguous unless we group on it
+	if len(p.aggregates) > 0 {
+		for _, field := range p.fields {
+			if !in_list(field, p.group_fields) {
+				return fmt.Errorf("field %s must appear in GROUP or an aggregate", field)
+			}
+		}
+	}
+
+	if p.tokens[p.token_index].token == sym_having {
+		return p.do_having()
+	}
+
+	return nil
+}
+
+// <group-list> = <group-item> { <comma> <group-item> }, each a field or time(<duration>)
+func (p *Parser) do_group_list() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	for {
+		if error := p.check_context(); error != nil {
+			return error
+		}
+		if p.is_word("TIME") && p.tokens[p.token_index+1].token == sym_lparen {
+			if error := p.do_time_bucket(); error != nil {
+				return error
+			}
+		} else {
+			if p.tokens[p.token_index].tag != "ident" {
+				return fmt.Errorf("expected field at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+			}
+			if error := p.unqualified(p.token_index, "in GROUP"); error != nil {
+				return error
+			}
+			p.group_fields = append(p.group_fields, p.resolve_field(p.tokens[p.token_index].val))
+			p.token_index++
+		}
+
+		// look-ahead(1) for the next field
+		if p.token_index+1 >= p.num_tokens || p.tokens[p.token_index].token != sym_comma {
+			break
+		}
+		p.token_index++ // skip past comma
 	}
 
-	*t = clock_ref
 	return nil
 }
 
-func (p *Parser) do_temp_since() error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+// time(1h) groups by the hour, for a histogram. The buckets start at midnight (UTC),
+// so the size has to fit a day evenly (15m, 1h, 6h) or be whole days (24h, 168h).
+func (p *Parser) do_time_bucket() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
 
-	// decode desired start time
-	if error := p.do_temp_ref(&p.time_from, false); error != nil {
-		return error
+	if p.time_bucket != 0 {
+		return fmt.Errorf("duplicate time bucket at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.take_word()
+	p.token_index += 2 // skip past time and opening parenthesis
+
+	token := &p.tokens[p.token_index]
+	if token.tag != "duration" {
+		return fmt.Errorf("expected bucket size such as 15m or 1h at '%s'", p.query[token.stmt_pos:])
+	}
+	size, err := time.ParseDuration(token.val)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid bucket size %s at '%s'", token.val, p.query[token.stmt_pos:])
 	}
+	day := 24 * time.Hour
+	if (size < day && day%size != 0) || (size > day && size%day != 0) {
+		return fmt.Errorf("bucket size %s doesn't divide a day evenly, nor is it whole days, at '%s'", token.val, p.query[token.stmt_pos:])
+	}
+	p.token_index++
 
-	// for "SINCE", end time is now
-	p.time_to = time.Now().UnixNano()
+	if p.tokens[p.token_index].token != sym_rparen {
+		return fmt.Errorf("expected closing parenthesis at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++
+	p.time_bucket = int64(size)
 
 	return nil
 }
 
-func (p *Parser) do_temp_between() error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+// HAVING filters the grouped results, so it may only look at grouped fields and aggregate aliases
+func (p *Parser) do_having() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
 
-	// decode desired start time
-	if error := p.do_temp_ref(&p.time_from, false); error != nil {
+	p.token_index++ // skip past HAVING keyword
+
+	start := p.token_index
+	if error := p.do_matching_cond(&p.having_tree, &p.having_list); error != nil {
 		return error
 	}
 
-	if p.tokens[p.token_index].token != sym_and {
-		return fmt.Errorf("missing AND in <temp-between> at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	var aliases []string
+	for _, agg := range p.aggregates {
+		if agg.alias != "" {
+			aliases = append(aliases, agg.alias)
+		}
 	}
-	p.token_index++ // skip past AND keyword
 
-	// decode desired end time, inclusive
-	if error := p.do_temp_ref(&p.time_to, true); error != nil {
-		return error
+	for _, token := range p.tokens[start:p.token_index] {
+		if token.tag == "ident" && !in_list(p.resolve_field(token.val), p.group_fields) && !in_list(token.val, aliases) {
+			return fmt.Errorf("HAVING may only use grouped fields and aggregate aliases, not %s at '%s'", token.val, p.query[token.stmt_pos:])
+		}
 	}
+	p.always_empty = p.always_empty || never_matches(p.having_tree)
 
 	return nil
 }
 
-func (p *Parser) do_temp_cond() error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+func (p *Parser) do_distinct() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
 
-	switch p.tokens[p.token_index].token {
-	case sym_since:
-		p.token_index++ // skip past SINCE keyword
-		if error := p.do_temp_since(); error != nil {
-			return error
-		}
-	case sym_between:
-		p.token_index++ // skip past BETWEEN keyword
-		if error := p.do_temp_between(); error != nil {
-			return error
+	if p.stage_flags&stage_flags_distinct != 0 {
+		return fmt.Errorf("duplicate DISTINCT at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	if p.find_flags&find_flags_distinct != 0 {
+		return fmt.Errorf("DISTINCT stage can not be combined with FIND DISTINCT at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past DISTINCT keyword
+	p.stage_flags |= stage_flags_distinct
+
+	// DISTINCT on its own is over everything selected, rather than some fields
+	if p.tokens[p.token_index].tag != "ident" {
+		p.distinct_row = true
+		return nil
+	}
+
+	return p.do_field_list(&p.distinct_fields, "DISTINCT")
+}
+
+// LIMIT <int-literal> [ BY <field-list> ]
+// With BY it's a limit per group rather than overall: SORT bytes DESC | LIMIT 5 BY src_ip
+// is the top 5 for each src_ip. The BY fields have to be selected or grouped on.
+func (p *Parser) do_limit() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.stage_flags&stage_flags_limit != 0 {
+		return fmt.Errorf("duplicate LIMIT at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++ // skip past LIMIT keyword
+	p.stage_flags |= stage_flags_limit
+
+	if p.tokens[p.token_index].tag != "int" {
+		return fmt.Errorf("expected number of rows after LIMIT at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	if error := p.do_int_literal(&p.limit); error != nil {
+		return error
+	}
+	if p.limit < 1 {
+		return fmt.Errorf("LIMIT has to be at least 1 at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.token_index++
+
+	if p.tokens[p.token_index].token != sym_by {
+		return nil
+	}
+	p.token_index++ // skip past BY keyword
+
+	start := p.token_index
+	if error := p.do_field_list(&p.limit_by, "LIMIT BY"); error != nil {
+		return error
+	}
+	if p.find_flags&find_flags_all != 0 {
+		return nil
+	}
+	for i, field := range p.limit_by {
+		if !in_list(field, p.fields) && !in_list(field, p.group_fields) {
+			return fmt.Errorf("LIMIT BY field %s is not selected or grouped at '%s'", field, p.query[p.tokens[start+2*i].stmt_pos:])
 		}
-	default:
-		// shouldn't happen, caller do_syntax() has already picked
 	}
 
-	if p.time_from > p.time_to { // is the end time before the start time?
-		p.time_from, p.time_to = p.time_to, p.time_from // swap start and end time
+	return nil
+}
+
+// FORMAT is a hint for whoever runs the query, how to present the results.
+// It's always the last stage, checked by do_stmt2()
+func (p *Parser) do_format() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	p.token_index++ // skip past FORMAT keyword
+	p.stage_flags |= stage_flags_format
+
+	if p.tokens[p.token_index].tag != "ident" {
+		return fmt.Errorf("expected output format (JSON, CSV or TABLE) at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
 	}
 
-	fmt.Fprintf(os.Stderr, "... BETWEEN %s AND %s\n", // DEBUG
-		time.Unix(0, p.time_from).UTC().Format(time.DateTime), // DEBUG
-		time.Unix(0, p.time_to).UTC().Format(time.DateTime))   // DEBUG
+	format, exists := format_table[strings.ToUpper(p.tokens[p.token_index].val)]
+	if !exists {
+		return fmt.Errorf("unknown output format %s, expected JSON, CSV or TABLE at '%s'", p.tokens[p.token_index].val, p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	p.format = format
+	p.token_index++
 
 	return nil
 }
 
-func (p *Parser) do_derived_field() error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+// An AND group with two different equalities on the same field can never match:
+// dest_port=80 AND dest_port=443. Only within an AND group, OR is fine.
+// Numbers go by their value, dest_port=80 AND dest_port=080 can match, and
+// without regard to case, name EQUALS-IGNORE-CASE 'admin' AND name='ADMIN' can too.
+func (p *Parser) warn_contradictions() {
+	for _, or := range p.or_list {
+		equals := make(map[string]*comparison) // first equality per field
+		group := []*comparison{&or.comparison}
+		for _, and := range or.and_list {
+			group = append(group, &and.comparison)
+		}
 
-	switch p.tokens[p.token_index].tag {
+		for _, c := range group {
+			if c.this.op != OpEqual || c.left_expr != nil || *c.left.lexer_tag != "ident" || *c.right.lexer_tag == "ident" {
+				continue
+			}
+
+			field := c.left.qualified_name() // netflow:a and dns:a are different fields
+			first, exists := equals[field]
+			if !exists {
+				equals[field] = c
+				continue
+			}
+			// Multiplied out, (a=1 OR b=2) AND x=1 AND x=2 has the same two in both groups, once is enough
+			warning := fmt.Sprintf("%s=%s AND %s=%s can never match", field, *first.right.lexer_val, field, *c.right.lexer_val)
+			order, comparable := literal_order(&first.right, &c.right, first.ignore_case || c.ignore_case)
+			if comparable && order != 0 && !in_list(warning, p.warnings) {
+				p.warnings = append(p.warnings, warning)
+			}
+		}
+	}
+}
+
+// Without a schema, what a field holds going by what it's compared with:
+// dest_port > 1024 is a number, name='x' a string, src_ip='10.0.0.1' an IP address.
+// A field compared with both a number and a string is probably a mistake, that's a warning.
+func (p *Parser) infer_types() {
+	first := make(map[string]*item) // first value per field, for the warning
+
+	for _, c := range p.matching_tree.comparisons() {
+		if c.left_expr != nil || *c.left.lexer_tag != "ident" {
+			continue
+		}
+		if c.this.op == OpMatches { // a pattern says nothing about the field, ua =~ '^10\.' isn't a string of digits
+			continue
+		}
+		field := c.left.qualified_name()
+
+		values := []*item{&c.right}
+		if c.this.op == OpBetween {
+			values = append(values, &c.upper)
+		}
+		for _, value := range values {
+			kind := literal_type(value)
+			if kind == FieldAny {
+				continue
+			}
+			if p.inferred == nil {
+				p.inferred = make(map[string]FieldType)
+			}
+
+			seen, exists := p.inferred[field]
+			switch {
+			case !exists:
+				p.inferred[field] = kind
+				first[field] = value
+			case seen == FieldAny: // already found conflicting
+			case merge_types(seen, kind) == FieldAny:
+				p.inferred[field] = FieldAny
+				p.warnings = append(p.warnings,
+					fmt.Sprintf("%s is compared with both a number and a string: %s and %s", field, first[field], value))
+			default:
+				p.inferred[field] = merge_types(seen, kind)
+			}
+		}
+	}
+}
+
+// What a literal looks like, FieldAny for fields and anything else
+func literal_type(value *item) FieldType {
+	switch *value.lexer_tag {
 	case "int":
-		// TODO: not yet implemented
-		break
+		return FieldInt
 	case "float":
-		// TODO: not yet implemented
-		break
+		return FieldFloat
 	case "string":
-		// TODO: not yet implemented
-		break
-	case "ident":
-		// TODO: only implemented straight retrieval of field, with optional alias (<as-clause>)
-		if p.fields == nil {
-			p.fields = make([]string, 0, 100)
+		switch value.typed.(type) {
+		case netip.Addr, netip.Prefix:
+			return FieldIP
 		}
-		field := p.tokens[p.token_index].val
-		p.fields = append(p.fields, field)
+		return FieldString
+	case "time": // unix epoch nanoseconds
+		return FieldInt
+	}
+	return FieldAny
+}
 
-		if p.field_aliases == nil {
-			p.field_aliases = make([]string, 0, 100)
+// Type that fits both, FieldAny if a number meets a string.
+// An integer and a float make a float, an IP address and another string a string.
+func merge_types(a, b FieldType) FieldType {
+	numeric := func(t FieldType) bool { return t == FieldInt || t == FieldFloat }
+
+	switch {
+	case a == b:
+		return a
+	case numeric(a) && numeric(b):
+		return FieldFloat
+	case !numeric(a) && !numeric(b):
+		return FieldString
+	}
+	return FieldAny
+}
+
+// Constant folding: true if the conditions can never be true, going by comparisons between
+// literals that are false, like 1=2. An AND is never true if any of its conditions is false,
+// an OR if all of them are. Comparisons involving fields or arithmetic aren't looked at.
+func never_matches(node *cond_node) bool {
+	switch {
+	case node == nil:
+		return false
+	case node.conjunction == ConjunctionNone:
+		result, folded := node.comparison.fold()
+		return folded && !result
+	}
+
+	for _, child := range node.children {
+		never := never_matches(child)
+		if node.conjunction == ConjunctionAnd && never {
+			return true
 		}
-		if p.token_index+2 < p.num_tokens && p.tokens[p.token_index+1].token == sym_as { // field alias?
-			p.field_aliases = append(p.field_aliases, p.tokens[p.token_index].val)
-			p.token_index += 3
-		} else { // no field alias
-			p.field_aliases = append(p.field_aliases, field) // use main field name
-			p.token_index++
+		if node.conjunction == ConjunctionOr && !never {
+			return false
 		}
-	default:
-		return fmt.Errorf("unexpected clause in <derived-key> at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+	return node.conjunction == ConjunctionOr
+}
+
+// Outcome of a comparison between literals, folded is false if it can't be worked out
+// here: there's a field or an expression involved, or a number is compared with a string.
+func (c *comparison) fold() (result bool, folded bool) {
+	if c.left_expr != nil {
+		return false, false
 	}
 
-	/*
-		// look-ahead (1)
-		if (p.token_index+1) < p.num_tokens && p.tokens[p.token_index+1].token == sym_comma {
-			p.token_index++ // skip past comma
+	if c.this.op == OpMatches {
+		if *c.left.lexer_tag != "string" {
+			return false, false
+		}
+		return c.right.typed.(*regexp.Regexp).MatchString(*c.left.lexer_val), true
+	}
+	if c.this.op == OpContains {
+		if *c.left.lexer_tag != "string" { // right is always a string
+			return false, false
+		}
+		haystack, needle := *c.left.lexer_val, *c.right.lexer_val
+		if c.ignore_case {
+			haystack, needle = strings.ToLower(haystack), strings.ToLower(needle)
 		}
-	*/
+		return strings.Contains(haystack, needle), true
+	}
 
-	return nil
-}
+	left, ok := literal_order(&c.left, &c.right, c.ignore_case)
+	if !ok {
+		return false, false
+	}
+	if c.this.op == OpBetween {
+		upper, ok := literal_order(&c.left, &c.upper, c.ignore_case)
+		if !ok {
+			return false, false
+		}
+		if c.exclusive {
+			return left >= 0 && upper < 0, true
+		}
+		return left >= 0 && upper <= 0, true
+	}
 
-func (p *Parser) do_stmt_sublist() error {
-	var sublist int
+	switch c.this.op {
+	case OpEqual:
+		return left == 0, true
+	case OpNotEqual:
+		return left != 0, true
+	case OpLess:
+		return left < 0, true
+	case OpGreater:
+		return left > 0, true
+	case OpLessEqual:
+		return left <= 0, true
+	case OpGreaterEqual:
+		return left >= 0, true
+	}
 
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+	return false, false
+}
 
-exitloop:
-	for p.token_index < p.num_tokens {
-		switch p.tokens[p.token_index].token {
-		case sym_comma:
-			// comma before first <stmt-sublist>, two adjacent, or after last (using look-ahead)
-			if sublist < 1 || (p.token_index+1 < p.num_tokens && p.tokens[p.token_index+1].token != sym_none) {
-				return fmt.Errorf("expected <stmt-sublist> at '%s'", p.query[p.tokens[p.token_index+1].stmt_pos:])
-			}
-			p.token_index++
-		case sym_matching:
-			break exitloop // let caller deal with this
-		case sym_since:
-			break exitloop // let caller deal with this
-		case sym_between:
-			break exitloop // let caller deal with this
-		case sym_none:
-			sublist++
-			if error := p.do_derived_field(); error != nil {
-				return error
-			}
-		default:
-			if sublist < 1 {
-				return fmt.Errorf("unexpected clause in <stmt-sublist> at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
-			}
+// -1, 0 or 1 as literal a is smaller than, equal to or larger than literal b.
+// Numbers compare as numbers and strings as strings, ok is false for anything else.
+func literal_order(a, b *item, ignore_case bool) (int, bool) {
+	numeric := func(i *item) bool { return *i.lexer_tag == "int" || *i.lexer_tag == "float" }
+
+	switch {
+	case numeric(a) && numeric(b):
+		x, err := literal_float(*a.lexer_val)
+		if err != nil {
+			return 0, false
 		}
+		y, err := literal_float(*b.lexer_val)
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case *a.lexer_tag == "time" && *b.lexer_tag == "time": // unix epoch nanoseconds
+		x, y := a.typed.(int64), b.typed.(int64)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case *a.lexer_tag == "string" && *b.lexer_tag == "string" && ignore_case:
+		return strings.Compare(strings.ToLower(*a.lexer_val), strings.ToLower(*b.lexer_val)), true
+	case *a.lexer_tag == "string" && *b.lexer_tag == "string":
+		return strings.Compare(*a.lexer_val, *b.lexer_val), true
 	}
 
-	if sublist < 1 {
-		return fmt.Errorf("FIND statement cut short '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	return 0, false
+}
+
+// Value of an int or float literal, E notation integers included
+func literal_float(s string) (float64, error) {
+	if i, err := parse_int(s); err == nil {
+		return float64(i), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// With a schema and AllowUnknownFields off, reject fields the schema doesn't know about.
+// Looks at the identifiers in tokens[start:end], except function names and AS aliases.
+func (p *Parser) check_fields(start, end int) error {
+	if p.options.AllowUnknownFields || p.options.Schema == nil {
+		return nil
 	}
 
-	fmt.Fprintf(os.Stderr, "Fields=%v\nAliases=%v\n", p.fields, p.field_aliases) // DEBUG
+	for i := start; i < end; i++ {
+		token := &p.tokens[i]
+		if token.tag != "ident" || p.tokens[i+1].token == sym_lparen || (i > 0 && p.tokens[i-1].token == sym_as) {
+			continue
+		}
+		if is_presence_word(token) && p.tokens[i+1].tag == "ident" { // EXISTS error_code
+			continue
+		}
+		if !in_list(p.resolve_field(token.val), p.options.Schema) {
+			return fmt.Errorf("unknown field %s at '%s'", token.val, p.query[token.stmt_pos:])
+		}
+	}
 
 	return nil
 }
 
-func (p *Parser) do_stmt_list() error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+// A pipe, or || which is two of them as far as the user is concerned
+func (p *Parser) is_pipe() bool {
+	token := &p.tokens[p.token_index]
+	return token.token == sym_pipe || token.token == sym_or && token.val == "||"
+}
+
+// Secondary statements, following a pipe
+func (p *Parser) do_stmt2() error {
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+
+	if p.stage_flags&stage_flags_format != 0 {
+		return fmt.Errorf("FORMAT has to be the last stage at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
 
 	switch p.tokens[p.token_index].token {
-	case sym_all:
-		p.token_index++
-		p.find_flags |= find_flags_all // we are asked to return all keys
+	case sym_sort:
+		return p.do_sort()
+	case sym_group:
+		return p.do_group()
+	case sym_distinct:
+		return p.do_distinct()
+	case sym_limit:
+		return p.do_limit()
+	case sym_format:
+		return p.do_format()
 	default:
-		return p.do_stmt_sublist()
+		return fmt.Errorf("expected SORT, GROUP, DISTINCT, LIMIT or FORMAT at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
 	}
-
-	return nil
 }
 
 func (p *Parser) do_stmt() error {
-	fmt.Fprintf(os.Stderr, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
+	fmt.Fprintf(trace, "%s(): %v\n", CurrentFunctionName(), p.tokens[p.token_index])
 
 	switch p.tokens[p.token_index].token {
 	case sym_find: // only statement type we have right now
 		p.token_index++
+		start := p.token_index
 		if error := p.do_stmt_list(); error != nil {
 			return error
 		}
+		if error := p.check_fields(start, p.token_index); error != nil {
+			return error
+		}
 	default:
 		// already checked by calling function do_syntax()
 	}
@@ -641,6 +2834,11 @@ func (p *Parser) do_syntax() error {
 		if error := p.do_stmt(); error != nil {
 			return error
 		}
+	case sym_matching, sym_since, sym_between, sym_on: // "SINCE LAST HOUR" is "FIND ALL SINCE LAST HOUR"
+		if !p.options.ImplicitFindAll {
+			return fmt.Errorf("expected statement at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		p.find_flags |= find_flags_all
 	default:
 		return fmt.Errorf("expected statement at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
 	}
@@ -648,67 +2846,224 @@ func (p *Parser) do_syntax() error {
 	switch p.tokens[p.token_index].token {
 	case sym_matching:
 		p.token_index++
-		if error := p.do_matching_cond(); error != nil {
+		start := p.token_index
+		if error := p.do_matching_cond(&p.matching_tree, &p.or_list); error != nil {
+			return error
+		}
+		if error := p.check_fields(start, p.token_index); error != nil {
 			return error
 		}
+		p.warn_contradictions()
+		p.infer_types()
+		p.always_empty = p.always_empty || never_matches(p.matching_tree)
 
 	default:
 		// sym_matching is optional
 	}
 
-	// Temporal reference is NOT optional
+	// Temporal reference is NOT optional, unless the RequireTemporal option is off
 	switch p.tokens[p.token_index].token {
-	case sym_since:
-		return p.do_temp_cond()
-	case sym_between:
-		return p.do_temp_cond()
+	case sym_since, sym_between, sym_on:
+	default:
+		if p.options.RequireTemporal {
+			return fmt.Errorf("expected temporal clause (SINCE, BETWEEN or ON) at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+	}
+	if error := p.do_temp_cond(); error != nil {
+		return error
+	}
+
+	// SAMPLE is optional, it's not a keyword as a field might well be called sample
+	if p.is_word("SAMPLE") {
+		if error := p.do_sample(); error != nil {
+			return error
+		}
+	}
+
+	// ORDER BY is optional, it's the SQL style equivalent of "| SORT"
+	if p.token_index < p.num_tokens && p.tokens[p.token_index].token == sym_order {
+		if error := p.do_order_by(); error != nil {
+			return error
+		}
+	}
+
+	// Any secondary statements?
+	for p.token_index < p.num_tokens && p.is_pipe() {
+		// The lexer takes || as OR, here it can only be two pipes with nothing in between
+		if p.tokens[p.token_index].token == sym_or {
+			return fmt.Errorf("empty pipe stage at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		}
+		p.token_index++ // skip past pipe
+
+		if p.token_index == p.num_tokens || p.tokens[p.token_index].token == sym_pipe {
+			return fmt.Errorf("empty pipe stage at '%s'", p.query[p.tokens[p.token_index-1].stmt_pos:])
+		}
+		if error := p.do_stmt2(); error != nil {
+			return error
+		}
+	}
+
+	// A complete statement has to use up all the tokens, anything left over is a mistake
+	if p.token_index < p.num_tokens {
+		return fmt.Errorf("unexpected trailing input at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+	}
+
+	// Aggregates without GROUP are over everything, a single row, so there's no room for plain fields.
+	// With GROUP, do_group() has checked them already.
+	if len(p.aggregates) > 0 && p.stage_flags&stage_flags_group == 0 && len(p.fields) > 0 {
+		return fmt.Errorf("field %s must appear in GROUP or an aggregate, there's no GROUP stage", p.fields[0])
+	}
+
+	return nil
+}
+
+// Check the value at the current token, the right-hand side of a comparison:
+// the lexer splits 12abc into 12 and abc, and with FieldTypes the value has to fit the field.
+func (p *Parser) check_value(c *comparison) error {
+	token := &p.tokens[p.token_index]
+	next := &p.tokens[p.token_index+1]
+
+	kind := "integer"
+	if token.tag == "float" {
+		kind = "floating point"
+	}
+	field := "expression"
+	if c.left_expr == nil {
+		field = *c.left.lexer_val
+	}
+
+	// Nothing in between, and it's not an operator or a sign: one malformed number
+	if (token.tag == "int" || token.tag == "float") && next.stmt_pos == token.stmt_end &&
+		(next.tag == "ident" || ((next.tag == "int" || next.tag == "float") && next.val[0] != '-' && next.val[0] != '+')) {
+		return fmt.Errorf("invalid %s literal '%s' in comparison on %s at %s", kind, p.query[token.stmt_pos:next.stmt_end], field, line_col(p.query, token.stmt_pos))
+	}
+
+	if c.left_expr != nil || token.tag == "ident" { // only literals against plain fields
+		return nil
+	}
+
+	var valid bool
+	switch p.options.FieldTypes[field] {
+	case FieldInt:
+		kind = "integer"
+		_, err := parse_int(token.val)
+		valid = token.tag != "float" && err == nil
+	case FieldFloat:
+		kind = "floating point"
+		_, err := strconv.ParseFloat(token.val, 64)
+		valid = err == nil
+	case FieldIP:
+		kind = "IP address"
+		valid = typed_value(token) != nil
 	default:
-		return fmt.Errorf("expected temporal clause (SINCE or BETWEEN) at '%s'", p.query[p.tokens[p.token_index].stmt_pos:])
+		valid = true
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s literal '%s' in comparison on %s at %s", kind, token.val, field, line_col(p.query, token.stmt_pos))
 	}
 
-	//return nil
+	return nil
 }
 
-// The parser is fed a single slice of lexer tokens by application
-func (p *Parser) parser() error {
-	// See if there are sub-commands. If so, chop 'em so they can get processed separately.
-	cmd := p.tokens
-	var cmd2 []lexer_token
-	for i := range cmd {
-		if p.tokens[i].token == sym_pipe {
-			cmd2 = cmd[i+1:]
-			cmd = cmd[:i-1]
-			_ = cmd
-			//fmt.Fprintf(os.Stderr, "len=%d\ncmd=%v\ncmd2=%v\n", len(cmd), cmd, cmd2)	// DEBUG
-			break
+// 1-based line:column of a byte offset in the query, for error messages
+func line_col(query string, pos int) string {
+	line_start := strings.LastIndexByte(query[:pos], '\n') + 1
+	return fmt.Sprintf("%d:%d", strings.Count(query[:pos], "\n")+1, utf8.RuneCountInString(query[line_start:pos])+1)
+}
+
+// The line of the query holding query[start:end], with that part underlined:
+//
+//	FIND src_ip MATCHING dest_port=443 BETWEN YESTERDAY AND TODAY
+//	                                   ^^^^^^
+//
+// Tabs are kept in the padding, so the underline lines up however wide they're shown.
+func underline(query string, start, end int) string {
+	line_start := strings.LastIndexByte(query[:start], '\n') + 1
+	line_end := len(query)
+	if i := strings.IndexByte(query[start:], '\n'); i >= 0 {
+		line_end = start + i
+	}
+	if end > line_end {
+		end = line_end
+	}
+
+	line := strings.TrimRight(query[line_start:line_end], "\r")
+	padding := []rune(query[line_start:start]) // one space per character, not per byte
+	for i := range padding {
+		if padding[i] != '\t' {
+			padding[i] = ' '
 		}
 	}
 
+	return line + "\n" + string(padding) + strings.Repeat("^", max_int(utf8.RuneCountInString(query[start:end]), 1))
+}
+
+func max_int(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Warnings returns the non-fatal issues found while parsing, if any
+func (p *Parser) Warnings() []string {
+	return p.warnings
+}
+
+// With the WarningsAsErrors option, the warnings are fatal after all
+func (p *Parser) check_warnings() error {
+	if !p.options.WarningsAsErrors || len(p.warnings) == 0 {
+		return nil
+	}
+	return fmt.Errorf("warning treated as error: %s", strings.Join(p.warnings, "; "))
+}
+
+// Current time in the location calendar references are taken in
+func (p *Parser) clock() time.Time {
+	now := time.Now()
+	if p.options.Now != nil {
+		now = p.options.Now()
+	}
+	if p.options.Location != nil {
+		return now.In(p.options.Location)
+	}
+
+	return now.UTC()
+}
+
+// The parser is fed a single slice of lexer tokens by application
+func (p *Parser) parser() error {
 	p.num_tokens = len(p.tokens)
 	p.token_index = 0 // Initialises to 0 anyway, but just to make it clear explicitly.
-	error := p.do_syntax()
-	if error != nil {
-		return fmt.Errorf("syntax error: %s", error)
-	}
 
-	// TODO: cmd2 processing
-	if len(cmd2) > 0 {
-		_ = cmd2
-		//return fmt.Errorf("sub-commands not yet implemented: %v", cmd2)
+	// All relative temporal references are resolved against the same point in time.
+	// When only validating, it doesn't matter where they end up, so don't bother with the clock.
+	if !p.validate_only {
+		p.now = p.clock()
 	}
 
-	// DEBUG
-	fmt.Fprintf(os.Stderr, "Parsed OR structure:\n")
-	for i := 0; i < len(p.or_list); i++ {
-		fmt.Fprintf(os.Stderr, "OR %s %s %s", *p.or_list[i].left.lexer_val, *p.or_list[i].this.lexer_tag, *p.or_list[i].right.lexer_val)
-		for j := 0; p.or_list != nil && j < len(p.or_list[i].and_list); j++ {
-			//fmt.Fprintf(os.Stderr, " AND %v", p.or_list[i].and_list[j])
-			fmt.Fprintf(os.Stderr, " AND %s %s %s", *p.or_list[i].and_list[j].left.lexer_val, *p.or_list[i].and_list[j].this.lexer_tag, *p.or_list[i].and_list[j].right.lexer_val)
+	// Terminate the token slice, so that looking at the token just past the end finds sym_eof.
+	// The full slice expression makes sure we append to a copy, not the caller's slice.
+	p.tokens = append(p.tokens[:p.num_tokens:p.num_tokens],
+		lexer_token{tag: "eof", token: sym_eof, stmt_pos: len(p.query), stmt_end: len(p.query)})
+
+	error := p.do_syntax()
+	if error != nil && p.ctx != nil && error == p.ctx.Err() {
+		return error // not a syntax error, we were told to stop
+	}
+	if error != nil {
+		if trace != io.Discard { // what we got before it went wrong, some of it may not be filled in
+			fmt.Fprintf(trace, "MATCHING %v\nHAVING %v\n", p.matching_tree, p.having_tree)
+		}
+		index := p.token_index
+		if index > p.num_tokens {
+			index = p.num_tokens
 		}
-		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("syntax error: %s\n%s", error, underline(p.query, p.tokens[index].stmt_pos, p.tokens[index].stmt_end))
+	}
+	if error := p.check_warnings(); error != nil {
+		return error
 	}
-	fmt.Fprintln(os.Stderr)
-	// DEBUG
 
 	return nil // Parsing completed successfully
 }
@@ -19,10 +19,30 @@ package openacta
 
 import (
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
+// Lex and parse a single statement, returning the parser for inspection
+func parse_statement(statement string) (*Parser, error) {
+	tokens, error := lexer(statement)
+	if error != nil {
+		return nil, error
+	}
+
+	var parser Parser
+	parser.query = statement
+	parser.tokens = tokens
+	parser.num_tokens = len(tokens)
+	return &parser, parser.parser()
+}
+
 func TestParser(t *testing.T) {
 
 	for i := range statements {
@@ -46,4 +66,1786 @@ func TestParser(t *testing.T) {
 	}
 }
 
+func TestOrderBy(t *testing.T) {
+	tests := []struct {
+		statement string
+		keys      []sort_key
+	}{
+		{"FIND src_ip SINCE YESTERDAY ORDER BY src_ip",
+			[]sort_key{{field: "src_ip"}}},
+		{"FIND src_ip SINCE YESTERDAY ORDER BY src_ip DESC",
+			[]sort_key{{field: "src_ip", desc: true}}},
+		{"FIND src_ip,dest_ip SINCE YESTERDAY ORDER BY src_ip ASC, dest_ip DESC",
+			[]sort_key{{field: "src_ip"}, {field: "dest_ip", desc: true}}},
+		{"FIND src_ip,dest_ip SINCE YESTERDAY | SORT src_ip ASC, dest_ip DESC",
+			[]sort_key{{field: "src_ip"}, {field: "dest_ip", desc: true}}},
+	}
+
+	for _, test := range tests {
+		parser, error := parse_statement(test.statement)
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+		if !reflect.DeepEqual(parser.sort_keys, test.keys) {
+			t.Errorf("%s: sort keys %v, expected %v", test.statement, parser.sort_keys, test.keys)
+		}
+	}
+
+	// Mixing the two forms is an error
+	if _, error := parse_statement("FIND src_ip SINCE YESTERDAY ORDER BY src_ip | SORT src_ip"); error == nil {
+		t.Errorf("expected error combining ORDER BY and SORT")
+	}
+}
+
+func TestSortNulls(t *testing.T) {
+	tests := []struct {
+		statement string
+		keys      []SortKey
+	}{
+		{"FIND ALL SINCE YESTERDAY | SORT user NULLS FIRST",
+			[]SortKey{{Field: "user", NullsFirst: true}}},
+		{"FIND ALL SINCE YESTERDAY | SORT user ASC NULLS LAST, bytes DESC nulls first",
+			[]SortKey{{Field: "user"}, {Field: "bytes", Descending: true, NullsFirst: true}}},
+		{"FIND ALL SINCE YESTERDAY ORDER BY user COLLATE nocase DESC NULLS LAST",
+			[]SortKey{{Field: "user", Descending: true, Collation: "nocase"}}},
+		{"FIND ALL SINCE YESTERDAY | SORT name COLLATE 'de_DE' | LIMIT 10",
+			[]SortKey{{Field: "name", Collation: "de_DE"}}},
+		{"FIND ALL SINCE YESTERDAY | SORT nulls, first", // just fields
+			[]SortKey{{Field: "nulls"}, {Field: "first"}}},
+	}
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+			continue
+		}
+		if !reflect.DeepEqual(query.Sort, test.keys) {
+			t.Errorf("%s: sort keys %+v, expected %+v", test.statement, query.Sort, test.keys)
+		}
+	}
+
+	errors := []struct {
+		statement string
+		expected  string
+	}{
+		{"FIND ALL SINCE YESTERDAY | SORT user NULLS", "expected FIRST or LAST after NULLS"},
+		{"FIND ALL SINCE YESTERDAY | SORT user NULLS DESC", "expected FIRST or LAST after NULLS at 'DESC'"},
+		{"FIND ALL SINCE YESTERDAY | SORT user COLLATE 42", "expected collation name after COLLATE at '42'"},
+		{"FIND ALL SINCE YESTERDAY | SORT user NULLS LAST DESC", "unexpected trailing input at 'DESC'"},
+	}
+	for _, test := range errors {
+		if _, error := Parse(test.statement); error == nil || !strings.Contains(error.Error(), test.expected) {
+			t.Errorf("%s: error %v, expected %s", test.statement, error, test.expected)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	parser, error := parse_statement("FIND src_ip BETWEEN '2020-05-04' AND '2022-10-09'")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if len(parser.Warnings()) != 2 {
+		t.Errorf("expected a warning for each date-only bound, got %v", parser.Warnings())
+	}
+
+	parser, error = parse_statement("FIND src_ip BETWEEN '2020-05-04 00:00:00' AND '2022-10-09 23:59:59'")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if len(parser.Warnings()) != 0 {
+		t.Errorf("expected no warnings for full timestamps, got %v", parser.Warnings())
+	}
+}
+
+func TestSpecialFieldNames(t *testing.T) {
+	parser, error := parse_statement("FIND @timestamp, $meta MATCHING user.name='arjen' AND $meta='x' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if !reflect.DeepEqual(parser.fields, []string{"@timestamp", "$meta"}) {
+		t.Errorf("unexpected fields %v", parser.fields)
+	}
+	if len(parser.or_list) != 1 || *parser.or_list[0].left.lexer_val != "user.name" {
+		t.Fatalf("expected MATCHING on user.name")
+	}
+	if len(parser.or_list[0].and_list) != 1 || *parser.or_list[0].and_list[0].left.lexer_val != "$meta" {
+		t.Errorf("expected AND on $meta")
+	}
+}
+
+func TestFieldAlias(t *testing.T) {
+	parser, error := parse_statement("FIND src_ip AS source, dest_ip AS dst, proto SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if !reflect.DeepEqual(parser.fields, []string{"src_ip", "dest_ip", "proto"}) {
+		t.Errorf("unexpected fields %v", parser.fields)
+	}
+	if !reflect.DeepEqual(parser.field_aliases, []string{"source", "dst", "proto"}) {
+		t.Errorf("unexpected aliases %v", parser.field_aliases)
+	}
+}
+
+func TestSinceUntil(t *testing.T) {
+	before := time.Now().UnixNano()
+
+	parser, error := parse_statement("FIND src_ip SINCE LAST WEEK")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if parser.time_to < before {
+		t.Errorf("SINCE without UNTIL should end now, got %s", time.Unix(0, parser.time_to).UTC())
+	}
+
+	parser, error = parse_statement("FIND src_ip SINCE LAST WEEK UNTIL YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	yesterday := before - before%temp_day - temp_second // just before midnight
+	if parser.time_to != yesterday {
+		t.Errorf("UNTIL YESTERDAY ends at %s, expected %s",
+			time.Unix(0, parser.time_to).UTC(), time.Unix(0, yesterday).UTC())
+	}
+	if parser.time_from >= parser.time_to {
+		t.Errorf("SINCE LAST WEEK should start before UNTIL YESTERDAY")
+	}
+
+	if _, error := parse_statement("FIND src_ip SINCE LAST WEEK UNTIL"); error == nil {
+		t.Errorf("expected error for UNTIL without temporal reference")
+	}
+}
+
+func TestEpochLiteral(t *testing.T) {
+	const new_year_2021 = 1609459200 * temp_second
+
+	tests := []string{
+		"FIND src_ip SINCE 1609459200",          // seconds
+		"FIND src_ip SINCE 1609459200000",       // milliseconds
+		"FIND src_ip SINCE 1609459200000000",    // microseconds
+		"FIND src_ip SINCE 1609459200000000000", // nanoseconds
+	}
+
+	for _, test := range tests {
+		parser, error := parse_statement(test)
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+		if parser.time_from != new_year_2021 {
+			t.Errorf("%s: starts at %s, expected %s", test,
+				time.Unix(0, parser.time_from).UTC(), time.Unix(0, new_year_2021).UTC())
+		}
+	}
+
+	// With a unit following, it's still a count
+	parser, error := parse_statement("FIND src_ip BETWEEN 1609459200 AND 2 DAYS AGO")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if parser.time_from != new_year_2021 || parser.time_to < parser.time_from+temp_year {
+		t.Errorf("unexpected range %s - %s",
+			time.Unix(0, parser.time_from).UTC(), time.Unix(0, parser.time_to).UTC())
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		statement  string
+		conditions [][]string // fields per AND group
+	}{
+		{"FIND x MATCHING a=1 OR b=2 AND c=3 OR d=4 SINCE YESTERDAY",
+			[][]string{{"a"}, {"b", "c"}, {"d"}}},
+		{"FIND x MATCHING a=1 AND b=2 OR c=3 OR d=4 AND e=5 AND f=6 SINCE YESTERDAY",
+			[][]string{{"a", "b"}, {"c"}, {"d", "e", "f"}}},
+		{"FIND x MATCHING a=1 OR b=2 AND c=3 OR d=4 AND e=5 OR f=6 SINCE YESTERDAY",
+			[][]string{{"a"}, {"b", "c"}, {"d", "e"}, {"f"}}},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+
+		var conditions [][]string
+		for _, group := range query.Conditions {
+			var fields []string
+			for _, predicate := range group {
+				fields = append(fields, predicate.Field)
+			}
+			conditions = append(conditions, fields)
+		}
+		if !reflect.DeepEqual(conditions, test.conditions) {
+			t.Errorf("%s: grouped as %v, expected %v", test.statement, conditions, test.conditions)
+		}
+	}
+}
+
+func TestGroupAggregates(t *testing.T) {
+	query, error := Parse("FIND src_ip, COUNT(*) SINCE YESTERDAY | GROUP src_ip")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if !reflect.DeepEqual(query.Aggregates, []Aggregate{{Function: "COUNT", Field: "*", Alias: "count_star", GeneratedAlias: true}}) {
+		t.Errorf("unexpected aggregates %v", query.Aggregates)
+	}
+
+	_, error = Parse("FIND src_ip, dest_ip, COUNT(*) SINCE YESTERDAY | GROUP src_ip")
+	if error == nil || !strings.Contains(error.Error(), "dest_ip must appear in GROUP") {
+		t.Errorf("expected error for ungrouped field, got %v", error)
+	}
+}
+
+func TestAggregateDistinct(t *testing.T) {
+	tests := []struct {
+		statement string
+		expected  Aggregate
+		warning   bool
+	}{
+		{"FIND COUNT(DISTINCT src_ip) AS sources SINCE LAST DAY", Aggregate{Function: "COUNT", Field: "src_ip", Alias: "sources", Distinct: true}, false},
+		{"FIND SUM(DISTINCT bytes) SINCE LAST DAY", Aggregate{Function: "SUM", Field: "bytes", Alias: "sum_distinct_bytes", Distinct: true, GeneratedAlias: true}, false},
+		{"FIND COUNT(src_ip) SINCE LAST DAY", Aggregate{Function: "COUNT", Field: "src_ip", Alias: "count_src_ip", GeneratedAlias: true}, false},
+		{"FIND MAX(DISTINCT bytes) SINCE LAST DAY", Aggregate{Function: "MAX", Field: "bytes", Alias: "max_distinct_bytes", Distinct: true, GeneratedAlias: true}, true},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+		if !reflect.DeepEqual(query.Aggregates, []Aggregate{test.expected}) {
+			t.Errorf("%s: aggregates %v, expected %v", test.statement, query.Aggregates, test.expected)
+		}
+		if warned := len(query.Warnings()) > 0; warned != test.warning {
+			t.Errorf("%s: warnings %v, expected a warning %v", test.statement, query.Warnings(), test.warning)
+		}
+	}
+
+	if _, error := Parse("FIND COUNT(DISTINCT *) SINCE LAST DAY"); error == nil {
+		t.Errorf("COUNT(DISTINCT *) accepted")
+	}
+}
+
+func TestHaving(t *testing.T) {
+	query, error := Parse("FIND src_ip, COUNT(*) AS n SINCE LAST DAY | GROUP src_ip HAVING n > 100 OR src_ip='10.0.0.1' | SORT n DESC")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	expected := [][]Predicate{
+		{{Field: "n", Op: OpGreater, Value: "100"}},
+		{{Field: "src_ip", Op: OpEqual, Value: "10.0.0.1", Kind: ValueString, Typed: netip.MustParseAddr("10.0.0.1")}},
+	}
+	if !reflect.DeepEqual(query.Having, expected) {
+		t.Errorf("having %v, expected %v", query.Having, expected)
+	}
+	if len(query.Sort) != 1 {
+		t.Errorf("SORT after HAVING not parsed: %v", query.Sort)
+	}
+
+	_, error = Parse("FIND src_ip, COUNT(*) AS n SINCE LAST DAY | GROUP src_ip HAVING dest_ip > 100")
+	if error == nil || !strings.Contains(error.Error(), "not dest_ip") {
+		t.Errorf("expected error for ungrouped field in HAVING, got %v", error)
+	}
+}
+
+func TestExclusiveRange(t *testing.T) {
+	tests := []struct {
+		statement string
+		exclusive bool
+	}{
+		{"FIND src_ip BETWEEN '2024-01-01 00:00:00' AND '2024-01-02 00:00:00'", false},
+		{"FIND src_ip BETWEEN '2024-01-01 00:00:00' AND '2024-01-02 00:00:00' EXCLUSIVE", true},
+		{"FIND src_ip SINCE '2024-01-01 00:00:00' UNTIL '2024-01-02 00:00:00' EXCLUSIVE", true},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+		if query.TimeToExclusive != test.exclusive {
+			t.Errorf("%s: exclusive %v, expected %v", test.statement, query.TimeToExclusive, test.exclusive)
+		}
+		if end := time.Unix(0, query.TimeTo).UTC().Format(time.DateTime); end != "2024-01-02 00:00:00" {
+			t.Errorf("%s: end %s", test.statement, end)
+		}
+	}
+
+	// A relative end is the last second of what it refers to, or with EXCLUSIVE where it starts
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00") // a Wednesday
+	relative := []struct {
+		statement string
+		end       string
+	}{
+		{"FIND src_ip BETWEEN LAST WEEK AND YESTERDAY", "2024-05-14 23:59:59"},
+		{"FIND src_ip BETWEEN LAST WEEK AND YESTERDAY EXCLUSIVE", "2024-05-14 00:00:00"},
+		{"FIND src_ip SINCE LAST WEEK UNTIL NEXT FRIDAY EXCLUSIVE", "2024-05-17 00:00:00"},
+		{"FIND src_ip SINCE LAST WEEK UNTIL FOREVER EXCLUSIVE", "2262-04-11 23:47:16"},
+	}
+	for _, test := range relative {
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.statement, error)
+		}
+		if end := time.Unix(0, query.TimeTo).UTC().Format(time.DateTime); end != test.end {
+			t.Errorf("%s: end %s, expected %s", test.statement, end, test.end)
+		}
+		if exclusive := strings.HasSuffix(test.statement, "EXCLUSIVE"); query.TimeToExclusive != exclusive {
+			t.Errorf("%s: exclusive %v", test.statement, query.TimeToExclusive)
+		}
+	}
+
+	if _, error := Parse("FIND src_ip SINCE YESTERDAY EXCLUSIVE"); error == nil {
+		t.Errorf("EXCLUSIVE without an explicit end accepted")
+	}
+
+	query, error := Parse("FIND src_ip MATCHING dest_port BETWEEN 1024 AND 2048 EXCLUSIVE AND proto='tcp' OR dest_port BETWEEN 1 AND 10 SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	expected := [][]Predicate{
+		{{Field: "dest_port", Op: OpBetween, Value: "1024", High: "2048", Exclusive: true}, {Field: "proto", Op: OpEqual, Value: "tcp", Kind: ValueString}},
+		{{Field: "dest_port", Op: OpBetween, Value: "1", High: "10"}},
+	}
+	if !reflect.DeepEqual(query.Conditions, expected) {
+		t.Errorf("conditions %v, expected %v", query.Conditions, expected)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	query, error := Parse("FIND src_ip AS 'Source IP', dest_ip AS dst, COUNT(*) AS \"Hit count\" SINCE YESTERDAY | GROUP src_ip, dest_ip")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if expected := []string{"Source IP", "dst"}; !reflect.DeepEqual(query.Aliases, expected) {
+		t.Errorf("aliases %q, expected %q", query.Aliases, expected)
+	}
+	if alias := query.Aggregates[0].Alias; alias != "Hit count" {
+		t.Errorf("aggregate alias %q, expected \"Hit count\"", alias)
+	}
+
+	for _, statement := range []string{
+		"FIND src_ip AS 42 SINCE YESTERDAY",
+		"FIND src_ip AS = SINCE YESTERDAY",
+		"FIND COUNT(*) AS 1.5 SINCE YESTERDAY",
+		"FIND src_ip AS '' SINCE YESTERDAY",
+	} {
+		if _, error := Parse(statement); error == nil || !strings.Contains(error.Error(), "alias") {
+			t.Errorf("%s: expected alias error, got %v", statement, error)
+		}
+	}
+}
+
+func TestContradictions(t *testing.T) {
+	tests := []struct {
+		statement string
+		warning   bool
+	}{
+		{"FIND src_ip MATCHING dest_port=80 AND dest_port=443 SINCE YESTERDAY", true},
+		{"FIND src_ip MATCHING proto='tcp' OR dest_port=80 AND src_ip='10.0.0.1' AND dest_port=443 SINCE YESTERDAY", true},
+		{"FIND src_ip MATCHING dest_port=80 OR dest_port=443 SINCE YESTERDAY", false},
+		{"FIND src_ip MATCHING dest_port=80 AND dest_port=80 SINCE YESTERDAY", false},
+		{"FIND src_ip MATCHING dest_port=80 AND dest_port!=443 SINCE YESTERDAY", false},
+		{"FIND src_ip MATCHING user EQUALS-IGNORE-CASE 'admin' AND user='ADMIN' SINCE YESTERDAY", false},
+		{"FIND src_ip MATCHING user EQUALS-IGNORE-CASE 'admin' AND user='root' SINCE YESTERDAY", true},
+		{"FIND src_ip MATCHING p=80 AND p=080 SINCE YESTERDAY", false},
+		{"FIND src_ip MATCHING p=80 AND p=80.0 AND p=8e1 SINCE YESTERDAY", false},
+		{"FIND src_ip MATCHING p=80 AND p=80.5 SINCE YESTERDAY", true},
+		{"FIND src_ip MATCHING seen=1 HOUR AGO AND seen=2 HOURS AGO SINCE YESTERDAY", true},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+		if warned := len(query.Warnings()) > 0; warned != test.warning {
+			t.Errorf("%s: warnings %v, expected a warning %v", test.statement, query.Warnings(), test.warning)
+		}
+	}
+
+	// Fields from different sources aren't the same field
+	if query, _ := Parse("FIND src_ip MATCHING netflow:a=1 AND dns:a=2 SINCE YESTERDAY"); len(query.Warnings()) != 0 {
+		t.Errorf("warnings %v for different sources", query.Warnings())
+	}
+	query, _ := Parse("FIND src_ip MATCHING netflow:a=1 AND netflow:a=2 SINCE YESTERDAY")
+	if warnings := query.Warnings(); !reflect.DeepEqual(warnings, []string{"netflow:a=1 AND netflow:a=2 can never match"}) {
+		t.Errorf("warnings %v", warnings)
+	}
+
+	// With CaseInsensitiveStrings, x and X are the same value, even when warnings are errors
+	options := DefaultOptions()
+	options.CaseInsensitiveStrings = true
+	options.WarningsAsErrors = true
+	if _, error := ParseWithOptions("FIND src_ip MATCHING a='x' AND a='X' SINCE YESTERDAY", options); error != nil {
+		t.Errorf("with CaseInsensitiveStrings: %s", error)
+	}
+}
+
+func TestComputedConditions(t *testing.T) {
+	tests := []struct {
+		condition string
+		expr      *Expr
+		op        Operator
+		value     string
+	}{
+		{"dest_port MOD 2 = 0", &Expr{Op: OpModulo, Left: &Expr{Field: "dest_port"}, Right: &Expr{Value: "2"}}, OpEqual, "0"},
+		{"dest_port % 2 = 0", &Expr{Op: OpModulo, Left: &Expr{Field: "dest_port"}, Right: &Expr{Value: "2"}}, OpEqual, "0"},
+		{"bytes / 1024 > 1", &Expr{Op: OpDivide, Left: &Expr{Field: "bytes"}, Right: &Expr{Value: "1024"}}, OpGreater, "1"},
+		// * binds tighter than +, parentheses override
+		{"a + b * 2 >= 10", &Expr{Op: OpAdd, Left: &Expr{Field: "a"}, Right: &Expr{Op: OpMultiply, Left: &Expr{Field: "b"}, Right: &Expr{Value: "2"}}}, OpGreaterEqual, "10"},
+		{"(a + b) * 2 >= 10", &Expr{Op: OpMultiply, Left: &Expr{Op: OpAdd, Left: &Expr{Field: "a"}, Right: &Expr{Field: "b"}}, Right: &Expr{Value: "2"}}, OpGreaterEqual, "10"},
+	}
+
+	for _, test := range tests {
+		query, error := Parse("FIND x MATCHING " + test.condition + " SINCE YESTERDAY")
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+		expected := Predicate{Expr: test.expr, Op: test.op, Value: test.value}
+		if predicate := query.Conditions[0][0]; !reflect.DeepEqual(predicate, expected) {
+			t.Errorf("%s: predicate %+v, expected %+v", test.condition, predicate, expected)
+		}
+	}
+
+	for _, condition := range []string{"dest_port MOD = 0", "(a + b = 1", "bytes /"} {
+		if _, error := Parse("FIND x MATCHING " + condition + " SINCE YESTERDAY"); error == nil {
+			t.Errorf("%s: accepted", condition)
+		}
+	}
+}
+
+func TestErrorUnderline(t *testing.T) {
+	tests := []struct {
+		statement string
+		underline string
+	}{
+		{"FIND src_ip MATCHING dest_port=443 BETWEN YESTERDAY",
+			"FIND src_ip MATCHING dest_port=443 BETWEN YESTERDAY\n                                   ^^^^^^"},
+		{"FIND src_ip\n\tMATCHING dest_port=443\n\tSORTED src_ip",
+			"\tSORTED src_ip\n\t^^^^^^"},
+		{"FIND src_ip MATCHING",
+			"FIND src_ip MATCHING\n                    ^"},
+	}
+
+	for _, test := range tests {
+		_, error := Parse(test.statement)
+		if error == nil {
+			t.Fatalf("%s: accepted", test.statement)
+		}
+		if !strings.HasSuffix(error.Error(), "\n"+test.underline) {
+			t.Errorf("%q: error %q, expected underline %q", test.statement, error, test.underline)
+		}
+	}
+}
+
+func TestAggregateAliases(t *testing.T) {
+	query, error := Parse("FIND src_ip, COUNT(*), SUM(bytes) AS total, AVG(user.age) SINCE YESTERDAY | GROUP src_ip HAVING count_star > 10")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	expected := []Aggregate{
+		{Function: "COUNT", Field: "*", Alias: "count_star", GeneratedAlias: true},
+		{Function: "SUM", Field: "bytes", Alias: "total"},
+		{Function: "AVG", Field: "user.age", Alias: "avg_user_age", GeneratedAlias: true},
+	}
+	if !reflect.DeepEqual(query.Aggregates, expected) {
+		t.Errorf("aggregates %+v, expected %+v", query.Aggregates, expected)
+	}
+
+	_, error = Parse("FIND SUM(bytes), SUM(bytes) SINCE YESTERDAY")
+	if error == nil || !strings.Contains(error.Error(), "duplicate aggregate alias sum_bytes") {
+		t.Errorf("expected duplicate alias error, got %v", error)
+	}
+	if _, error = Parse("FIND SUM(bytes), SUM(bytes) AS total SINCE YESTERDAY"); error != nil {
+		t.Errorf("Parser error: %s", error)
+	}
+}
+
+func TestUnaryMinus(t *testing.T) {
+	a, b := &Expr{Field: "a"}, &Expr{Field: "b"}
+
+	tests := []struct {
+		condition string
+		expr      *Expr
+	}{
+		{"-a > 0", &Expr{Op: OpNegate, Left: a}},
+		{"- -a > 0", &Expr{Op: OpNegate, Left: &Expr{Op: OpNegate, Left: a}}},
+		{"-a + b > 0", &Expr{Op: OpAdd, Left: &Expr{Op: OpNegate, Left: a}, Right: b}},
+		{"a - -b > 0", &Expr{Op: OpSubtract, Left: a, Right: &Expr{Op: OpNegate, Left: b}}},
+		{"a - b > 0", &Expr{Op: OpSubtract, Left: a, Right: b}},
+		{"-a * b > 0", &Expr{Op: OpMultiply, Left: &Expr{Op: OpNegate, Left: a}, Right: b}},
+		{"-(a - b) > 0", &Expr{Op: OpNegate, Left: &Expr{Op: OpSubtract, Left: a, Right: b}}},
+		{"a -5 > 0", &Expr{Op: OpSubtract, Left: a, Right: &Expr{Value: "5"}}},
+		{"a - -5 > 0", &Expr{Op: OpSubtract, Left: a, Right: &Expr{Value: "-5"}}},
+		{"+a - b > 0", &Expr{Op: OpSubtract, Left: a, Right: b}},
+	}
+
+	for _, test := range tests {
+		query, error := Parse("FIND x MATCHING " + test.condition + " SINCE YESTERDAY")
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.condition, error)
+		}
+		if expr := query.Conditions[0][0].Expr; !reflect.DeepEqual(expr, test.expr) {
+			t.Errorf("%s: expression %+v, expected %+v", test.condition, expr, test.expr)
+		}
+	}
+
+	if _, error := Parse("FIND x MATCHING a - > 0 SINCE YESTERDAY"); error == nil {
+		t.Errorf("dangling minus accepted")
+	}
+}
+
+func TestBeforeLast(t *testing.T) {
+	tests := []struct {
+		temporal string
+		from     string
+	}{
+		{"SINCE MONTH BEFORE LAST", "2024-03-15"},
+		{"SINCE 1 MONTH BEFORE LAST", "2024-03-15"},
+		{"SINCE 2 MONTHS BEFORE LAST", "2024-02-15"},
+		{"SINCE 3 WEEKS BEFORE LAST", "2024-04-17"},
+		{"SINCE PREVIOUS 3 WEEKS", "2024-04-24"},
+		{"SINCE 3 WEEKS AGO", "2024-04-24"},
+		{"SINCE PREVIOUS WEEK", "2024-05-08"},
+		{"SINCE LAST WEEK", "2024-05-08"},
+	}
+
+	for _, test := range tests {
+		options := DefaultOptions()
+		options.Now = pinned_clock("2024-05-15 12:00:00")
+
+		query, error := ParseWithOptions("FIND src_ip "+test.temporal, options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.temporal, error)
+		}
+		if from := time.Unix(0, query.TimeFrom).UTC().Format(time.DateOnly); from != test.from {
+			t.Errorf("%s: starts %s, expected %s", test.temporal, from, test.from)
+		}
+	}
+
+	for _, statement := range []string{"FIND src_ip SINCE PREVIOUS", "FIND src_ip SINCE PREVIOUS 3", "FIND src_ip SINCE PREVIOUS 3 AGO"} {
+		if _, error := Parse(statement); error == nil {
+			t.Errorf("%s: accepted", statement)
+		}
+	}
+}
+
+func TestDistinctStage(t *testing.T) {
+	tests := []struct {
+		statement string
+		fields    []string
+		row       bool
+	}{
+		{"FIND src_ip, dest_ip SINCE YESTERDAY | DISTINCT", nil, true},
+		{"FIND src_ip, dest_ip SINCE YESTERDAY | DISTINCT | SORT src_ip", nil, true},
+		{"FIND src_ip, dest_ip SINCE YESTERDAY | DISTINCT src_ip", []string{"src_ip"}, false},
+		{"FIND src_ip, dest_ip SINCE YESTERDAY | DISTINCT src_ip, dest_ip", []string{"src_ip", "dest_ip"}, false},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.statement, error)
+		}
+		if !reflect.DeepEqual(query.Distinct, test.fields) || query.DistinctRow != test.row {
+			t.Errorf("%s: distinct %v row %v, expected %v row %v", test.statement, query.Distinct, query.DistinctRow, test.fields, test.row)
+		}
+	}
+}
+
+func TestTrailingInput(t *testing.T) {
+	tests := []struct {
+		statement string
+		ok        bool
+	}{
+		{"FIND src_ip SINCE YESTERDAY", true},
+		{"FIND src_ip SINCE YESTERDAY | SORT src_ip", true},
+		{"FIND src_ip SINCE YESTERDAY garbage", false},
+		{"FIND src_ip MATCHING dest_port=443 SINCE YESTERDAY 443", false},
+		{"FIND src_ip SINCE YESTERDAY ORDER BY src_ip DESC src_ip", false},
+		{"FIND src_ip SINCE YESTERDAY | SORT src_ip garbage", false},
+	}
+
+	for _, test := range tests {
+		_, error := Parse(test.statement)
+		if test.ok && error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+		}
+		if !test.ok {
+			if error == nil {
+				t.Errorf("%s: expected an error", test.statement)
+			} else if !strings.Contains(error.Error(), "unexpected trailing input") {
+				t.Errorf("%s: unexpected error: %s", test.statement, error)
+			}
+		}
+	}
+}
+
+func TestEmptyStage(t *testing.T) {
+	for _, statement := range []string{
+		"FIND ALL SINCE YESTERDAY |",
+		"FIND ALL SINCE YESTERDAY | SORT src_ip |",
+		"FIND ALL SINCE YESTERDAY | SORT src_ip | | LIMIT 10",
+		"FIND ALL SINCE YESTERDAY || LIMIT 10",
+		"FIND ALL SINCE YESTERDAY | SORT src_ip || LIMIT 10",
+	} {
+		if _, error := Parse(statement); error == nil || !strings.Contains(error.Error(), "empty pipe stage") {
+			t.Errorf("%s: error %v, expected empty pipe stage", statement, error)
+		}
+	}
+
+	// || in a condition is still OR
+	query, error := Parse("FIND ALL MATCHING dest_port=80 || dest_port=443 SINCE YESTERDAY | SORT src_ip")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if len(query.Conditions) != 2 {
+		t.Errorf("conditions %v, expected two OR groups", query.Conditions)
+	}
+}
+
+func TestIntLiteral(t *testing.T) {
+	tests := []struct {
+		literal  string
+		expected int
+		ok       bool
+	}{
+		{"1000", 1000, true},
+		{"1e3", 1000, true},
+		{"1E3", 1000, true},
+		{"25e0", 25, true},
+		{"0e99", 0, true},
+		{"9e18", 9000000000000000000, true},
+		{"1e19", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+
+	for _, test := range tests {
+		i, error := parse_int(test.literal)
+		if test.ok && (error != nil || i != test.expected) {
+			t.Errorf("%s: %d (error %v), expected %d", test.literal, i, error, test.expected)
+		}
+		if !test.ok && error == nil {
+			t.Errorf("%s: %d, expected an error", test.literal, i)
+		}
+	}
+
+	// E notation counts in relative temporal references
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+	for _, statements := range [][2]string{
+		{"FIND x SINCE 1e3 SECONDS AGO", "FIND x SINCE 1000 SECONDS AGO"},
+		{"FIND x BETWEEN 2E1 DAYS AGO AND 5e0 DAYS AGO", "FIND x BETWEEN 20 DAYS AGO AND 5 DAYS AGO"},
+	} {
+		query, error := ParseWithOptions(statements[0], options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", statements[0], error)
+		}
+		expected, error := ParseWithOptions(statements[1], options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", statements[1], error)
+		}
+		if query.TimeFrom != expected.TimeFrom || query.TimeTo != expected.TimeTo {
+			t.Errorf("%s: %d to %d, expected %d to %d", statements[0], query.TimeFrom, query.TimeTo, expected.TimeFrom, expected.TimeTo)
+		}
+	}
+}
+
+func TestBareUnit(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	accepted := [][2]string{
+		{"FIND x BETWEEN LAST MONTH AND FORTNIGHT AGO", "FIND x BETWEEN LAST MONTH AND 1 FORTNIGHT AGO"},
+		{"FIND x SINCE DAY AGO", "FIND x SINCE 1 DAY AGO"},
+		{"FIND x SINCE WEEK BEFORE LAST", "FIND x SINCE 2 WEEKS AGO"},
+	}
+	for _, statements := range accepted {
+		query, error := ParseWithOptions(statements[0], options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", statements[0], error)
+		}
+		expected, error := ParseWithOptions(statements[1], options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", statements[1], error)
+		}
+		if query.TimeFrom != expected.TimeFrom || query.TimeTo != expected.TimeTo {
+			t.Errorf("%s: %d to %d, expected %d to %d", statements[0], query.TimeFrom, query.TimeTo, expected.TimeFrom, expected.TimeTo)
+		}
+	}
+
+	rejected := []string{
+		"FIND x BETWEEN LAST MONTH AND FORTNIGHT",
+		"FIND x SINCE MONTH",
+		"FIND x SINCE DAY | SORT x",
+		"FIND x SINCE TUESDAY BEFORE YESTERDAY",
+	}
+	for _, statement := range rejected {
+		_, error := ParseWithOptions(statement, options)
+		if error == nil || !strings.Contains(error.Error(), "ambiguous relative time") {
+			t.Errorf("%s: expected ambiguous relative time error, got %v", statement, error)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		statement string
+		format    Format
+		error     string
+	}{
+		{"FIND ALL SINCE LAST HOUR", FormatDefault, ""},
+		{"FIND ALL SINCE LAST HOUR | FORMAT json", FormatJSON, ""},
+		{"FIND ALL SINCE LAST HOUR | FORMAT CSV", FormatCSV, ""},
+		{"FIND src_ip SINCE LAST HOUR | SORT src_ip | FORMAT table", FormatTable, ""},
+		{"FIND ALL SINCE LAST HOUR | FORMAT xml", FormatDefault, "unknown output format xml"},
+		{"FIND ALL SINCE LAST HOUR | FORMAT", FormatDefault, "expected output format"},
+		{"FIND src_ip SINCE LAST HOUR | FORMAT json | SORT src_ip", FormatDefault, "FORMAT has to be the last stage"},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if test.error != "" {
+			if error == nil || !strings.Contains(error.Error(), test.error) {
+				t.Errorf("%s: expected error %q, got %v", test.statement, test.error, error)
+			}
+			continue
+		}
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.statement, error)
+		}
+		if query.Format != test.format {
+			t.Errorf("%s: format %s, expected %s", test.statement, query.Format, test.format)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00") // a Wednesday
+
+	tests := []struct {
+		statement string
+		to        string
+	}{
+		{"FIND x BETWEEN YESTERDAY AND NEXT FRIDAY", "2024-05-17 23:59:59"},
+		{"FIND x BETWEEN YESTERDAY AND NEXT WEDNESDAY", "2024-05-22 23:59:59"},
+		{"FIND x SINCE YESTERDAY UNTIL NEXT MONDAY", "2024-05-20 23:59:59"},
+		{"FIND x BETWEEN YESTERDAY AND NEXT JANUARY", "2025-01-31 23:59:59"},
+		{"FIND x BETWEEN YESTERDAY AND NEXT JUNE", "2024-06-30 23:59:59"},
+		{"FIND x BETWEEN YESTERDAY AND NEXT MAY", "2025-05-31 23:59:59"},
+	}
+
+	for _, test := range tests {
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.statement, error)
+		}
+		if to := time.Unix(0, query.TimeTo).UTC().Format(time.DateTime); to != test.to {
+			t.Errorf("%s: ends %s, expected %s", test.statement, to, test.to)
+		}
+	}
+
+	for _, statement := range []string{"FIND x SINCE NEXT FRIDAY", "FIND x BETWEEN NEXT FRIDAY AND NEXT MAY"} {
+		if _, error := ParseWithOptions(statement, options); error == nil || !strings.Contains(error.Error(), "NEXT can only be the end of a range") {
+			t.Errorf("%s: expected NEXT error, got %v", statement, error)
+		}
+	}
+	if _, error := ParseWithOptions("FIND x BETWEEN YESTERDAY AND NEXT WEEK", options); error == nil || !strings.Contains(error.Error(), "expected weekday or month after NEXT") {
+		t.Errorf("NEXT WEEK: expected error, got %v", error)
+	}
+}
+
+func TestValueErrors(t *testing.T) {
+	options := DefaultOptions()
+	options.FieldTypes = map[string]FieldType{"dest_port": FieldInt, "bytes": FieldFloat, "src_ip": FieldIP, "user": FieldString}
+
+	tests := []struct {
+		statement string
+		error     string
+	}{
+		{"FIND x MATCHING dest_port=443 AND bytes>1.5 AND src_ip='10.0.0.0/8' AND user=42 SINCE YESTERDAY", ""},
+		{"FIND x MATCHING dest_port='443' AND bytes>'1e3' AND dest_port=other_port SINCE YESTERDAY", ""},
+		{"FIND x MATCHING dest_port BETWEEN 1024 AND 2048 SINCE YESTERDAY", ""},
+		{"FIND x MATCHING dest_port=12abc SINCE YESTERDAY", "invalid integer literal '12abc' in comparison on dest_port at 1:27"},
+		{"FIND x MATCHING y=12abc SINCE YESTERDAY", "invalid integer literal '12abc' in comparison on y at 1:19"},
+		{"FIND x\nMATCHING bytes > 1.5.2 SINCE YESTERDAY", "invalid floating point literal '1.5.2' in comparison on bytes at 2:18"},
+		{"FIND x MATCHING bytes MOD 2 = 1.5x SINCE YESTERDAY", "invalid floating point literal '1.5x' in comparison on expression"},
+		{"FIND x MATCHING dest_port='abc' SINCE YESTERDAY", "invalid integer literal 'abc' in comparison on dest_port at 1:27"},
+		{"FIND x MATCHING dest_port=4.5 SINCE YESTERDAY", "invalid integer literal '4.5' in comparison on dest_port"},
+		{"FIND x MATCHING dest_port BETWEEN 1024 AND 'max' SINCE YESTERDAY", "invalid integer literal 'max' in comparison on dest_port"},
+		{"FIND x MATCHING bytes>'lots' SINCE YESTERDAY", "invalid floating point literal 'lots' in comparison on bytes"},
+		{"FIND x MATCHING src_ip='10.0.0.300' SINCE YESTERDAY", "invalid IP address literal '10.0.0.300' in comparison on src_ip"},
+		{"FIND x MATCHING src_ip=10 SINCE YESTERDAY", "invalid IP address literal '10' in comparison on src_ip"},
+	}
+
+	for _, test := range tests {
+		_, error := ParseWithOptions(test.statement, options)
+		if test.error == "" && error != nil {
+			t.Errorf("%s: Parse error: %s", test.statement, error)
+		}
+		if test.error != "" && (error == nil || !strings.Contains(error.Error(), test.error)) {
+			t.Errorf("%s: expected error %q, got %v", test.statement, test.error, error)
+		}
+	}
+
+	// Malformed numbers are caught without FieldTypes too, a sign is subtraction
+	if _, error := Parse("FIND x MATCHING y=12abc SINCE YESTERDAY"); error == nil {
+		t.Errorf("12abc: expected an error")
+	}
+	if _, error := Parse("FIND x MATCHING y -5=12 SINCE YESTERDAY"); error != nil {
+		t.Errorf("y -5=12: Parse error: %s", error)
+	}
+}
+
+func TestParenthesisedFields(t *testing.T) {
+	tests := []struct {
+		statement string
+		fields    []string
+		error     string
+	}{
+		{"FIND (src_ip, dest_ip) SINCE YESTERDAY", []string{"src_ip", "dest_ip"}, ""},
+		{"FIND (src_ip) MATCHING dest_port=443 SINCE YESTERDAY", []string{"src_ip"}, ""},
+		{"FIND (src_ip AS source, COUNT(*) AS n) SINCE YESTERDAY | GROUP src_ip", []string{"src_ip"}, ""},
+		{"FIND (src_ip, dest_ip SINCE YESTERDAY", nil, "expected closing parenthesis"},
+		{"FIND src_ip, dest_ip) SINCE YESTERDAY", nil, "closing parenthesis without opening one"},
+		{"FIND () SINCE YESTERDAY", nil, "unexpected clause"},
+		{"FIND ((src_ip)) SINCE YESTERDAY", nil, "unexpected clause"},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if test.error != "" {
+			if error == nil || !strings.Contains(error.Error(), test.error) {
+				t.Errorf("%s: expected error %q, got %v", test.statement, test.error, error)
+			}
+			continue
+		}
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.statement, error)
+		}
+		if !reflect.DeepEqual(query.Fields, test.fields) {
+			t.Errorf("%s: fields %v, expected %v", test.statement, query.Fields, test.fields)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	tests := []struct {
+		statement string
+		limit     int
+		by        []string
+		error     string
+	}{
+		{"FIND src_ip, dest_ip SINCE YESTERDAY | LIMIT 10", 10, nil, ""},
+		{"FIND src_ip, dest_ip, bytes SINCE YESTERDAY | SORT bytes DESC | LIMIT 5 BY src_ip", 5, []string{"src_ip"}, ""},
+		{"FIND src_ip, dest_ip, bytes SINCE YESTERDAY | LIMIT 5 BY src_ip, dest_ip | FORMAT json", 5, []string{"src_ip", "dest_ip"}, ""},
+		{"FIND ALL SINCE YESTERDAY | LIMIT 5 BY host", 5, []string{"host"}, ""},
+		{"FIND src_ip, COUNT(*) AS n SINCE YESTERDAY | GROUP src_ip | LIMIT 3 BY src_ip", 3, []string{"src_ip"}, ""},
+		{"FIND src_ip, dest_ip SINCE YESTERDAY | LIMIT 5 BY host", 0, nil, "LIMIT BY field host is not selected or grouped"},
+		{"FIND src_ip SINCE YESTERDAY | LIMIT 5 BY src_ip, host", 0, nil, "LIMIT BY field host is not selected or grouped at 'host'"},
+		{"FIND src_ip SINCE YESTERDAY | LIMIT", 0, nil, "expected number of rows after LIMIT"},
+		{"FIND src_ip SINCE YESTERDAY | LIMIT 0", 0, nil, "LIMIT has to be at least 1"},
+		{"FIND src_ip SINCE YESTERDAY | LIMIT 5 | LIMIT 6", 0, nil, "duplicate LIMIT"},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if test.error != "" {
+			if error == nil || !strings.Contains(error.Error(), test.error) {
+				t.Errorf("%s: expected error %q, got %v", test.statement, test.error, error)
+			}
+			continue
+		}
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.statement, error)
+		}
+		if query.Limit != test.limit || !reflect.DeepEqual(query.LimitBy, test.by) {
+			t.Errorf("%s: limit %d by %v, expected %d by %v", test.statement, query.Limit, query.LimitBy, test.limit, test.by)
+		}
+	}
+}
+
+func TestAlwaysEmpty(t *testing.T) {
+	tests := []struct {
+		statement string
+		empty     bool
+	}{
+		{"FIND x MATCHING 1=2 SINCE YESTERDAY", true},
+		{"FIND x MATCHING 1=1 OR a=2 SINCE YESTERDAY", false},
+		{"FIND x MATCHING 1=2 OR a=2 SINCE YESTERDAY", false},
+		{"FIND x MATCHING a=2 AND 1=2 OR 'x'='y' SINCE YESTERDAY", true},
+		{"FIND x MATCHING 1.0=1 SINCE YESTERDAY", false},
+		{"FIND x MATCHING 1e3>=1000 SINCE YESTERDAY", false},
+		{"FIND x MATCHING 3<2 SINCE YESTERDAY", true},
+		{"FIND x MATCHING 'a' EQUALS-IGNORE-CASE 'A' SINCE YESTERDAY", false},
+		{"FIND x MATCHING 'a'='A' SINCE YESTERDAY", true},
+		{"FIND x MATCHING 5 BETWEEN 1 AND 5 SINCE YESTERDAY", false},
+		{"FIND x MATCHING 5 BETWEEN 1 AND 5 EXCLUSIVE SINCE YESTERDAY", true},
+		// only literals on both sides are folded
+		{"FIND x MATCHING 1='1' SINCE YESTERDAY", false},
+		{"FIND x MATCHING 1+1=3 SINCE YESTERDAY", false},
+		{"FIND x MATCHING a=a SINCE YESTERDAY", false},
+		{"FIND x SINCE YESTERDAY", false},
+		{"FIND x, COUNT(*) AS n SINCE YESTERDAY | GROUP x HAVING 1>2", true},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.statement, error)
+		}
+		if query.AlwaysEmpty != test.empty {
+			t.Errorf("%s: always empty %v, expected %v", test.statement, query.AlwaysEmpty, test.empty)
+		}
+	}
+}
+
+func TestAndConditions(t *testing.T) {
+	parser, error := parse_statement("FIND x MATCHING a=1 AND b=2 AND c=3 OR d=4 AND e=5 SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+
+	var groups [][]string
+	for _, or := range parser.or_list {
+		group := []string{*or.left.lexer_val}
+		for _, and := range or.and_list {
+			group = append(group, *and.left.lexer_val)
+		}
+		groups = append(groups, group)
+	}
+	expected := [][]string{{"a", "b", "c"}, {"d", "e"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("groups %v, expected %v", groups, expected)
+	}
+}
+
+func TestAggregateOnly(t *testing.T) {
+	query, error := Parse("FIND COUNT(*), SUM(bytes) SINCE LAST DAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if len(query.Fields) != 0 || len(query.Group) != 0 || len(query.Aggregates) != 2 {
+		t.Errorf("fields %v, group %v, aggregates %v", query.Fields, query.Group, query.Aggregates)
+	}
+
+	for _, statement := range []string{"FIND src_ip, COUNT(*) SINCE LAST DAY", "FIND COUNT(*), src_ip SINCE LAST DAY | SORT src_ip"} {
+		_, error := Parse(statement)
+		if error == nil || !strings.Contains(error.Error(), "field src_ip must appear in GROUP or an aggregate") {
+			t.Errorf("%s: expected GROUP error, got %v", statement, error)
+		}
+	}
+
+	if _, error := Parse("FIND src_ip, COUNT(*) SINCE LAST DAY | GROUP src_ip"); error != nil {
+		t.Errorf("with GROUP: Parser error: %s", error)
+	}
+}
+
+func TestDumpTree(t *testing.T) {
+	query, error := Parse("FIND src_ip, COUNT(*) AS n MATCHING dest_port - 1 = 442 AND (netflow:proto='tcp' OR 'x' BETWEEN a AND b) OR bytes BETWEEN 10 AND 20 EXCLUSIVE SINCE YESTERDAY | GROUP src_ip HAVING n > 5")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+
+	var out strings.Builder
+	query.DumpTree(&out)
+	expected := `MATCHING
+  OR (dest_port - 1) = 442 AND (netflow:proto = 'tcp' OR 'x' BETWEEN a AND b)
+  OR bytes BETWEEN 10 AND 20 EXCLUSIVE
+HAVING
+  OR n > 5
+`
+	if out.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+func TestDumpTreePartial(t *testing.T) {
+	defer func(w io.Writer) { trace = w }(trace)
+	var out strings.Builder
+	trace = &out
+
+	// Fails halfway through the third comparison, which has no upper bound yet:
+	// the tree so far is dumped to trace
+	_, error := parse_statement("FIND x MATCHING a=1 AND b=2 OR c BETWEEN 1 SINCE YESTERDAY")
+	if error == nil || !strings.Contains(error.Error(), "missing AND in BETWEEN") {
+		t.Fatalf("expected an error in BETWEEN, got %v", error)
+	}
+	if !strings.Contains(out.String(), "MATCHING (a = 1 AND b = 2) OR c BETWEEN 1 AND ?\n") {
+		t.Errorf("partial tree not in trace output:\n%s", out.String())
+	}
+
+	// Nothing of the comparison after OR
+	out.Reset()
+	if _, error := parse_statement("FIND x MATCHING a=1 OR , SINCE YESTERDAY"); error == nil {
+		t.Fatalf("expected a syntax error")
+	}
+	if !strings.Contains(out.String(), "MATCHING a = 1 OR ? ? ?\n") {
+		t.Errorf("partial tree not in trace output:\n%s", out.String())
+	}
+
+	// Items that were never filled in
+	tag := "int"
+	one := "1"
+	tree := &cond_node{conjunction: ConjunctionOr, children: []*cond_node{
+		{comparison: &comparison{this: item{op: OpEqual}}},
+		{conjunction: ConjunctionAnd, children: []*cond_node{
+			{comparison: &comparison{left_expr: &expr{op: OpNegate}, right: item{lexer_tag: &tag, lexer_val: &one}}}, nil, {}}},
+		nil,
+	}}
+	if s, expected := tree.String(), "? = ? OR ((-?) ? 1 AND ? AND ?) OR ?"; s != expected {
+		t.Errorf("got %s, expected %s", s, expected)
+	}
+}
+
+func TestSortRandom(t *testing.T) {
+	options := DefaultOptions()
+	options.RandomSeed = 42
+
+	query, error := ParseWithOptions("FIND ALL SINCE LAST HOUR | SORT random | LIMIT 100", options)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if !query.SortRandom || query.RandomSeed != 42 || len(query.Sort) != 0 || query.Limit != 100 {
+		t.Errorf("sort random %v, seed %d, sort %v, limit %d", query.SortRandom, query.RandomSeed, query.Sort, query.Limit)
+	}
+
+	// A field called random
+	query, error = ParseWithOptions("FIND ALL SINCE LAST HOUR | SORT [random] DESC", options)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if query.SortRandom || query.RandomSeed != 0 || !reflect.DeepEqual(query.Sort, []SortKey{{Field: "random", Descending: true}}) {
+		t.Errorf("sort random %v, seed %d, sort %v", query.SortRandom, query.RandomSeed, query.Sort)
+	}
+
+	for _, statement := range []string{
+		"FIND ALL SINCE LAST HOUR | SORT RANDOM, src_ip",
+		"FIND ALL SINCE LAST HOUR | SORT src_ip, RANDOM",
+		"FIND ALL SINCE LAST HOUR | SORT RANDOM DESC",
+	} {
+		if _, error := Parse(statement); error == nil {
+			t.Errorf("%s: expected an error", statement)
+		}
+	}
+}
+
+func TestChainedComparison(t *testing.T) {
+	tests := []struct {
+		statement string
+		expected  [][]string
+	}{
+		{"FIND ALL MATCHING 1024 < dest_port < 2048 SINCE YESTERDAY", [][]string{{"dest_port>1024", "dest_port<2048"}}},
+		{"FIND ALL MATCHING proto='tcp' AND 2048 >= dest_port >= 1024 OR a=1 SINCE YESTERDAY", [][]string{{"proto=tcp", "dest_port<=2048", "dest_port>=1024"}, {"a=1"}}},
+		{"FIND ALL MATCHING 1 <= x < 10 AND y=2 SINCE YESTERDAY", [][]string{{"x>=1", "x<10", "y=2"}}},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Errorf("%s: Parse error: %s", test.statement, error)
+			continue
+		}
+		var groups [][]string
+		for _, group := range query.Conditions {
+			var list []string
+			for _, predicate := range group {
+				list = append(list, predicate.Field+predicate.Op.String()+predicate.Value)
+			}
+			groups = append(groups, list)
+		}
+		if !reflect.DeepEqual(groups, test.expected) {
+			t.Errorf("%s: conditions %v, expected %v", test.statement, groups, test.expected)
+		}
+	}
+
+	for _, statement := range []string{
+		"FIND ALL MATCHING 1024 < dest_port > 80 SINCE YESTERDAY", // ambiguous
+		"FIND ALL MATCHING 1024 < dest_port = 2048 SINCE YESTERDAY",
+		"FIND ALL MATCHING a < b < 2048 SINCE YESTERDAY", // field on the outside
+		"FIND ALL MATCHING 1 < 2 < 3 SINCE YESTERDAY",    // no field in the middle
+		"FIND ALL MATCHING 1 < a < b SINCE YESTERDAY",
+		"FIND ALL MATCHING 1 < a < 5 < 9 SINCE YESTERDAY",
+	} {
+		if _, error := Parse(statement); error == nil {
+			t.Errorf("%s: expected an error", statement)
+		}
+	}
+}
+
+func TestTimeBucket(t *testing.T) {
+	tests := []struct {
+		statement string
+		bucket    time.Duration
+		group     []string
+	}{
+		{"FIND COUNT(*) SINCE LAST DAY | GROUP time(1h)", time.Hour, nil},
+		{"FIND src_ip, SUM(bytes) SINCE LAST WEEK | GROUP src_ip, TIME(15m) HAVING sum_bytes > 0", 15 * time.Minute, []string{"src_ip"}},
+		{"FIND COUNT(*) SINCE LAST MONTH | GROUP time(168h)", 7 * 24 * time.Hour, nil},
+		{"FIND [time], COUNT(*) SINCE LAST DAY | GROUP [time]", 0, []string{"time"}},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Errorf("%s: Parse error: %s", test.statement, error)
+			continue
+		}
+		if query.TimeBucket != int64(test.bucket) || !reflect.DeepEqual(query.Group, test.group) {
+			t.Errorf("%s: time bucket %v, group %v", test.statement, time.Duration(query.TimeBucket), query.Group)
+		}
+	}
+
+	for _, statement := range []string{
+		"FIND COUNT(*) SINCE LAST DAY | GROUP time(7m)",  // doesn't fit a day
+		"FIND COUNT(*) SINCE LAST DAY | GROUP time(36h)", // not whole days
+		"FIND COUNT(*) SINCE LAST DAY | GROUP time(0s)",
+		"FIND COUNT(*) SINCE LAST DAY | GROUP time(60)",
+		"FIND COUNT(*) SINCE LAST DAY | GROUP time(1h",
+		"FIND COUNT(*) SINCE LAST DAY | GROUP time(1h), time(1m)",
+	} {
+		if _, error := Parse(statement); error == nil {
+			t.Errorf("%s: expected an error", statement)
+		}
+	}
+}
+
+func TestFindDistinct(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	prefix, error := ParseWithOptions("FIND DISTINCT src_ip, dest_ip SINCE YESTERDAY", options)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	stage, error := ParseWithOptions("FIND src_ip, dest_ip SINCE YESTERDAY | DISTINCT", options)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if !prefix.DistinctRow || !reflect.DeepEqual(prefix.Fields, []string{"src_ip", "dest_ip"}) || !prefix.Equal(stage) {
+		t.Errorf("FIND DISTINCT gives distinct row %v, fields %v", prefix.DistinctRow, prefix.Fields)
+	}
+
+	if query, error := Parse("find distinct ALL since yesterday"); error != nil || !query.All || !query.DistinctRow {
+		t.Errorf("FIND DISTINCT ALL: %v", error)
+	}
+
+	for _, statement := range []string{
+		"FIND DISTINCT src_ip SINCE YESTERDAY | DISTINCT",
+		"FIND DISTINCT src_ip SINCE YESTERDAY | DISTINCT src_ip",
+		"FIND DISTINCT SINCE YESTERDAY",
+	} {
+		if _, error := Parse(statement); error == nil {
+			t.Errorf("%s: expected an error", statement)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	// Cut off where the parser looks ahead, these have to be errors rather than a panic
+	for _, statement := range []string{
+		"FIND ALL SINCE LAST",
+		"FIND ALL SINCE DAY BEFORE",
+		"FIND ALL SINCE DAY",
+		"FIND ALL SINCE 2 DAYS",
+		"FIND ALL SINCE 3 MONDAYS",
+		"FIND ALL SINCE MONDAY BEFORE",
+		"FIND ALL SINCE PREVIOUS",
+		"FIND ALL SINCE PREVIOUS 2",
+		"FIND ALL SINCE YESTERDAY UNTIL",
+		"FIND ALL SINCE LAST WEEK UNTIL NEXT",
+		"FIND ALL BETWEEN",
+		"FIND ALL BETWEEN LAST WEEK AND",
+		"FIND count(",
+		"FIND count",
+		"FIND x AS",
+		"FIND SUM(b) AS",
+		"FIND x,",
+	} {
+		if _, error := Parse(statement); error == nil {
+			t.Errorf("%s: expected an error", statement)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	query, error := Parse("FIND ALL MATCHING message CONTAINS 'failed login' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	predicate := query.Conditions[0][0]
+	if predicate.Field != "message" || predicate.Op != OpContains || predicate.Value != "failed login" || predicate.IgnoreCase {
+		t.Errorf("predicate %+v", predicate)
+	}
+
+	options := DefaultOptions()
+	options.CaseInsensitiveStrings = true
+	query, error = ParseWithOptions("FIND ALL MATCHING message contains 'Failed' SINCE YESTERDAY", options)
+	if error != nil || !query.Conditions[0][0].IgnoreCase {
+		t.Errorf("CaseInsensitiveStrings: %v %+v", error, query)
+	}
+
+	// Between literals it's worked out straight away
+	tests := []struct {
+		statement string
+		options   Options
+		empty     bool
+	}{
+		{"FIND ALL MATCHING 'three failed login attempts' CONTAINS 'failed login' SINCE YESTERDAY", DefaultOptions(), false},
+		{"FIND ALL MATCHING 'three failed login attempts' CONTAINS 'Failed Login' SINCE YESTERDAY", DefaultOptions(), true},
+		{"FIND ALL MATCHING 'three failed login attempts' CONTAINS 'Failed Login' SINCE YESTERDAY", options, false},
+		{"FIND ALL MATCHING 'successful login' CONTAINS 'failed' SINCE YESTERDAY", DefaultOptions(), true},
+	}
+	for _, test := range tests {
+		query, error := ParseWithOptions(test.statement, test.options)
+		if error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+			continue
+		}
+		if query.AlwaysEmpty != test.empty {
+			t.Errorf("%s: always empty %v, expected %v", test.statement, query.AlwaysEmpty, test.empty)
+		}
+	}
+
+	if _, error := Parse("FIND ALL MATCHING message CONTAINS 42 SINCE YESTERDAY"); error == nil {
+		t.Errorf("CONTAINS without a string accepted")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	query, error := Parse("FIND ALL MATCHING user_agent =~ '(?i)curl|wget' AND path matches \"^/admin/\" SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	for i, predicate := range query.Conditions[0] {
+		compiled, ok := predicate.Typed.(*regexp.Regexp)
+		if predicate.Op != OpMatches || !ok || compiled.String() != predicate.Value {
+			t.Errorf("predicate %d: %+v", i, predicate)
+		}
+	}
+	if compiled := query.Conditions[0][0].Typed.(*regexp.Regexp); !compiled.MatchString("Curl/8.0") || compiled.MatchString("Mozilla/5.0") {
+		t.Errorf("pattern %s doesn't work as expected", compiled)
+	}
+
+	// Between literals it's worked out straight away
+	if query, _ := Parse("FIND ALL MATCHING 'wget/1.2' =~ 'curl|wget' SINCE YESTERDAY"); query.AlwaysEmpty {
+		t.Errorf("'wget/1.2' =~ 'curl|wget' is always empty")
+	}
+	if query, _ := Parse("FIND ALL MATCHING 'Mozilla' =~ 'curl|wget' SINCE YESTERDAY"); !query.AlwaysEmpty {
+		t.Errorf("'Mozilla' =~ 'curl|wget' isn't always empty")
+	}
+
+	tests := []struct {
+		statement string
+		expected  string
+	}{
+		{"FIND ALL MATCHING user_agent =~ 'curl(' SINCE YESTERDAY", "invalid regular expression: missing closing ): `curl(`, at 1:33"},
+		{"FIND ALL MATCHING user_agent =~ curl SINCE YESTERDAY", "MATCHES needs a regular expression in quotes"},
+		{"FIND ALL MATCHING user_agent =~ '" + strings.Repeat("a", 1025) + "' SINCE YESTERDAY", "regular expression longer than 1024 characters"},
+	}
+	for _, test := range tests {
+		if _, error := Parse(test.statement); error == nil || !strings.Contains(error.Error(), test.expected) {
+			t.Errorf("%.60s: error %v, expected %s", test.statement, error, test.expected)
+		}
+	}
+}
+
+func TestQualifiedFields(t *testing.T) {
+	query, error := Parse("FIND netflow:src_ip, dest_ip MATCHING netflow:dest_port=443 AND [a:b]='x' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if !reflect.DeepEqual(query.Fields, []string{"src_ip", "dest_ip"}) || !reflect.DeepEqual(query.Sources, []string{"netflow", ""}) {
+		t.Errorf("fields %v from sources %q", query.Fields, query.Sources)
+	}
+	if predicate := query.Conditions[0][0]; predicate.Field != "dest_port" || predicate.Source != "netflow" {
+		t.Errorf("qualified condition %+v", predicate)
+	}
+	if predicate := query.Conditions[0][1]; predicate.Field != "a:b" || predicate.Source != "" {
+		t.Errorf("bracketed condition %+v", predicate)
+	}
+
+	// Without any qualified field, there's nothing to say
+	if query, _ := Parse("FIND src_ip MATCHING dest_port=443 SINCE YESTERDAY"); query.Sources != nil {
+		t.Errorf("sources %q for unqualified fields", query.Sources)
+	}
+
+	// Anywhere else the source would be lost
+	tests := []struct {
+		statement string
+		error     string
+	}{
+		{"FIND netflow:src_ip, COUNT(*) SINCE YESTERDAY | GROUP netflow:src_ip", "qualified field netflow:src_ip can't be used in GROUP at 'netflow:src_ip'"},
+		{"FIND ALL SINCE YESTERDAY | SORT bytes, netflow:src_ip DESC", "qualified field netflow:src_ip can't be used to sort on at 'netflow:src_ip DESC'"},
+		{"FIND src_ip SINCE YESTERDAY ORDER BY netflow:src_ip", "qualified field netflow:src_ip can't be used to sort on"},
+		{"FIND COUNT(DISTINCT netflow:src_ip) SINCE YESTERDAY", "qualified field netflow:src_ip can't be used in COUNT() at 'netflow:src_ip) SINCE"},
+		{"FIND src_ip SINCE YESTERDAY | DISTINCT netflow:src_ip", "qualified field netflow:src_ip can't be used in DISTINCT"},
+		{"FIND src_ip SINCE YESTERDAY | LIMIT 5 BY netflow:src_ip", "qualified field netflow:src_ip can't be used in LIMIT BY"},
+		{"FIND ALL MATCHING netflow:bytes / 1024 > 10 SINCE YESTERDAY", "qualified field netflow:bytes can't be used in a computed value at 'netflow:bytes / 1024 > 10"},
+		{"FIND ALL MATCHING src_ip = netflow:dest_ip SINCE YESTERDAY", "qualified field netflow:dest_ip can't be used on the right-hand side at 'netflow:dest_ip SINCE"},
+	}
+	for _, test := range tests {
+		_, error := Parse(test.statement)
+		if error == nil || !strings.Contains(error.Error(), test.error) {
+			t.Errorf("%s: error %v, expected %s", test.statement, error, test.error)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	tests := []struct {
+		statement string
+		expected  Sample
+	}{
+		{"FIND ALL MATCHING dest_port=443 SINCE LAST WEEK SAMPLE 10%", Sample{Percent: 10}},
+		{"FIND ALL SINCE YESTERDAY sample 0.5 percent ORDER BY src_ip", Sample{Percent: 0.5}},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 25%", Sample{Percent: 25}},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 1000 ROWS | LIMIT 10", Sample{Rows: 1000}},
+		{"FIND sample MATCHING sample=1 SINCE YESTERDAY", Sample{}},
+	}
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+			continue
+		}
+		if query.Sample != test.expected {
+			t.Errorf("%s: sample %+v, expected %+v", test.statement, query.Sample, test.expected)
+		}
+	}
+
+	errors := []struct {
+		statement string
+		expected  string
+	}{
+		{"FIND ALL SINCE YESTERDAY SAMPLE 150%", "SAMPLE percentage has to be more than 0 and at most 100 at '150%'"},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 0%", "SAMPLE percentage has to be more than 0 and at most 100"},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 0 ROWS", "SAMPLE has to be at least 1 row"},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 2.5 ROWS", "SAMPLE has to be at least 1 row"},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 10", "expected %, PERCENT or ROWS after SAMPLE 10"},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 10 %", "% goes right after the number, as in SAMPLE 10%"},
+		{"FIND ALL SINCE YESTERDAY SAMPLE 10 MOD", "expected %, PERCENT or ROWS after SAMPLE 10"},
+		{"FIND ALL SINCE YESTERDAY SAMPLE MOD 10", "expected percentage or number of rows after SAMPLE"},
+	}
+	for _, test := range errors {
+		if _, error := Parse(test.statement); error == nil || !strings.Contains(error.Error(), test.expected) {
+			t.Errorf("%s: error %v, expected %s", test.statement, error, test.expected)
+		}
+	}
+
+	// Outside SAMPLE, % is modulo, with or without spaces
+	query, error := Parse("FIND ALL MATCHING dest_port % 2 = 0 AND bytes%3 = 1 SINCE YESTERDAY SAMPLE 10%")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	for _, predicate := range query.Conditions[0] {
+		if predicate.Expr == nil || predicate.Expr.Op != OpModulo {
+			t.Errorf("expected modulo, got %+v", predicate.Expr)
+		}
+	}
+	if query.Sample.Percent != 10 {
+		t.Errorf("sample %+v, expected 10%%", query.Sample)
+	}
+}
+
+func TestOnDay(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00") // a Wednesday
+
+	tests := []struct {
+		statement string
+		from      string
+		to        string
+	}{
+		{"FIND ALL ON '2024-01-05'", "2024-01-05 00:00:00", "2024-01-05 23:59:59"},
+		{"FIND ALL MATCHING dest_port=443 ON '2024-01-05 13:30:00' | SORT src_ip", "2024-01-05 00:00:00", "2024-01-05 23:59:59"},
+		{"FIND ALL ON YESTERDAY", "2024-05-14 00:00:00", "2024-05-14 23:59:59"},
+		{"FIND ALL on last monday", "2024-05-13 00:00:00", "2024-05-13 23:59:59"},
+	}
+	for _, test := range tests {
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+			continue
+		}
+		from := time.Unix(0, query.TimeFrom).UTC().Format(time.DateTime)
+		to := time.Unix(0, query.TimeTo).UTC().Format(time.DateTime)
+		if from != test.from || to != test.to || query.TimeToExclusive {
+			t.Errorf("%s: %s to %s, expected %s to %s", test.statement, from, to, test.from, test.to)
+		}
+	}
+
+	if _, error := ParseWithOptions("FIND ALL ON FOREVER", options); error == nil || !strings.Contains(error.Error(), "ON needs a day, not FOREVER") {
+		t.Errorf("ON FOREVER: error %v", error)
+	}
+}
+
+func TestTemporalOr(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00") // a Wednesday
+	day := func(date string, clock string) int64 {
+		t, _ := time.Parse(time.DateTime, date+" "+clock)
+		return t.UnixNano()
+	}
+
+	query, error := ParseWithOptions("FIND ALL MATCHING user='bob' SINCE LAST MONDAY UNTIL LAST TUESDAY OR BETWEEN '2024-05-01' AND '2024-05-02' EXCLUSIVE | SORT user", options)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	expected := []TimeRange{
+		time_range(day("2024-05-13", "00:00:00"), day("2024-05-14", "00:00:00"), false),
+		time_range(day("2024-05-01", "00:00:00"), day("2024-05-02", "00:00:00"), true),
+	}
+	if !reflect.DeepEqual(query.TimeRanges, expected) {
+		t.Errorf("time ranges %+v, expected %+v", query.TimeRanges, expected)
+	}
+	if query.TimeFrom != expected[1].From || query.TimeTo != expected[0].To || query.TimeToExclusive {
+		t.Errorf("span %d to %d (exclusive %v)", query.TimeFrom, query.TimeTo, query.TimeToExclusive)
+	}
+
+	// A single range is still a list of one
+	query, error = ParseWithOptions("FIND ALL SINCE YESTERDAY", options)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if len(query.TimeRanges) != 1 || query.TimeRanges[0] != query.TemporalPredicate() {
+		t.Errorf("time ranges %+v, expected just %+v", query.TimeRanges, query.TemporalPredicate())
+	}
+
+	// OR has to be followed by another range
+	if _, error := ParseWithOptions("FIND ALL SINCE YESTERDAY OR LAST WEEK", options); error == nil || !strings.Contains(error.Error(), "unexpected trailing input at 'OR LAST WEEK'") {
+		t.Errorf("OR without a range: error %v", error)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	query, error := Parse("FIND ALL MATCHING EXISTS error_code AND status >= 500 OR missing user OR NOT EXISTS [trace id] AND NOT MISSING span SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	expected := [][]Predicate{
+		{{Field: "error_code", Op: OpExists}, {Field: "status", Op: OpGreaterEqual, Value: "500"}},
+		{{Field: "user", Op: OpMissing}},
+		{{Field: "trace id", Op: OpMissing}, {Field: "span", Op: OpExists}},
+	}
+	if !reflect.DeepEqual(query.Conditions, expected) {
+		t.Errorf("conditions %+v, expected %+v", query.Conditions, expected)
+	}
+
+	// Followed by an operator, it's just a field
+	query, error = Parse("FIND ALL MATCHING exists = 1 AND missing BETWEEN 1 AND 2 AND [exists] = 'x' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	for _, predicate := range query.Conditions[0] {
+		if predicate.Op == OpExists || predicate.Op == OpMissing {
+			t.Errorf("%+v taken as a presence predicate", predicate)
+		}
+	}
+
+	errors := []struct {
+		statement string
+		expected  string
+	}{
+		{"FIND ALL MATCHING EXISTS SINCE YESTERDAY", "EXISTS needs a field at 'SINCE YESTERDAY'"},
+		{"FIND ALL MATCHING a=1 AND NOT MISSING 42 SINCE YESTERDAY", "MISSING needs a field at '42 SINCE YESTERDAY'"},
+	}
+	for _, test := range errors {
+		if _, error := Parse(test.statement); error == nil || !strings.Contains(error.Error(), test.expected) {
+			t.Errorf("%s: error %v, expected %s", test.statement, error, test.expected)
+		}
+	}
+}
+
+func TestTemporalComparison(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	tests := []struct {
+		query string
+		value string // RFC 3339, "" for a plain value
+	}{
+		{"FIND ALL MATCHING last_seen > 1 HOUR AGO SINCE LAST DAY", "2024-05-15T11:00:00Z"},
+		{"FIND ALL MATCHING last_seen >= YESTERDAY SINCE LAST DAY", "2024-05-14T00:00:00Z"},
+		{"FIND ALL MATCHING expires < LAST WEEK AND x = 1 SINCE LAST DAY", "2024-05-08T00:00:00Z"},
+		{"FIND ALL MATCHING last_seen > 1 SINCE LAST DAY", ""},
+		{"FIND ALL MATCHING last_seen > '2024-05-01' SINCE LAST DAY", ""},
+	}
+
+	for _, test := range tests {
+		q, error := ParseWithOptions(test.query, options)
+		if error != nil {
+			t.Errorf("%s: %s", test.query, error)
+			continue
+		}
+		predicate := q.Conditions[0][0]
+		if predicate.Op != OpGreater && predicate.Op != OpGreaterEqual && predicate.Op != OpLess {
+			t.Errorf("%s: operator %s", test.query, predicate.Op)
+		}
+
+		ns, temporal := predicate.Typed.(int64)
+		if test.value == "" {
+			if temporal {
+				t.Errorf("%s: plain value taken as a point in time, %s", test.query, predicate.Value)
+			}
+			continue
+		}
+		expected, _ := time.Parse(time.RFC3339, test.value)
+		if !temporal || ns != expected.UnixNano() || predicate.Value != test.value {
+			t.Errorf("%s: value %s (%v), expected %s", test.query, predicate.Value, predicate.Typed, test.value)
+		}
+		if q.IsDeterministic() {
+			t.Errorf("%s: deterministic, it depends on the clock", test.query)
+		}
+
+		data, _ := q.ToJSON()
+		if loaded, error := FromJSON(data); error != nil || loaded.Conditions[0][0].Typed != predicate.Typed {
+			t.Errorf("%s: from JSON %v, %v", test.query, loaded, error)
+		}
+	}
+
+	if _, error := Parse("FIND ALL MATCHING last_seen > 1 HOUR SINCE LAST DAY"); error == nil {
+		t.Errorf("1 HOUR without AGO accepted as a point in time")
+	}
+}
+
+func TestTemporalOutOfRange(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	for _, query := range []string{
+		"FIND src_ip SINCE 100000000 CENTURIES AGO",
+		"FIND src_ip SINCE 9223372036854775807 SECONDS AGO",
+		"FIND src_ip SINCE 3000 YEARS AGO",
+		"FIND src_ip SINCE 350 YEARS AGO",
+		"FIND src_ip SINCE 3100000 HOURS AGO",
+		"FIND src_ip SINCE PREVIOUS 1000000000000 WEEKS",
+		"FIND src_ip SINCE 20000 MONDAYS AGO",
+		"FIND src_ip SINCE 99999999999",
+		"FIND src_ip SINCE '9999-12-31'",
+		"FIND src_ip MATCHING last_seen > 100000000 CENTURIES AGO SINCE LAST DAY",
+	} {
+		q, error := ParseWithOptions(query, options)
+		if error == nil {
+			t.Errorf("%s: accepted, from %s", query, time.Unix(0, q.TimeFrom).UTC())
+			continue
+		}
+		if !strings.Contains(error.Error(), "time reference out of range") {
+			t.Errorf("%s: %s", query, error)
+		}
+	}
+
+	tests := []struct {
+		query string
+		from  string
+	}{
+		{"FIND src_ip SINCE 200 YEARS AGO", "1824-05-15 00:00:00"},
+		{"FIND src_ip SINCE 300 YEARS AGO", "1724-05-15 00:00:00"},
+		{"FIND src_ip SINCE 2900000 HOURS AGO", "1693-07-16 04:00:00"},
+		{"FIND src_ip SINCE 2 HOURS AGO", "2024-05-15 10:00:00"},
+		{"FIND src_ip SINCE 90 MINUTES AGO", "2024-05-15 10:30:00"},
+		{"FIND src_ip SINCE 5 SECONDS AGO", "2024-05-15 11:59:55"},
+	}
+	for _, test := range tests {
+		q, error := ParseWithOptions(test.query, options)
+		if error != nil {
+			t.Errorf("%s: %s", test.query, error)
+			continue
+		}
+		if from := time.Unix(0, q.TimeFrom).UTC().Format(time.DateTime); from != test.from {
+			t.Errorf("%s: from %s, expected %s", test.query, from, test.from)
+		}
+	}
+
+	// Going back a negative number of units would be in the future
+	for _, test := range []struct{ query, at string }{
+		{"FIND src_ip SINCE -5 DAYS AGO", "at '-5 DAYS AGO'"},
+		{"FIND src_ip SINCE -300 YEARS AGO", "at '-300 YEARS AGO'"},
+		{"FIND src_ip SINCE -2 WEEKS BEFORE LAST", "at '-2 WEEKS BEFORE LAST'"},
+		{"FIND src_ip SINCE PREVIOUS -3 WEEKS", "at '-3 WEEKS'"},
+		{"FIND ALL MATCHING last_seen > -1 HOUR AGO SINCE LAST DAY", "at '-1 HOUR AGO SINCE LAST DAY'"},
+	} {
+		_, error := ParseWithOptions(test.query, options)
+		if error == nil || !strings.Contains(error.Error(), "negative count of time units, that's in the future, "+test.at) {
+			t.Errorf("%s: %v", test.query, error)
+		}
+		if error := Validate(test.query); error == nil {
+			t.Errorf("%s: Validate accepted it", test.query)
+		}
+	}
+}
+
+func TestConditionGroups(t *testing.T) {
+	tests := []struct {
+		statement string
+		tree      string // as the parser has it, parentheses where the grouping changes
+		groups    int    // AND groups once multiplied out
+	}{
+		{"FIND ALL MATCHING (a=1 OR b=2) AND (c=3 OR d=4) SINCE YESTERDAY", "(a = 1 OR b = 2) AND (c = 3 OR d = 4)", 4},
+		{"FIND ALL MATCHING a=1 AND (b=2 OR c=3) SINCE YESTERDAY", "a = 1 AND (b = 2 OR c = 3)", 2},
+		{"FIND ALL MATCHING a=1 OR b=2 AND c=3 OR d=4 SINCE YESTERDAY", "a = 1 OR (b = 2 AND c = 3) OR d = 4", 3},
+		{"FIND ALL MATCHING ((a=1)) AND ((b=2 AND c=3)) SINCE YESTERDAY", "a = 1 AND b = 2 AND c = 3", 1},
+		{"FIND ALL MATCHING (bytes + 1) * 8 > 1024 AND ((bytes - 1) > 2 OR EXISTS x) SINCE YESTERDAY", "((bytes + 1) * 8) > 1024 AND ((bytes - 1) > 2 OR EXISTS x)", 2},
+		{"FIND ALL MATCHING (1 < port < 10 OR (NOT MISSING y)) SINCE YESTERDAY", "(port > 1 AND port < 10) OR EXISTS y", 2},
+	}
+
+	for _, test := range tests {
+		tokens, error := lexer(test.statement)
+		if error != nil {
+			t.Fatalf("Lexer error: %s", error)
+		}
+		p := Parser{query: test.statement, tokens: tokens, num_tokens: len(tokens), options: DefaultOptions()}
+		if error := p.parser(); error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+			continue
+		}
+		if tree := p.matching_tree.String(); tree != test.tree {
+			t.Errorf("%s: tree %s, expected %s", test.statement, tree, test.tree)
+		}
+		if len(p.or_list) != test.groups {
+			t.Errorf("%s: %d AND groups, expected %d", test.statement, len(p.or_list), test.groups)
+		}
+	}
+
+	// The nesting itself, as the Query has it
+	query := "FIND ALL MATCHING (a=1 OR b=2) AND (c=3 OR d=4) SINCE YESTERDAY"
+	q, error := Parse(query)
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	tree := q.MatchingTree
+	if tree.Conjunction != ConjunctionAnd || len(tree.Children) != 2 || tree.Predicate != nil {
+		t.Fatalf("expected AND of two, got %+v", tree)
+	}
+	for i, fields := range []string{"ab", "cd"} {
+		child := tree.Children[i]
+		if child.Conjunction != ConjunctionOr || len(child.Children) != 2 || child.Children[0].Predicate == nil ||
+			child.Children[0].Predicate.Field+child.Children[1].Predicate.Field != fields {
+			t.Errorf("expected OR of %s, got %+v", fields, child)
+		}
+	}
+	var walked []string
+	tree.Walk(func(c *Condition) bool {
+		if c.Predicate != nil {
+			walked = append(walked, c.Predicate.Field)
+		}
+		return c.Conjunction != ConjunctionOr || c.Children[0].Predicate.Field != "c" // skip c=3 OR d=4
+	})
+	if !reflect.DeepEqual(walked, []string{"a", "b"}) {
+		t.Errorf("walked %v", walked)
+	}
+
+	// Conditions has them multiplied out
+	var groups []string
+	for _, group := range q.Conditions {
+		groups = append(groups, group[0].Field+group[1].Field)
+	}
+	if expected := []string{"ac", "ad", "bc", "bd"}; !reflect.DeepEqual(groups, expected) {
+		t.Errorf("groups %q, expected %q", groups, expected)
+	}
+
+	// HAVING takes them too
+	q, error = Parse("FIND src_ip, COUNT(*) AS n SINCE YESTERDAY | GROUP src_ip HAVING (n > 10 OR n < 2) AND src_ip != '10.0.0.1'")
+	if error != nil || len(q.Having) != 2 || len(q.Having[0]) != 2 || q.HavingTree.Conjunction != ConjunctionAnd {
+		t.Errorf("HAVING %v, %v", q, error)
+	}
+
+	// 29 comparisons, but 2^14 AND groups multiplied out: there's only the tree then
+	q, error = Parse("FIND ALL MATCHING " + strings.Repeat("(a=1 OR b=2) AND ", 14) + "c=3 SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+	if !q.Unexpanded || q.Conditions != nil || len(q.MatchingTree.Children) != 15 || len(q.Warnings()) != 1 {
+		t.Errorf("unexpanded %v, %d groups, tree %+v, warnings %v", q.Unexpanded, len(q.Conditions), q.MatchingTree, q.Warnings())
+	}
+	if where, args := q.ToSQLWhere(); !strings.HasSuffix(where, `AND ("a" = ? OR "b" = ?) AND "c" = ?`) || len(args) != 2+29 {
+		t.Errorf("SQL %s %v", where, args)
+	}
+	if fields := q.ReferencedFields(); !reflect.DeepEqual(fields, []string{"a", "b", "c"}) {
+		t.Errorf("referenced fields %v", fields)
+	}
+
+	errors := []struct {
+		statement string
+		expected  string
+	}{
+		{"FIND ALL MATCHING (a=1 OR b=2 SINCE YESTERDAY", "expected closing parenthesis"},
+		{"FIND ALL MATCHING (a=1 OR b=2)) SINCE YESTERDAY", "expected temporal clause"},
+	}
+	for _, test := range errors {
+		if _, error := Parse(test.statement); error == nil || !strings.Contains(error.Error(), test.expected) {
+			t.Errorf("%s: error %v, expected %s", test.statement, error, test.expected)
+		}
+	}
+}
+
+func TestFieldsKeyword(t *testing.T) {
+	tests := []struct {
+		statement string
+		fields    []string
+		ok        bool
+	}{
+		{"FIND FIELDS src_ip, dest_ip SINCE YESTERDAY", []string{"src_ip", "dest_ip"}, true},
+		{"find fields (src_ip, dest_ip) SINCE YESTERDAY", []string{"src_ip", "dest_ip"}, true},
+		{"FIND DISTINCT FIELDS src_ip SINCE YESTERDAY", []string{"src_ip"}, true},
+		{"FIND fields SINCE YESTERDAY", []string{"fields"}, true},
+		{"FIND fields, src_ip SINCE YESTERDAY", []string{"fields", "src_ip"}, true},
+		{"FIND FIELDS fields SINCE YESTERDAY", []string{"fields"}, true},
+		{"FIND [fields] src_ip SINCE YESTERDAY", []string{"fields", "src_ip"}, true},
+		{"FIND FIELDS ALL SINCE YESTERDAY", nil, false},
+		{"FIND ALL FIELDS src_ip SINCE YESTERDAY", nil, false},
+		{"FIND FIELDS SINCE YESTERDAY", []string{"FIELDS"}, true},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if (error == nil) != test.ok {
+			t.Errorf("%s: error %v, expected ok %v", test.statement, error, test.ok)
+			continue
+		}
+		if error == nil && !reflect.DeepEqual(query.Fields, test.fields) {
+			t.Errorf("%s: fields %v, expected %v", test.statement, query.Fields, test.fields)
+		}
+	}
+
+	if formatted, error := FormatQuery("find fields src_ip since yesterday"); error != nil || formatted != "FIND FIELDS src_ip\nSINCE YESTERDAY" {
+		t.Errorf("FormatQuery: %q, %v", formatted, error)
+	}
+}
+
+func TestForever(t *testing.T) {
+	now := time.Now().UnixNano()
+
+	tests := []struct {
+		statement   string
+		open_past   bool
+		open_future bool
+	}{
+		{"FIND src_ip SINCE FOREVER", true, false},
+		{"FIND src_ip BETWEEN FOREVER AND YESTERDAY", true, false},
+		{"FIND src_ip BETWEEN LAST WEEK AND FOREVER", false, true},
+		{"FIND src_ip SINCE LAST WEEK UNTIL FOREVER", false, true},
+		{"FIND src_ip BETWEEN FOREVER AND FOREVER", true, true},
+	}
+
+	for _, test := range tests {
+		parser, error := parse_statement(test.statement)
+		if error != nil {
+			t.Fatalf("Parser error: %s", error)
+		}
+		if (parser.time_from == temp_forever_past) != test.open_past {
+			t.Errorf("%s: start %d, expected open past %v", test.statement, parser.time_from, test.open_past)
+		}
+		if (parser.time_to == temp_forever_future) != test.open_future {
+			t.Errorf("%s: end %d, expected open future %v", test.statement, parser.time_to, test.open_future)
+		}
+		if !test.open_past && (parser.time_from <= temp_forever_past || parser.time_from > now) {
+			t.Errorf("%s: start %d out of range", test.statement, parser.time_from)
+		}
+	}
+}
+
 // EOF
@@ -0,0 +1,1371 @@
+// OpenActa - Query
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+The Query is what the outside world gets to see of a parsed statement.
+The parser's own structures point back into the token slice, which is handy
+while parsing but awkward for anyone else. A Query holds plain values only,
+so it can be compared, copied and kept around after the parser is gone.
+*/
+
+type Query struct {
+	// From directives in leading comments: -- name: failed-logins, see lexer_directives()
+	Name        string
+	Description string
+
+	Fields  []string // Fields to return
+	Aliases []string // Field aliases, same order as Fields
+	Sources []string // Source per field for qualified fields (netflow:src_ip), "" for others - nil if there are none
+	All     bool     // FIND ALL
+
+	Aggregates []Aggregate // COUNT(*), SUM(bytes), ...
+
+	TimeFrom        int64 // Earliest time we want (unix epoch, nanoseconds)
+	TimeTo          int64 // Latest time we want (unix epoch, nanoseconds)
+	TimeToExclusive bool  // EXCLUSIVE: TimeTo itself is not included
+
+	// The ranges of the temporal clause, in the order written: ON YESTERDAY OR ON LAST MONDAY
+	// is two of them. Usually there's just the one, TimeFrom and TimeTo span them all.
+	TimeRanges []TimeRange
+
+	// MATCHING conditions as written, parentheses and all: (a=1 OR b=2) AND c=3 is an AND
+	// of an OR and a predicate. nil if there are none.
+	MatchingTree *Condition
+
+	// MATCHING conditions multiplied out, as OR of AND groups:
+	// a=1 OR b=2 AND c=3 is [[a=1] [b=2 c=3]], (a=1 OR b=2) AND c=3 is [[a=1 c=3] [b=2 c=3]].
+	// Every parenthesised OR ANDed on doubles the groups: past 10000 of them, Conditions is
+	// nil and Unexpanded is set, with a warning. MatchingTree has the conditions either way.
+	Conditions [][]Predicate
+
+	Sort       []SortKey     // SORT stage or ORDER BY clause
+	Group      []string      // GROUP stage fields
+	HavingTree *Condition    // HAVING conditions on the GROUP stage as written, like MatchingTree
+	Having     [][]Predicate // HAVING conditions multiplied out, OR of AND groups like Conditions
+	Distinct   []string      // DISTINCT stage fields
+
+	// MATCHING or HAVING came to too many AND groups to multiply out, see Conditions
+	Unexpanded bool
+
+	// GROUP time(1h): also group by time, in buckets of this many nanoseconds starting
+	// at midnight UTC. 0 if there's none.
+	TimeBucket int64
+
+	// DISTINCT stage without fields, or FIND DISTINCT: over the whole selected row (Distinct is empty)
+	DistinctRow bool
+
+	// SORT RANDOM: results in random order, for sampling (Sort is empty).
+	// RandomSeed is Options.RandomSeed, 0 leaves the seed to whoever runs the query.
+	SortRandom bool
+	RandomSeed int64
+
+	Sample Sample // SAMPLE clause, zero if there's none
+
+	Limit   int      // LIMIT stage, 0 if there's none
+	LimitBy []string // LIMIT ... BY fields, Limit is per distinct combination of these
+
+	Format Format // FORMAT stage, FormatDefault if there's none
+
+	// MATCHING or HAVING can never be true, as comparisons between literals rule out
+	// every OR branch (1=2): there's no need to run the query at all
+	AlwaysEmpty bool
+
+	warnings []string
+	inferred map[string]FieldType
+	relative bool // the time range was resolved against the clock, see IsDeterministic()
+
+	// The time range as written was resolved against the clock (LAST WEEK, SINCE without
+	// UNTIL), so Equal() goes by the temporal clause rather than the times
+	relative_range bool
+
+	// The statement as written, and where its temporal clause is, for ExpandTemporal()
+	text           string
+	temporal_start int
+	temporal_end   int
+}
+
+// A single comparison in the MATCHING clause
+type Predicate struct {
+	Field  string    // left-hand side
+	Source string    // source of a qualified field: netflow for netflow:src_ip, Field is src_ip
+	Expr   *Expr     // computed left-hand side (dest_port MOD 2), Field is empty then
+	Op     Operator  // comparison
+	Value  string    // right-hand side, lower bound for BETWEEN
+	Kind   ValueKind // what Value is: literal, quoted string or field
+
+	// Value as netip.Addr ('192.168.0.1') or netip.Prefix ('10.0.0.0/8') for quoted
+	// IP literals, time.Duration (nanoseconds) for durations (500ms),
+	// *regexp.Regexp for the pattern of OpMatches,
+	// int64 unix epoch nanoseconds for a point in time (1 HOUR AGO), Value is then in RFC 3339 form.
+	// nil for anything else, Value has the string either way.
+	Typed interface{}
+
+	High      string    // BETWEEN upper bound
+	HighKind  ValueKind // what High is
+	Exclusive bool      // BETWEEN ... EXCLUSIVE, High itself is not included
+
+	// Compare strings without regard to case: EQUALS-IGNORE-CASE,
+	// or a quoted string with the CaseInsensitiveStrings option
+	IgnoreCase bool
+}
+
+// What the right-hand side of a Predicate is, a backend passes a string on as a string
+// however much it looks like a number, and a field as a field
+type ValueKind int
+
+const (
+	ValueLiteral ValueKind = iota // unquoted: number, duration or point in time
+	ValueString                   // quoted string: zip = '007'
+	ValueField                    // another field: bytes_in > bytes_out
+)
+
+// The conditions as written: a single Predicate (Conjunction is ConjunctionNone),
+// or the AND or OR of its Children
+type Condition struct {
+	Conjunction Conjunction
+	Predicate   *Predicate
+	Children    []*Condition
+}
+
+// Walk calls visit for c and everything below it, depth first in the order written.
+// When visit returns false, what's below that condition is skipped.
+func (c *Condition) Walk(visit func(c *Condition) bool) {
+	if c == nil || !visit(c) {
+		return
+	}
+	for _, child := range c.Children {
+		child.Walk(visit)
+	}
+}
+
+// The predicates in the tree, in the order written
+func (c *Condition) predicates() []*Predicate {
+	var predicates []*Predicate
+	c.Walk(func(c *Condition) bool {
+		if c.Predicate != nil {
+			predicates = append(predicates, c.Predicate)
+		}
+		return true
+	})
+	return predicates
+}
+
+// DumpTree writes the MATCHING and HAVING conditions as written, one OR branch per line, for debugging:
+//
+//	MATCHING
+//	  OR (dest_port - 1) = 442 AND proto = 'tcp'
+//	  OR bytes BETWEEN 10 AND 20 EXCLUSIVE
+func (q *Query) DumpTree(w io.Writer) {
+	dump := func(clause string, tree *Condition) {
+		if tree == nil {
+			return
+		}
+		fmt.Fprintf(w, "%s\n", clause)
+		branches := []*Condition{tree}
+		if tree.Conjunction == ConjunctionOr {
+			branches = tree.Children
+		}
+		for _, branch := range branches {
+			fmt.Fprintf(w, "  OR %s\n", branch)
+		}
+	}
+
+	dump("MATCHING", q.MatchingTree)
+	dump("HAVING", q.HavingTree)
+}
+
+// The conditions as written, with parentheses where a group is joined differently from its parent
+func (c *Condition) String() string {
+	switch {
+	case c == nil:
+		return "?"
+	case c.Predicate != nil:
+		return c.Predicate.String()
+	}
+
+	parts := make([]string, 0, len(c.Children))
+	for _, child := range c.Children {
+		if child != nil && child.Predicate == nil {
+			parts = append(parts, "("+child.String()+")")
+		} else {
+			parts = append(parts, child.String())
+		}
+	}
+	return strings.Join(parts, " "+c.Conjunction.String()+" ")
+}
+
+// The predicate as written, strings in quotes and a qualified field with its source
+func (p *Predicate) String() string {
+	left := p.Field
+	switch {
+	case p.Expr != nil:
+		left = p.Expr.String()
+	case p.Source != "":
+		left = p.Source + ":" + p.Field
+	}
+
+	if p.Op == OpExists || p.Op == OpMissing {
+		return fmt.Sprintf("%s %s", p.Op, left)
+	}
+	s := fmt.Sprintf("%s %s %s", left, p.Op, value_string(p.Value, p.Kind))
+	if p.Op == OpBetween {
+		s += " AND " + value_string(p.High, p.HighKind)
+		if p.Exclusive {
+			s += " EXCLUSIVE"
+		}
+	}
+	if p.IgnoreCase {
+		s += " (ignore case)"
+	}
+	return s
+}
+
+func (e *Expr) String() string {
+	switch {
+	case e == nil:
+		return "?"
+	case e.Op == OpNone && e.Field != "":
+		return e.Field
+	case e.Op == OpNone:
+		return value_string(e.Value, e.Kind)
+	case e.Op == OpNegate:
+		return fmt.Sprintf("(-%s)", e.Left)
+	}
+	return fmt.Sprintf("(%s %s %s)", e.Left, e.Op, e.Right)
+}
+
+func value_string(value string, kind ValueKind) string {
+	if kind == ValueString {
+		return "'" + value + "'"
+	}
+	return value
+}
+
+// A predicate in the flat view of the conditions, see Query.Predicates()
+type JoinedPredicate struct {
+	Predicate
+	Conjunction Conjunction // how it's joined to the predicate before it
+}
+
+type Conjunction int
+
+const (
+	ConjunctionNone Conjunction = iota // the first predicate
+	ConjunctionAnd
+	ConjunctionOr
+)
+
+func (c Conjunction) String() string {
+	switch c {
+	case ConjunctionAnd:
+		return "AND"
+	case ConjunctionOr:
+		return "OR"
+	}
+	return ""
+}
+
+// How an index on the field could be used for a predicate, see Predicate.Classify()
+type Access int
+
+const (
+	AccessScan  Access = iota // every row has to be looked at: !=, computed fields, patterns
+	AccessSeek                // equality, straight to the matching rows
+	AccessRange               // <, >, <=, >= or BETWEEN, a range of the index
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessSeek:
+		return "seek"
+	case AccessRange:
+		return "range"
+	}
+	return "scan"
+}
+
+// Arithmetic on the left-hand side of a comparison, as a tree.
+// A leaf has Op OpNone, and either a Field or a literal Value.
+// OpNegate only has a Left. A literal on the left-hand side that isn't
+// compared with a field, 'abc' BETWEEN lo AND hi, is a single leaf.
+type Expr struct {
+	Op    Operator  // OpAdd, OpSubtract, OpMultiply, OpDivide, OpModulo or OpNegate
+	Field string    // leaf: field reference
+	Value string    // leaf: literal
+	Kind  ValueKind // leaf: what Value is, ValueString for a quoted string
+	Left  *Expr
+	Right *Expr
+}
+
+// Comparison and arithmetic operators
+type Operator int
+
+const (
+	OpNone Operator = iota
+	OpEqual
+	OpNotEqual
+	OpLess
+	OpGreater
+	OpLessEqual
+	OpGreaterEqual
+	OpBetween // Value <= Field <= High (or < High, if Exclusive)
+	OpAdd
+	OpSubtract
+	OpMultiply
+	OpDivide
+	OpModulo
+	OpNegate   // unary minus
+	OpContains // Value is a substring of Field
+	OpMatches  // Field matches the regular expression in Value, Typed has it compiled
+	OpExists   // Field is there, whatever its value - Value is empty
+	OpMissing  // Field isn't there - Value is empty
+)
+
+// lexer symbol -> operator look-up, anything not in here isn't an operator
+var operator_table = map[int]Operator{
+	sym_equal:         OpEqual,
+	sym_equal_ci:      OpEqual, // with IgnoreCase
+	sym_not_equal:     OpNotEqual,
+	sym_less:          OpLess,
+	sym_greater:       OpGreater,
+	sym_less_equal:    OpLessEqual,
+	sym_greater_equal: OpGreaterEqual,
+	sym_contains:      OpContains,
+	sym_matches:       OpMatches,
+}
+
+// lexer symbol -> arithmetic operator look-up, for <num-val-expr>
+var arithmetic_table = map[int]Operator{
+	sym_plus:  OpAdd,
+	sym_minus: OpSubtract,
+	sym_mul:   OpMultiply,
+	sym_div:   OpDivide,
+	sym_mod:   OpModulo,
+}
+
+func (op Operator) String() string {
+	switch op {
+	case OpEqual:
+		return "="
+	case OpNotEqual:
+		return "!="
+	case OpLess:
+		return "<"
+	case OpGreater:
+		return ">"
+	case OpLessEqual:
+		return "<="
+	case OpGreaterEqual:
+		return ">="
+	case OpBetween:
+		return "BETWEEN"
+	case OpAdd:
+		return "+"
+	case OpSubtract:
+		return "-"
+	case OpMultiply:
+		return "*"
+	case OpDivide:
+		return "/"
+	case OpModulo:
+		return "%"
+	case OpNegate:
+		return "-"
+	case OpContains:
+		return "CONTAINS"
+	case OpMatches:
+		return "=~"
+	case OpExists:
+		return "EXISTS"
+	case OpMissing:
+		return "MISSING"
+	}
+	return "?"
+}
+
+// Output format requested with a FORMAT stage, the parser only passes it on
+type Format int
+
+const (
+	FormatDefault Format = iota // no FORMAT stage, up to whoever runs the query
+	FormatJSON
+	FormatCSV
+	FormatTable
+)
+
+// FORMAT name -> format look-up, names are matched in upper case
+var format_table = map[string]Format{
+	"JSON":  FormatJSON,
+	"CSV":   FormatCSV,
+	"TABLE": FormatTable,
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "JSON"
+	case FormatCSV:
+		return "CSV"
+	case FormatTable:
+		return "TABLE"
+	}
+	return ""
+}
+
+// The time range of a query, for pruning storage before looking at any other conditions
+type TimeRange struct {
+	From int64 // unix epoch, nanoseconds
+	To   int64
+
+	FromBounded bool // false for FOREVER as the start, From is then math.MinInt64
+	ToBounded   bool // false for FOREVER as the end, To is then math.MaxInt64
+	ToExclusive bool // EXCLUSIVE: To itself is not included
+}
+
+type Aggregate struct {
+	Function string // COUNT, SUM, MIN, MAX or AVG
+	Field    string // argument, "*" for COUNT(*)
+	Alias    string // AS alias, or generated: count_star, sum_bytes, ...
+	Distinct bool   // COUNT(DISTINCT src_ip)
+
+	GeneratedAlias bool // there was no AS, Alias was generated
+}
+
+// SAMPLE 10% or SAMPLE 1000 ROWS: only part of the results is wanted, picked at random.
+// One of the two is set.
+type Sample struct {
+	Percent float64 // more than 0, at most 100
+	Rows    int
+}
+
+type SortKey struct {
+	Field      string
+	Descending bool
+
+	// Rows without the field, or with a null value, go last unless NullsFirst is set -
+	// ascending or descending alike, so what's there comes first
+	NullsFirst bool
+	Collation  string // COLLATE hint for comparing strings, "" if there's none
+}
+
+// Parse lexes and parses a single statement
+func Parse(query string) (*Query, error) {
+	return ParseWithOptions(query, DefaultOptions())
+}
+
+// ParseWithOptions lexes and parses a single statement, see options.go
+func ParseWithOptions(query string, options Options) (*Query, error) {
+	return parse(context.Background(), query, options)
+}
+
+// ParseContext lexes and parses a single statement, giving up with ctx.Err() once ctx
+// is cancelled or past its deadline. Meant for services parsing user-supplied queries.
+func ParseContext(ctx context.Context, query string) (*Query, error) {
+	return parse(ctx, query, DefaultOptions())
+}
+
+func parse(ctx context.Context, query string, options Options) (*Query, error) {
+	if err := ctx.Err(); err != nil { // don't bother starting
+		return nil, err
+	}
+
+	tokens, err := lexer_context(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := Parser{query: query, tokens: tokens, num_tokens: len(tokens), options: options, ctx: ctx}
+	if err := p.parser(); err != nil {
+		return nil, err
+	}
+
+	return p.make_query(), nil
+}
+
+// Validate checks the syntax of a statement, without building a Query.
+// It goes through the same grammar as Parse, so anything Validate accepts Parse accepts too,
+// but relative temporal references aren't resolved against the clock.
+func Validate(query string) error {
+	tokens, err := lexer(query)
+	if err != nil {
+		return err
+	}
+
+	p := Parser{query: query, tokens: tokens, num_tokens: len(tokens), options: DefaultOptions(), validate_only: true}
+	return p.parser()
+}
+
+// Warnings returns the non-fatal issues found while parsing, if any
+func (q *Query) Warnings() []string {
+	return q.warnings
+}
+
+// Equal reports whether two queries parsed to the same structure,
+// however they were written: LAST WEEK and the dates it resolved to are the same.
+// When both time ranges were resolved against the clock (SINCE LAST WEEK, SINCE without
+// UNTIL), the clock moved on in between, so they're compared as written instead.
+// A point in time in MATCHING (last_seen > 1 HOUR AGO) is compared as resolved,
+// two of those only come out the same with a pinned Options.Now.
+func (q *Query) Equal(other *Query) bool {
+	if q == nil || other == nil {
+		return q == other
+	}
+
+	a, b := *q, *other
+	if a.relative_range && b.relative_range {
+		if !strings.EqualFold(a.temporal_clause(), b.temporal_clause()) {
+			return false
+		}
+		a.TimeFrom, a.TimeTo, a.TimeRanges = 0, 0, nil
+		b.TimeFrom, b.TimeTo, b.TimeRanges = 0, 0, nil
+	}
+	a.text, a.temporal_start, a.temporal_end, a.relative, a.relative_range = "", 0, 0, false, false
+	b.text, b.temporal_start, b.temporal_end, b.relative, b.relative_range = "", 0, 0, false, false
+	return reflect.DeepEqual(a, b)
+}
+
+// The temporal clause as written, with single spaces between words
+func (q *Query) temporal_clause() string {
+	return strings.Join(strings.Fields(q.text[q.temporal_start:q.temporal_end]), " ")
+}
+
+// IsDeterministic tells whether parsing the statement again, at any other time, gives the
+// same query with the same results: false if its time range depends on when it's run (LAST HOUR,
+// SINCE without UNTIL), or it picks results at random (SAMPLE, SORT RANDOM).
+// A cache can hold on to the results of a deterministic query.
+// A query loaded with FromJSON() has its time range as resolved, so that's no longer relative.
+func (q *Query) IsDeterministic() bool {
+	return !q.relative && q.Sample == (Sample{}) && !q.SortRandom
+}
+
+// ExpandTemporal returns the statement with its temporal clause replaced by the
+// time range it resolved to, for audit logs and the like:
+//
+//	FIND src_ip SINCE LAST WEEK | SORT src_ip
+//	FIND src_ip BETWEEN '2024-05-08T00:00:00Z' AND '2024-05-15T12:00:00Z' | SORT src_ip
+//
+// The rest of the statement is left exactly as it was written.
+func (q *Query) ExpandTemporal() string {
+	if q.text == "" { // not from Parse()
+		return ""
+	}
+
+	var ranges []string
+	for _, r := range q.ranges() {
+		expanded := "BETWEEN " + expand_time(r.From) + " AND " + expand_time(r.To)
+		if r.ToExclusive {
+			expanded += " EXCLUSIVE"
+		}
+		ranges = append(ranges, expanded)
+	}
+	clause := strings.Join(ranges, " OR ")
+
+	if q.temporal_start == q.temporal_end { // there was no temporal clause, put it in
+		before, after := strings.TrimRightFunc(q.text[:q.temporal_start], unicode.IsSpace), q.text[q.temporal_start:]
+		if after != "" {
+			clause += " "
+		}
+		return before + " " + clause + after
+	}
+
+	return q.text[:q.temporal_start] + clause + q.text[q.temporal_end:]
+}
+
+// TemporalPredicate returns the time range the query resolved to.
+// SINCE without UNTIL ends at the time of parsing, so it's bounded on both sides,
+// only FOREVER leaves a side open.
+// With more than one range in the temporal clause, it's the span of all of them.
+func (q *Query) TemporalPredicate() TimeRange {
+	return time_range(q.TimeFrom, q.TimeTo, q.TimeToExclusive)
+}
+
+// The ranges of the temporal clause, or the span if there are none (not from Parse())
+func (q *Query) ranges() []TimeRange {
+	if len(q.TimeRanges) == 0 {
+		return []TimeRange{q.TemporalPredicate()}
+	}
+	return q.TimeRanges
+}
+
+func time_range(from int64, to int64, exclusive bool) TimeRange {
+	return TimeRange{
+		From: from,
+		To:   to,
+
+		FromBounded: from != temp_forever_past,
+		ToBounded:   to != temp_forever_future,
+		ToExclusive: exclusive,
+	}
+}
+
+// From the earliest start to the latest end, which is exclusive only if it is for every range ending there
+func span_ranges(ranges []TimeRange) TimeRange {
+	span := ranges[0]
+	for _, r := range ranges[1:] {
+		if r.From < span.From {
+			span.From = r.From
+		}
+		switch {
+		case r.To > span.To:
+			span.To, span.ToExclusive = r.To, r.ToExclusive
+		case r.To == span.To:
+			span.ToExclusive = span.ToExclusive && r.ToExclusive
+		}
+	}
+
+	return time_range(span.From, span.To, span.ToExclusive)
+}
+
+// Where two ranges overlap, overlap is false if they don't
+func (r TimeRange) intersect(other TimeRange) (TimeRange, bool) {
+	from, to, exclusive := r.From, r.To, r.ToExclusive
+	if other.From > from {
+		from = other.From
+	}
+	switch {
+	case other.To < to:
+		to, exclusive = other.To, other.ToExclusive
+	case other.To == to:
+		exclusive = exclusive || other.ToExclusive
+	}
+
+	return time_range(from, to, exclusive), from < to || (from == to && !exclusive)
+}
+
+// Quoted RFC 3339 time in UTC, or FOREVER for an open end
+func expand_time(t int64) string {
+	if t == temp_forever_past || t == temp_forever_future {
+		return "FOREVER"
+	}
+
+	return "'" + time.Unix(0, t).UTC().Format(time.RFC3339Nano) + "'"
+}
+
+// ReferencedFields returns every field the query touches, from the field list,
+// aggregates, MATCHING conditions (both sides) and the pipe stages - deduplicated and sorted.
+// A qualified field comes with its source, netflow:src_ip. Aliases are names given to
+// results rather than fields, so they're left out of the pipe stages; MATCHING is on the
+// events themselves, so a field there counts even if an alias has the same name.
+func (q *Query) ReferencedFields() []string {
+	aliases := make(map[string]bool)
+	for i := range q.Aliases {
+		if i < len(q.Fields) && q.Aliases[i] != q.Fields[i] {
+			aliases[q.Aliases[i]] = true
+		}
+	}
+	for _, agg := range q.Aggregates {
+		if agg.Alias != "" {
+			aliases[agg.Alias] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	var fields []string
+	add := func(field string, maybe_alias bool) {
+		if field == "" || field == "*" || seen[field] || (maybe_alias && aliases[field]) {
+			return
+		}
+		seen[field] = true
+		fields = append(fields, field)
+	}
+
+	for i, field := range q.Fields {
+		if i < len(q.Sources) && q.Sources[i] != "" {
+			field = q.Sources[i] + ":" + field
+		}
+		add(field, false)
+	}
+	for _, agg := range q.Aggregates {
+		add(agg.Field, false)
+	}
+	for _, predicate := range q.matching().predicates() {
+		if predicate.Source != "" {
+			add(predicate.Source+":"+predicate.Field, false)
+		} else {
+			add(predicate.Field, false)
+		}
+		for _, field := range predicate.Expr.fields() {
+			add(field, false)
+		}
+		if predicate.Kind == ValueField {
+			add(predicate.Value, false)
+		}
+		if predicate.HighKind == ValueField {
+			add(predicate.High, false)
+		}
+	}
+	for _, key := range q.Sort {
+		add(key.Field, true)
+	}
+	for _, field := range q.Group {
+		add(field, true)
+	}
+	for _, field := range q.Distinct {
+		add(field, true)
+	}
+	for _, field := range q.LimitBy {
+		add(field, true)
+	}
+
+	sort.Strings(fields)
+	return fields
+}
+
+// InferredTypes returns what the fields in the MATCHING clause hold, going by the values they're
+// compared with, for backends without a schema: dest_port > 1024 makes dest_port a FieldInt.
+// A qualified field goes by its source as well, netflow:dest_port apart from dest_port.
+// A field compared with both a number and a string is FieldAny, and there's a warning about it.
+func (q *Query) InferredTypes() map[string]FieldType {
+	return copy_types(q.inferred)
+}
+
+// CombineAND returns a new query that is base with the MATCHING conditions of extra ANDed on,
+// such as a mandatory tenant filter on a user's query, without going through the query text.
+// The time range is where both ranges overlap (any of them, with OR). Everything else comes from base.
+// If the ranges don't overlap at all, the result is AlwaysEmpty.
+func CombineAND(base, extra *Query) *Query {
+	q := copy_query(base)
+	q.warnings = append(q.warnings, extra.warnings...)
+	q.relative = base.relative || extra.relative
+	q.relative_range = false // the overlap isn't what either clause says
+	for field, kind := range extra.inferred {
+		if seen, exists := q.inferred[field]; exists {
+			kind = merge_types(seen, kind)
+		}
+		if q.inferred == nil {
+			q.inferred = make(map[string]FieldType)
+		}
+		q.inferred[field] = kind
+	}
+	q.text, q.temporal_start, q.temporal_end = "", 0, 0 // there's no query text for this one
+
+	q.MatchingTree = and_conditions(copy_condition(base.matching()), copy_condition(extra.matching()))
+
+	// (a OR b) AND (c OR d) is (a AND c) OR (a AND d) OR (b AND c) OR (b AND d)
+	switch {
+	case base.Unexpanded || extra.Unexpanded || len(base.Conditions)*len(extra.Conditions) > max_condition_groups:
+		q.Conditions = nil
+		q.Unexpanded = true
+	case len(extra.Conditions) == 0:
+		q.Conditions = copy_conditions(base.Conditions)
+	case len(base.Conditions) == 0:
+		q.Conditions = copy_conditions(extra.Conditions)
+	default:
+		q.Conditions = nil
+		for _, a := range base.Conditions {
+			for _, b := range extra.Conditions {
+				group := append(append([]Predicate(nil), a...), b...)
+				q.Conditions = append(q.Conditions, group)
+			}
+		}
+	}
+
+	// Wherever a range of base overlaps one of extra
+	q.TimeRanges = nil
+	for _, a := range base.ranges() {
+		for _, b := range extra.ranges() {
+			if overlap, ok := a.intersect(b); ok {
+				q.TimeRanges = append(q.TimeRanges, overlap)
+			}
+		}
+	}
+	if len(q.TimeRanges) > 0 {
+		span := span_ranges(q.TimeRanges)
+		q.TimeFrom, q.TimeTo, q.TimeToExclusive = span.From, span.To, span.ToExclusive
+	} else { // no overlap at all, AlwaysEmpty: keep where the spans would meet
+		span, _ := base.TemporalPredicate().intersect(extra.TemporalPredicate())
+		q.TimeFrom, q.TimeTo, q.TimeToExclusive = span.From, span.To, span.ToExclusive
+	}
+
+	q.AlwaysEmpty = base.AlwaysEmpty || extra.AlwaysEmpty || len(q.TimeRanges) == 0
+
+	return &q
+}
+
+// A copy that shares no slices or maps with the original
+func copy_query(original *Query) Query {
+	q := *original
+	q.Fields = append([]string(nil), original.Fields...)
+	q.Aliases = append([]string(nil), original.Aliases...)
+	q.Sources = append([]string(nil), original.Sources...)
+	q.Aggregates = append([]Aggregate(nil), original.Aggregates...)
+	q.TimeRanges = append([]TimeRange(nil), original.TimeRanges...)
+	q.MatchingTree = copy_condition(original.MatchingTree)
+	q.Conditions = copy_conditions(original.Conditions)
+	q.Sort = append([]SortKey(nil), original.Sort...)
+	q.Group = append([]string(nil), original.Group...)
+	q.HavingTree = copy_condition(original.HavingTree)
+	q.Having = copy_conditions(original.Having)
+	q.Distinct = append([]string(nil), original.Distinct...)
+	q.LimitBy = append([]string(nil), original.LimitBy...)
+	q.warnings = append([]string(nil), original.warnings...)
+	q.inferred = copy_types(original.inferred)
+
+	return q
+}
+
+// Canonicalize returns a copy of the query with its MATCHING and HAVING conditions in a
+// set order, so that queries which only differ in the order of AND and OR operands are Equal,
+// and make the same key for a cache: a=1 AND b=2 and b=2 AND a=1.
+// Duplicates go as well, a=1 AND a=1 is a=1, and values compared without regard to case
+// are in lower case. Conditions are an OR of AND groups without any NOT, so none of this
+// changes what matches. The statement text goes, as it doesn't match any more.
+// MatchingTree and HavingTree are rebuilt from the sorted groups, so they lose their parentheses,
+// unless the query is Unexpanded: then they're left as they are.
+func (q *Query) Canonicalize() *Query {
+	c := copy_query(q)
+	c.Conditions = canonical_conditions(c.Conditions)
+	c.Having = canonical_conditions(c.Having)
+	if !c.Unexpanded {
+		c.MatchingTree = condition_tree(c.Conditions)
+		c.HavingTree = condition_tree(c.Having)
+	}
+	sort.Strings(c.warnings)
+	c.text, c.temporal_start, c.temporal_end = "", 0, 0
+
+	return &c
+}
+
+// Each AND group sorted and without duplicates, then the groups likewise
+func canonical_conditions(conditions [][]Predicate) [][]Predicate {
+	type keyed_group struct {
+		key   string
+		group []Predicate
+	}
+	var groups []keyed_group
+
+	for _, group := range conditions {
+		keys := make(map[string]Predicate, len(group))
+		for _, predicate := range group {
+			if predicate.IgnoreCase && predicate.Op != OpMatches { // a pattern might have \D in it
+				predicate.Value, predicate.High = lower_value(predicate.Value, predicate.Kind), lower_value(predicate.High, predicate.HighKind)
+			}
+			keys[predicate.key()] = predicate
+		}
+
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+
+		keyed := keyed_group{key: strings.Join(sorted, "\n")}
+		for _, key := range sorted {
+			keyed.group = append(keyed.group, keys[key])
+		}
+		groups = append(groups, keyed)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].key < groups[j].key })
+
+	var canonical [][]Predicate
+	for i := range groups {
+		if i == 0 || groups[i].key != groups[i-1].key {
+			canonical = append(canonical, groups[i].group)
+		}
+	}
+
+	return canonical
+}
+
+// Everything about a predicate that matters for what it matches, as text to sort on
+func (p *Predicate) key() string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%s\x00%d\x00%s\x00%d\x00%t\x00%t", p.Source, p.Field, p.Expr.key(), p.Op, p.Value, p.Kind, p.High, p.HighKind, p.Exclusive, p.IgnoreCase)
+}
+
+// A value compared without regard to case, in lower case unless it's a field name
+func lower_value(value string, kind ValueKind) string {
+	if kind == ValueField {
+		return value
+	}
+	return strings.ToLower(value)
+}
+
+// The expression in prefix notation, "" for none
+func (e *Expr) key() string {
+	switch {
+	case e == nil:
+		return ""
+	case e.Op == OpNone && e.Field != "":
+		return "[" + e.Field + "]"
+	case e.Op == OpNone:
+		return value_string(e.Value, e.Kind)
+	}
+	return "(" + e.Op.String() + " " + e.Left.key() + " " + e.Right.key() + ")"
+}
+
+func copy_conditions(conditions [][]Predicate) [][]Predicate {
+	var copied [][]Predicate
+	for _, group := range conditions {
+		copied = append(copied, append([]Predicate(nil), group...))
+	}
+
+	return copied
+}
+
+func copy_condition(c *Condition) *Condition {
+	if c == nil {
+		return nil
+	}
+
+	copied := &Condition{Conjunction: c.Conjunction}
+	if c.Predicate != nil {
+		predicate := *c.Predicate
+		copied.Predicate = &predicate
+	}
+	for _, child := range c.Children {
+		copied.Children = append(copied.Children, copy_condition(child))
+	}
+	return copied
+}
+
+// The MATCHING conditions as a tree. A query that wasn't parsed (put together by hand,
+// or loaded from JSON stored before there was a tree) only has Conditions to go by.
+func (q *Query) matching() *Condition {
+	if q.MatchingTree != nil || q.Unexpanded {
+		return q.MatchingTree
+	}
+	return condition_tree(q.Conditions)
+}
+
+// OR of AND groups as a tree, nil for no groups
+func condition_tree(conditions [][]Predicate) *Condition {
+	var or []*Condition
+	for _, group := range conditions {
+		var and []*Condition
+		for i := range group {
+			predicate := group[i]
+			and = append(and, &Condition{Predicate: &predicate})
+		}
+		if len(and) == 1 {
+			or = append(or, and[0])
+		} else {
+			or = append(or, &Condition{Conjunction: ConjunctionAnd, Children: and})
+		}
+	}
+
+	switch len(or) {
+	case 0:
+		return nil
+	case 1:
+		return or[0]
+	}
+	return &Condition{Conjunction: ConjunctionOr, Children: or}
+}
+
+// a AND b, either of which may be nil. An AND is taken in, a AND (b AND c) is a AND b AND c.
+func and_conditions(a, b *Condition) *Condition {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+
+	and := &Condition{Conjunction: ConjunctionAnd}
+	for _, c := range []*Condition{a, b} {
+		if c.Conjunction == ConjunctionAnd {
+			and.Children = append(and.Children, c.Children...)
+		} else {
+			and.Children = append(and.Children, c)
+		}
+	}
+	return and
+}
+
+// Predicates returns the MATCHING conditions as a flat list in the order they were written,
+// each with the AND or OR joining it to the one before - handy for compiling a simple filter.
+// Read with AND binding tighter than OR, as in the query, it's the same as Conditions:
+// a=1 OR b=2 AND c=3 is a=1, OR b=2, AND c=3.
+// That only works when there's no OR inside an AND: for (a=1 OR b=2) AND c=3 an error is
+// returned, go by MatchingTree instead. Parentheses that change nothing, (a=1 AND b=2) OR c=3, are fine.
+func (q *Query) Predicates() ([]JoinedPredicate, error) {
+	tree := q.matching()
+	if tree == nil {
+		return nil, nil
+	}
+
+	branches := []*Condition{tree}
+	if tree.Conjunction == ConjunctionOr {
+		branches = tree.Children
+	}
+
+	var predicates []JoinedPredicate
+	for i, branch := range branches {
+		group := []*Condition{branch}
+		if branch.Conjunction == ConjunctionAnd {
+			group = branch.Children
+		}
+
+		for j, c := range group {
+			if c.Predicate == nil {
+				return nil, fmt.Errorf("conditions with an OR inside an AND can't be flattened, use MatchingTree")
+			}
+			conjunction := ConjunctionAnd
+			switch {
+			case i == 0 && j == 0:
+				conjunction = ConjunctionNone
+			case j == 0:
+				conjunction = ConjunctionOr
+			}
+			predicates = append(predicates, JoinedPredicate{Predicate: *c.Predicate, Conjunction: conjunction})
+		}
+	}
+
+	return predicates, nil
+}
+
+// Classify tells a backend with indexes how the predicate could be looked up.
+// Only a plain field helps, an index on dest_port is no use for dest_port MOD 2.
+// Comparing without regard to case takes a case insensitive index, so that's a scan too.
+func (p *Predicate) Classify() Access {
+	if p.Expr != nil || p.IgnoreCase || p.Kind == ValueField || p.HighKind == ValueField {
+		return AccessScan
+	}
+
+	switch p.Op {
+	case OpEqual:
+		return AccessSeek
+	case OpLess, OpGreater, OpLessEqual, OpGreaterEqual, OpBetween:
+		return AccessRange
+	}
+	return AccessScan
+}
+
+// SeekPredicates returns the equality predicates that every result satisfies, whichever OR branch
+// it comes from, so a backend can start from an index lookup on one of them.
+// With OR, that's only those in every branch: for a=1 AND b=2 OR a=1 AND c=3 it's a=1.
+// With parentheses it's the same: for a=1 AND (b=2 OR c=3) it's a=1, for (a=1 OR b=2) AND c=3 it's c=3.
+func (q *Query) SeekPredicates() []Predicate {
+	return seek_predicates(q.matching())
+}
+
+// The equalities c can't be true without: all of them for an AND, those in every branch for an OR
+func seek_predicates(c *Condition) []Predicate {
+	switch {
+	case c == nil:
+		return nil
+	case c.Predicate != nil:
+		if c.Predicate.Classify() != AccessSeek {
+			return nil
+		}
+		return []Predicate{*c.Predicate}
+	}
+
+	var seek []Predicate
+	if c.Conjunction == ConjunctionAnd {
+		for _, child := range c.Children {
+			for _, predicate := range seek_predicates(child) {
+				if !has_seek(seek, &predicate) {
+					seek = append(seek, predicate)
+				}
+			}
+		}
+		return seek
+	}
+
+	if len(c.Children) == 0 {
+		return nil
+	}
+	for _, predicate := range seek_predicates(c.Children[0]) {
+		everywhere := true
+		for _, child := range c.Children[1:] {
+			everywhere = everywhere && has_seek(seek_predicates(child), &predicate)
+		}
+		if everywhere {
+			seek = append(seek, predicate)
+		}
+	}
+	return seek
+}
+
+// The same equality is in this list
+func has_seek(list []Predicate, predicate *Predicate) bool {
+	for i := range list {
+		if list[i].Classify() == AccessSeek && list[i].Field == predicate.Field && list[i].Value == predicate.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// Guessed fraction of rows that get through a single predicate, see EstimateSelectivity()
+var selectivity_table = map[Operator]float64{
+	OpEqual:        0.01,
+	OpNotEqual:     0.9,
+	OpLess:         0.3,
+	OpGreater:      0.3,
+	OpLessEqual:    0.3,
+	OpGreaterEqual: 0.3,
+	OpBetween:      0.1,
+	OpContains:     0.1,
+	OpMatches:      0.2,
+	OpExists:       0.9,
+	OpMissing:      0.1,
+}
+
+// Computed left-hand side, dest_port MOD 2 = 0: anyone's guess
+const selectivity_expr = 0.5
+
+// EstimateSelectivity guesses the fraction of rows in the time range that the MATCHING conditions
+// let through, from 0 (none) to 1 (all), for a backend choosing between an index and a scan.
+// It only looks at the statement, not at the data, so it's a rough guess at best:
+//
+//   - an equality lets 1% through, a range (<, >, ...) 30%, BETWEEN 10%, != 90%,
+//     CONTAINS 10%, MATCHES 20%, EXISTS 90% and MISSING 10%
+//   - a computed left-hand side, dest_port MOD 2 = 0, lets half through whatever the comparison
+//   - an AND multiplies, as if its conditions were independent
+//   - an OR adds up, to at most 1
+//
+// Without conditions it's 1, a query that's AlwaysEmpty 0. HAVING isn't counted, it's after grouping.
+func (q *Query) EstimateSelectivity() float64 {
+	if q.AlwaysEmpty {
+		return 0
+	}
+
+	return selectivity(q.matching())
+}
+
+func selectivity(c *Condition) float64 {
+	switch {
+	case c == nil:
+		return 1
+	case c.Predicate != nil && c.Predicate.Expr != nil:
+		return selectivity_expr
+	case c.Predicate != nil:
+		if s, known := selectivity_table[c.Predicate.Op]; known {
+			return s
+		}
+		return 1
+	}
+
+	fraction := 1.0
+	if c.Conjunction == ConjunctionOr {
+		fraction = 0
+	}
+	for _, child := range c.Children {
+		if c.Conjunction == ConjunctionOr {
+			fraction += selectivity(child)
+		} else {
+			fraction *= selectivity(child)
+		}
+	}
+	return math.Min(fraction, 1)
+}
+
+func make_expr(e *expr) *Expr {
+	if e.op == OpNone {
+		if *e.value.lexer_tag == "ident" {
+			return &Expr{Field: *e.value.lexer_val}
+		}
+		return &Expr{Value: *e.value.lexer_val, Kind: value_kind(e.value)}
+	}
+
+	if e.op == OpNegate {
+		return &Expr{Op: e.op, Left: make_expr(e.left)}
+	}
+
+	return &Expr{Op: e.op, Left: make_expr(e.left), Right: make_expr(e.right)}
+}
+
+// Fields in an expression, left to right
+func (e *Expr) fields() []string {
+	if e == nil {
+		return nil
+	}
+	if e.Op == OpNone {
+		if e.Field == "" {
+			return nil
+		}
+		return []string{e.Field}
+	}
+
+	return append(e.Left.fields(), e.Right.fields()...)
+}
+
+// Field goes on the left, a literal compared with a field turns around: 5 < y is y > 5.
+// Any other literal on the left is a single leaf Expr, so it's never taken for a field.
+func make_predicate(c *comparison) Predicate {
+	if flipped, ok := flipped_operators[c.this.op]; ok && c.left_expr == nil && *c.left.lexer_tag != "ident" && *c.right.lexer_tag == "ident" {
+		turned := *c
+		turned.left, turned.right = c.right, c.left
+		turned.this.op = flipped
+		return make_predicate(&turned)
+	}
+
+	predicate := Predicate{Field: *c.left.lexer_val, Source: c.left.source, Op: c.this.op, Value: *c.right.lexer_val, Kind: value_kind(c.right), Typed: c.right.typed}
+	switch {
+	case c.left_expr != nil:
+		predicate.Field = ""
+		predicate.Expr = make_expr(c.left_expr)
+	case *c.left.lexer_tag != "ident":
+		predicate.Field = ""
+		predicate.Expr = make_expr(&expr{value: c.left})
+	}
+	if c.this.op == OpBetween {
+		predicate.High = *c.upper.lexer_val
+		predicate.HighKind = value_kind(c.upper)
+		predicate.Exclusive = c.exclusive
+	}
+	predicate.IgnoreCase = c.ignore_case
+
+	return predicate
+}
+
+// The operator with the sides swapped around
+var flipped_operators = map[Operator]Operator{
+	OpEqual:        OpEqual,
+	OpNotEqual:     OpNotEqual,
+	OpLess:         OpGreater,
+	OpGreater:      OpLess,
+	OpLessEqual:    OpGreaterEqual,
+	OpGreaterEqual: OpLessEqual,
+}
+
+func value_kind(value item) ValueKind {
+	switch *value.lexer_tag {
+	case "string":
+		return ValueString
+	case "ident":
+		return ValueField
+	}
+	return ValueLiteral
+}
+
+// OR of AND groups, from the parser's or_list structure
+func make_conditions(or_list []*or_item) [][]Predicate {
+	var conditions [][]Predicate
+
+	for _, or := range or_list {
+		group := []Predicate{make_predicate(&or.comparison)}
+		for _, and := range or.and_list {
+			group = append(group, make_predicate(&and.comparison))
+		}
+		conditions = append(conditions, group)
+	}
+
+	return conditions
+}
+
+// The tree as written, from the parser's cond_node tree
+func make_condition(node *cond_node) *Condition {
+	if node == nil {
+		return nil
+	}
+	if node.conjunction == ConjunctionNone {
+		predicate := make_predicate(node.comparison)
+		return &Condition{Predicate: &predicate}
+	}
+
+	c := &Condition{Conjunction: node.conjunction}
+	for _, child := range node.children {
+		c.Children = append(c.Children, make_condition(child))
+	}
+	return c
+}
+
+func copy_types(types map[string]FieldType) map[string]FieldType {
+	if len(types) == 0 {
+		return nil
+	}
+
+	copied := make(map[string]FieldType, len(types))
+	for field, kind := range types {
+		copied[field] = kind
+	}
+	return copied
+}
+
+// Copy the parser state into a Query
+func (p *Parser) make_query() *Query {
+	q := Query{
+		Fields:   append([]string(nil), p.fields...),
+		Aliases:  append([]string(nil), p.field_aliases...),
+		All:      p.find_flags&find_flags_all != 0,
+		TimeFrom: p.time_from,
+		TimeTo:   p.time_to,
+
+		TimeToExclusive: p.time_to_exclusive,
+		TimeRanges:      append([]TimeRange(nil), p.time_ranges...),
+
+		Group:    append([]string(nil), p.group_fields...),
+		Distinct: append([]string(nil), p.distinct_fields...),
+
+		TimeBucket:  p.time_bucket,
+		DistinctRow: p.distinct_row,
+		SortRandom:  p.sort_random,
+		Sample:      p.sample,
+		Limit:       p.limit,
+		LimitBy:     append([]string(nil), p.limit_by...),
+		Format:      p.format,
+		AlwaysEmpty: p.always_empty,
+
+		warnings: append([]string(nil), p.warnings...),
+		inferred: copy_types(p.inferred),
+		relative: p.relative_time || p.relative_conditions,
+
+		relative_range: p.relative_time,
+
+		text:           p.query,
+		temporal_start: p.temporal_start,
+		temporal_end:   p.temporal_end,
+	}
+
+	q.MatchingTree = make_condition(p.matching_tree)
+	q.HavingTree = make_condition(p.having_tree)
+	q.Conditions = make_conditions(p.or_list)
+	q.Having = make_conditions(p.having_list)
+	q.Unexpanded = p.unexpanded
+
+	for _, source := range p.field_sources {
+		if source != "" {
+			q.Sources = append([]string(nil), p.field_sources...)
+			break
+		}
+	}
+
+	directives := lexer_directives(p.query)
+	q.Name, q.Description = directives["name"], directives["description"]
+
+	for _, agg := range p.aggregates {
+		q.Aggregates = append(q.Aggregates, Aggregate{Function: agg.function, Field: agg.field, Alias: agg.alias, Distinct: agg.distinct, GeneratedAlias: agg.generated})
+	}
+
+	for _, key := range p.sort_keys {
+		q.Sort = append(q.Sort, SortKey{Field: key.field, Descending: key.desc, NullsFirst: key.nulls_first, Collation: key.collation})
+	}
+	if p.sort_random {
+		q.RandomSeed = p.options.RandomSeed
+	}
+
+	return &q
+}
+
+// EOF
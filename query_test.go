@@ -0,0 +1,675 @@
+// OpenActa - Query tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryEqual(t *testing.T) {
+	const statement = "FIND src_ip,dest_ip MATCHING src_ip='192.168.0.1' OR dest_port=80 " +
+		"BETWEEN '2020-05-04 00:00:00' AND '2022-10-09 00:00:00' | SORT dest_ip DESC"
+
+	q1, error := Parse(statement)
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	q2, error := Parse(statement)
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if !q1.Equal(q2) {
+		t.Errorf("two parses of the same statement differ:\n%+v\n%+v", q1, q2)
+	}
+
+	q3, error := Parse("FIND src_ip,dest_ip MATCHING src_ip='192.168.0.1' AND dest_port=80 " +
+		"BETWEEN '2020-05-04 00:00:00' AND '2022-10-09 00:00:00' | SORT dest_ip DESC")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if q1.Equal(q3) {
+		t.Errorf("OR and AND statements compare as equal")
+	}
+
+	expected := [][]Predicate{
+		{{Field: "src_ip", Op: OpEqual, Value: "192.168.0.1", Kind: ValueString, Typed: netip.MustParseAddr("192.168.0.1")}},
+		{{Field: "dest_port", Op: OpEqual, Value: "80"}},
+	}
+	if !(&Query{Conditions: expected}).Equal(&Query{Conditions: q1.Conditions}) {
+		t.Errorf("conditions %v, expected %v", q1.Conditions, expected)
+	}
+
+	// Relative time ranges, parsed a few seconds apart, go by the temporal clause as written
+	parse := func(statement string, now string) *Query {
+		options := DefaultOptions()
+		options.Now = pinned_clock(now)
+		query, error := ParseWithOptions(statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", statement, error)
+		}
+		return query
+	}
+	since := parse("FIND src_ip SINCE LAST WEEK", "2024-05-15 12:00:00")
+	if !since.Equal(parse("FIND src_ip since  last week", "2024-05-15 12:00:05")) {
+		t.Errorf("SINCE LAST WEEK parsed twice differs")
+	}
+	if since.Equal(parse("FIND src_ip SINCE LAST MONTH", "2024-05-15 12:00:00")) {
+		t.Errorf("SINCE LAST WEEK and SINCE LAST MONTH compare as equal")
+	}
+	if !since.Equal(parse(since.ExpandTemporal(), "2024-05-15 12:00:00")) {
+		t.Errorf("SINCE LAST WEEK and the times it resolved to differ")
+	}
+}
+
+func TestOperators(t *testing.T) {
+	tests := []struct {
+		comparison string
+		op         Operator
+	}{
+		{"dest_port=80", OpEqual},
+		{"dest_port==80", OpEqual},
+		{"dest_port!=80", OpNotEqual},
+		{"dest_port<>80", OpNotEqual},
+		{"dest_port<80", OpLess},
+		{"dest_port>80", OpGreater},
+		{"dest_port<=80", OpLessEqual},
+		{"dest_port>=80", OpGreaterEqual},
+		{"name EQUALS-IGNORE-CASE 'admin'", OpEqual},
+	}
+
+	for _, test := range tests {
+		query, error := Parse("FIND src_ip MATCHING " + test.comparison + " SINCE YESTERDAY")
+		if error != nil {
+			t.Fatalf("Parse error: %s", error)
+		}
+		if op := query.Conditions[0][0].Op; op != test.op {
+			t.Errorf("%s: operator %s, expected %s", test.comparison, op, test.op)
+		}
+	}
+}
+
+func TestReferencedFields(t *testing.T) {
+	query, error := Parse("FIND src_ip, dest_ip AS dst, SUM(bytes) AS total " +
+		"MATCHING dest_port=443 OR proto='udp' AND src_ip='10.0.0.1' SINCE YESTERDAY " +
+		"| GROUP src_ip, dest_ip | SORT total DESC, user.name | DISTINCT host")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+
+	expected := []string{"bytes", "dest_ip", "dest_port", "host", "proto", "src_ip", "user.name"}
+	if fields := query.ReferencedFields(); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("referenced fields %v, expected %v", fields, expected)
+	}
+
+	tests := []struct {
+		statement string
+		expected  []string
+	}{
+		{"FIND ALL MATCHING bytes_in > bytes_out AND 5 < y AND z BETWEEN lo AND hi AND 'a' BETWEEN w AND 'z' SINCE YESTERDAY",
+			[]string{"bytes_in", "bytes_out", "hi", "lo", "w", "y", "z"}},
+		{"FIND src_ip AS secret MATCHING secret='x' SINCE YESTERDAY", []string{"secret", "src_ip"}},
+		{"FIND netflow:src_ip, src_ip MATCHING dns:query='x' SINCE YESTERDAY", []string{"dns:query", "netflow:src_ip", "src_ip"}},
+	}
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Errorf("%s: Parse error: %s", test.statement, error)
+			continue
+		}
+		if fields := query.ReferencedFields(); !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%s: referenced fields %v, expected %v", test.statement, fields, test.expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	const valid = "FIND src_ip, COUNT(*) AS n MATCHING dest_port=443 SINCE 2 DAYS AGO | GROUP src_ip HAVING n > 10"
+	if error := Validate(valid); error != nil {
+		t.Errorf("valid statement rejected: %s", error)
+	}
+
+	const invalid = "FIND src_ip MATCHING dest_port=443 | SORT src_ip"
+	error := Validate(invalid)
+	if error == nil {
+		t.Fatalf("statement without temporal clause accepted")
+	}
+	if _, parse_error := Parse(invalid); parse_error == nil || parse_error.Error() != error.Error() {
+		t.Errorf("Validate and Parse disagree: %v, %v", error, parse_error)
+	}
+}
+
+func TestTypedIP(t *testing.T) {
+	tests := []struct {
+		value string
+		typed interface{}
+	}{
+		{"'192.168.0.1'", netip.MustParseAddr("192.168.0.1")},
+		{"'2001:db8::1'", netip.MustParseAddr("2001:db8::1")},
+		{"'10.0.0.0/8'", netip.MustParsePrefix("10.0.0.0/8")},
+		{"'example.com'", nil},
+		{"'192.168.0.256'", nil},
+		{"80", nil},
+	}
+
+	for _, test := range tests {
+		query, error := Parse("FIND x MATCHING src_ip=" + test.value + " SINCE YESTERDAY")
+		if error != nil {
+			t.Fatalf("Parse error: %s", error)
+		}
+		predicate := query.Conditions[0][0]
+		if predicate.Typed != test.typed {
+			t.Errorf("%s: typed %#v, expected %#v", test.value, predicate.Typed, test.typed)
+		}
+		if predicate.Value != strings.Trim(test.value, "'") {
+			t.Errorf("%s: value %q", test.value, predicate.Value)
+		}
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	defer func(w io.Writer) { trace = w }(trace)
+	trace = io.Discard
+
+	statement := large_query(900)
+
+	if _, error := ParseContext(context.Background(), statement); error != nil {
+		t.Fatalf("Parser error: %s", error)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, error := ParseContext(ctx, "FIND src_ip SINCE YESTERDAY"); !errors.Is(error, context.Canceled) {
+		t.Errorf("cancelled: got error %v, expected %v", error, context.Canceled)
+	}
+
+	// Gives up in the lexer
+	if _, error := lexer_context(ctx, statement); !errors.Is(error, context.Canceled) {
+		t.Errorf("cancelled lexer: got error %v, expected %v", error, context.Canceled)
+	}
+
+	// Gives up in the parser, when the lexer is already done
+	tokens, error := lexer(statement)
+	if error != nil {
+		t.Fatalf("Lexer error: %s", error)
+	}
+	p := Parser{query: statement, tokens: tokens, num_tokens: len(tokens), options: DefaultOptions(), ctx: ctx}
+	if error := p.parser(); !errors.Is(error, context.Canceled) {
+		t.Errorf("cancelled parser: got error %v, expected %v", error, context.Canceled)
+	}
+}
+
+func TestExpandTemporal(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	tests := []struct {
+		statement string
+		expanded  string
+	}{
+		{"FIND src_ip SINCE LAST WEEK | SORT src_ip",
+			"FIND src_ip BETWEEN '2024-05-08T00:00:00Z' AND '2024-05-15T12:00:00Z' | SORT src_ip"},
+		{"FIND src_ip MATCHING dest_port=443 BETWEEN YESTERDAY AND YESTERDAY",
+			"FIND src_ip MATCHING dest_port=443 BETWEEN '2024-05-14T00:00:00Z' AND '2024-05-14T23:59:59Z'"},
+		{"FIND src_ip SINCE FOREVER UNTIL '2024-01-01 00:00:00' EXCLUSIVE ORDER BY src_ip",
+			"FIND src_ip BETWEEN FOREVER AND '2024-01-01T00:00:00Z' EXCLUSIVE ORDER BY src_ip"},
+		{"FIND src_ip ON YESTERDAY OR ON '2024-05-01' | SORT src_ip",
+			"FIND src_ip BETWEEN '2024-05-14T00:00:00Z' AND '2024-05-14T23:59:59Z' OR BETWEEN '2024-05-01T00:00:00Z' AND '2024-05-01T23:59:59Z' | SORT src_ip"},
+	}
+
+	for _, test := range tests {
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", test.statement, error)
+		}
+		expanded := query.ExpandTemporal()
+		if expanded != test.expanded {
+			t.Errorf("%s: expanded to\n%s\nexpected\n%s", test.statement, expanded, test.expanded)
+		}
+
+		// The expanded statement parses to the same query
+		again, error := ParseWithOptions(expanded, options)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", expanded, error)
+		}
+		if !again.Equal(query) {
+			t.Errorf("%s: parses to\n%+v\nexpected\n%+v", expanded, again, query)
+		}
+	}
+}
+
+func TestTemporalPredicate(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+	now := options.Now().UnixNano()
+
+	tests := []struct {
+		statement    string
+		from_bounded bool
+		to_bounded   bool
+		exclusive    bool
+	}{
+		{"FIND x SINCE YESTERDAY", true, true, false},
+		{"FIND x SINCE YESTERDAY UNTIL LAST HOUR EXCLUSIVE", true, true, true},
+		{"FIND x BETWEEN LAST WEEK AND YESTERDAY", true, true, false},
+		{"FIND x SINCE FOREVER", false, true, false},
+		{"FIND x SINCE LAST WEEK UNTIL FOREVER", true, false, false},
+		{"FIND x BETWEEN FOREVER AND FOREVER", false, false, false},
+	}
+
+	for _, test := range tests {
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", test.statement, error)
+		}
+
+		r := query.TemporalPredicate()
+		if r.FromBounded != test.from_bounded || r.ToBounded != test.to_bounded || r.ToExclusive != test.exclusive {
+			t.Errorf("%s: bounded %v/%v exclusive %v, expected %v/%v %v", test.statement,
+				r.FromBounded, r.ToBounded, r.ToExclusive, test.from_bounded, test.to_bounded, test.exclusive)
+		}
+		if r.From != query.TimeFrom || r.To != query.TimeTo {
+			t.Errorf("%s: %d to %d, expected %d to %d", test.statement, r.From, r.To, query.TimeFrom, query.TimeTo)
+		}
+		if r.FromBounded && r.ToBounded && (r.From > r.To || r.To > now) {
+			t.Errorf("%s: %d to %d out of order or past now", test.statement, r.From, r.To)
+		}
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	query, error := Parse("FIND x MATCHING a=1 OR b!=2 AND c>3 AND d<=4 OR e='5' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+
+	predicates, error := query.Predicates()
+	if error != nil {
+		t.Fatalf("Predicates error: %s", error)
+	}
+
+	var flat []string
+	for _, predicate := range predicates {
+		flat = append(flat, strings.TrimSpace(fmt.Sprintf("%s %s%s%s", predicate.Conjunction, predicate.Field, predicate.Op, predicate.Value)))
+	}
+	expected := []string{"a=1", "OR b!=2", "AND c>3", "AND d<=4", "OR e=5"}
+	if !reflect.DeepEqual(flat, expected) {
+		t.Errorf("predicates %q, expected %q", flat, expected)
+	}
+
+	query, error = Parse("FIND x SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if predicates, error := query.Predicates(); error != nil || len(predicates) != 0 {
+		t.Errorf("no conditions: %v, %v", predicates, error)
+	}
+
+	// Parentheses are fine as long as there's no OR inside an AND
+	query, _ = Parse("FIND x MATCHING (a=1 AND b=2) OR c=3 SINCE YESTERDAY")
+	if predicates, error := query.Predicates(); error != nil || len(predicates) != 3 || predicates[2].Conjunction != ConjunctionOr || predicates[2].Field != "c" {
+		t.Errorf("AND in parentheses: %v, %v", predicates, error)
+	}
+	query, _ = Parse("FIND x MATCHING (a=1 OR b=2) AND c=3 SINCE YESTERDAY")
+	if predicates, error := query.Predicates(); error == nil {
+		t.Errorf("OR in parentheses: expected an error, got %v", predicates)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		comparison string
+		op         Operator
+		value      string
+		duration   time.Duration
+	}{
+		{"response_time > 500ms", OpGreater, "500ms", 500 * time.Millisecond},
+		{"response_time < 2s", OpLess, "2s", 2 * time.Second},
+		{"uptime >= 1h30m", OpGreaterEqual, "1h30m", 90 * time.Minute},
+		{"latency<=1.5us", OpLessEqual, "1.5us", 1500 * time.Nanosecond},
+	}
+
+	for _, test := range tests {
+		query, error := Parse("FIND x MATCHING " + test.comparison + " SINCE YESTERDAY")
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", test.comparison, error)
+		}
+		predicate := query.Conditions[0][0]
+		if predicate.Op != test.op || predicate.Value != test.value || predicate.Typed != test.duration {
+			t.Errorf("%s: %s %s %v, expected %s %s %v", test.comparison, predicate.Op, predicate.Value, predicate.Typed, test.op, test.value, test.duration)
+		}
+	}
+
+	// Plain numbers aren't durations
+	query, error := Parse("FIND x MATCHING response_time > 500 SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if typed := query.Conditions[0][0].Typed; typed != nil {
+		t.Errorf("500: typed %v, expected nil", typed)
+	}
+	if _, error := Parse("FIND x MATCHING response_time > 500mx SINCE YESTERDAY"); error == nil {
+		t.Errorf("500mx: expected an error")
+	}
+}
+
+func TestCombineAND(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	parse := func(statement string) *Query {
+		query, error := ParseWithOptions(statement, options)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", statement, error)
+		}
+		return query
+	}
+	conditions := func(query *Query) [][]string {
+		var groups [][]string
+		for _, group := range query.Conditions {
+			var list []string
+			for _, predicate := range group {
+				list = append(list, predicate.Field+predicate.Op.String()+predicate.Value)
+			}
+			groups = append(groups, list)
+		}
+		return groups
+	}
+
+	user := parse("FIND src_ip, dest_ip MATCHING dest_port=443 OR dest_port=80 AND proto='tcp' SINCE LAST WEEK | SORT src_ip")
+	tenant := parse("FIND ALL MATCHING tenant='acme' BETWEEN 2 WEEKS AGO AND YESTERDAY")
+
+	combined := CombineAND(user, tenant)
+	expected := [][]string{{"dest_port=443", "tenant=acme"}, {"dest_port=80", "proto=tcp", "tenant=acme"}}
+	if !reflect.DeepEqual(conditions(combined), expected) {
+		t.Errorf("conditions %v, expected %v", conditions(combined), expected)
+	}
+	if combined.TimeFrom != user.TimeFrom || combined.TimeTo != tenant.TimeTo {
+		t.Errorf("time range %d to %d, expected %d to %d", combined.TimeFrom, combined.TimeTo, user.TimeFrom, tenant.TimeTo)
+	}
+	if !reflect.DeepEqual(combined.Fields, user.Fields) || !reflect.DeepEqual(combined.Sort, user.Sort) || combined.AlwaysEmpty {
+		t.Errorf("fields %v, sort %v, always empty %v", combined.Fields, combined.Sort, combined.AlwaysEmpty)
+	}
+
+	// Two OR groups on each side
+	both := CombineAND(parse("FIND x MATCHING a=1 OR b=2 SINCE YESTERDAY"), parse("FIND x MATCHING c=3 OR d=4 SINCE YESTERDAY"))
+	expected = [][]string{{"a=1", "c=3"}, {"a=1", "d=4"}, {"b=2", "c=3"}, {"b=2", "d=4"}}
+	if !reflect.DeepEqual(conditions(both), expected) {
+		t.Errorf("conditions %v, expected %v", conditions(both), expected)
+	}
+
+	// One without conditions, and ranges that don't overlap
+	none := CombineAND(parse("FIND x SINCE YESTERDAY"), parse("FIND x MATCHING a=1 BETWEEN 3 WEEKS AGO AND 2 WEEKS AGO"))
+	if !reflect.DeepEqual(conditions(none), [][]string{{"a=1"}}) || !none.AlwaysEmpty {
+		t.Errorf("conditions %v, always empty %v", conditions(none), none.AlwaysEmpty)
+	}
+
+	// The tree is the AND of both trees
+	if tree := combined.MatchingTree; tree.Conjunction != ConjunctionAnd || len(tree.Children) != 2 ||
+		tree.Children[0].Conjunction != ConjunctionOr || tree.Children[1].Predicate.Field != "tenant" {
+		t.Errorf("tree %+v", tree)
+	}
+
+	// The originals are left alone
+	combined.Conditions[0][0].Value = "changed"
+	combined.MatchingTree.Children[1].Predicate.Value = "changed"
+	if user.Conditions[0][0].Value != "443" || tenant.Conditions[0][0].Value != "acme" || tenant.MatchingTree.Predicate.Value != "acme" {
+		t.Errorf("originals changed: %v %v", user.Conditions, tenant.Conditions)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	query, error := Parse("FIND ALL MATCHING proto='tcp' AND dest_port>=1024 AND bytes BETWEEN 10 AND 20 AND dest_port MOD 2=0 AND src_ip!='10.0.0.1' AND name EQUALS-IGNORE-CASE 'admin' AND src_ip = dest_ip SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+
+	var access []Access
+	for i := range query.Conditions[0] {
+		access = append(access, query.Conditions[0][i].Classify())
+	}
+	expected := []Access{AccessSeek, AccessRange, AccessRange, AccessScan, AccessScan, AccessScan, AccessScan}
+	if !reflect.DeepEqual(access, expected) {
+		t.Errorf("access %v, expected %v", access, expected)
+	}
+
+	seek := func(statement string) []string {
+		query, error := Parse(statement)
+		if error != nil {
+			t.Fatalf("%s: Parse error: %s", statement, error)
+		}
+		var list []string
+		for _, predicate := range query.SeekPredicates() {
+			list = append(list, predicate.Field+"="+predicate.Value)
+		}
+		return list
+	}
+	if list := seek("FIND ALL MATCHING proto='tcp' AND dest_port>1024 AND tenant='acme' SINCE YESTERDAY"); !reflect.DeepEqual(list, []string{"proto=tcp", "tenant=acme"}) {
+		t.Errorf("seek predicates %v", list)
+	}
+	if list := seek("FIND ALL MATCHING a=1 AND b=2 OR c=3 AND a=1 SINCE YESTERDAY"); !reflect.DeepEqual(list, []string{"a=1"}) {
+		t.Errorf("seek predicates %v", list)
+	}
+	if list := seek("FIND ALL MATCHING a=1 OR b=2 SINCE YESTERDAY"); list != nil {
+		t.Errorf("seek predicates %v, expected none", list)
+	}
+	if list := seek("FIND ALL MATCHING (a=1 OR b=2) AND c=3 AND (d=4 AND e>5 OR d=4) SINCE YESTERDAY"); !reflect.DeepEqual(list, []string{"c=3", "d=4"}) {
+		t.Errorf("seek predicates %v", list)
+	}
+}
+
+func TestInferredTypes(t *testing.T) {
+	query, error := Parse("FIND ALL MATCHING dest_port > 1024 AND bytes BETWEEN 10 AND 2.5 AND src_ip='10.0.0.1' AND name='x' OR dest_port=443 AND bytes MOD 2 = 0 SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	expected := map[string]FieldType{"dest_port": FieldInt, "bytes": FieldFloat, "src_ip": FieldIP, "name": FieldString}
+	if types := query.InferredTypes(); !reflect.DeepEqual(types, expected) {
+		t.Errorf("inferred types %v, expected %v", types, expected)
+	}
+	if len(query.Warnings()) != 0 {
+		t.Errorf("unexpected warnings %v", query.Warnings())
+	}
+
+	// Conflicting
+	query, error = Parse("FIND ALL MATCHING dest_port = 443 OR dest_port = 'https' OR dest_port = 'http' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if types := query.InferredTypes(); !reflect.DeepEqual(types, map[string]FieldType{"dest_port": FieldAny}) {
+		t.Errorf("inferred types %v", types)
+	}
+	if warnings := query.Warnings(); !reflect.DeepEqual(warnings, []string{"dest_port is compared with both a number and a string: 443 and 'https'"}) {
+		t.Errorf("warnings %v", warnings)
+	}
+
+	// A regular expression is neither a string value nor an IP address
+	query, error = Parse("FIND ALL MATCHING src_ip = '10.0.0.1' AND ua =~ 'curl' OR host MATCHES '^web' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if types := query.InferredTypes(); !reflect.DeepEqual(types, map[string]FieldType{"src_ip": FieldIP}) {
+		t.Errorf("inferred types %v, expected src_ip only", types)
+	}
+
+	// Nothing to go by
+	query, _ = Parse("FIND ALL MATCHING a = b SINCE YESTERDAY")
+	if types := query.InferredTypes(); types != nil {
+		t.Errorf("inferred types %v, expected none", types)
+	}
+
+	// The same name from different sources are different fields
+	query, error = Parse("FIND ALL MATCHING netflow:a = 1 AND dns:a = 'x' SINCE YESTERDAY")
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if types := query.InferredTypes(); !reflect.DeepEqual(types, map[string]FieldType{"netflow:a": FieldInt, "dns:a": FieldString}) {
+		t.Errorf("inferred types %v", types)
+	}
+	if len(query.Warnings()) != 0 {
+		t.Errorf("unexpected warnings %v", query.Warnings())
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	query, error := Parse(`-- name: failed-logins
+-- Description:  failed logins per source
+// just a comment: not a directive
+FIND src_ip, COUNT(*) MATCHING outcome='failure' SINCE LAST DAY | GROUP src_ip`)
+	if error != nil {
+		t.Fatalf("Parse error: %s", error)
+	}
+	if query.Name != "failed-logins" || query.Description != "failed logins per source" {
+		t.Errorf("name %q, description %q", query.Name, query.Description)
+	}
+
+	for _, statement := range []string{
+		"-- failed logins\nFIND ALL SINCE LAST DAY",                 // plain comment
+		"/* name: x */ FIND ALL SINCE LAST DAY",                     // block comments don't hold directives
+		"FIND ALL SINCE LAST DAY\n-- name: too late",                // only ahead of the statement
+		"-- owner: someone\nFIND ALL SINCE LAST DAY",                // not a directive we know
+		"FIND ALL MATCHING a - -1 = 0 SINCE LAST DAY // name: nope", // not a comment, and too late
+	} {
+		query, error := Parse(statement)
+		if error != nil {
+			t.Errorf("%q: Parse error: %s", statement, error)
+			continue
+		}
+		if query.Name != "" || query.Description != "" {
+			t.Errorf("%q: name %q, description %q", statement, query.Name, query.Description)
+		}
+	}
+}
+
+func TestIsDeterministic(t *testing.T) {
+	tests := []struct {
+		statement     string
+		deterministic bool
+	}{
+		{"FIND ALL BETWEEN '2024-05-01' AND '2024-05-02 12:00:00' EXCLUSIVE", true},
+		{"FIND src_ip MATCHING dest_port=443 SINCE 1714521600 UNTIL FOREVER | SORT src_ip", true},
+		{"FIND ALL ON '2024-01-05'", true},
+		{"FIND ALL SINCE LAST HOUR", false},
+		{"FIND ALL SINCE '2024-05-01'", false}, // up to now
+		{"FIND ALL BETWEEN '2024-05-01' AND YESTERDAY", false},
+		{"FIND ALL ON YESTERDAY", false},
+		{"FIND ALL BETWEEN '2024-05-01' AND '2024-05-02' SAMPLE 10%", false},
+		{"FIND ALL BETWEEN '2024-05-01' AND '2024-05-02' | SORT RANDOM", false},
+	}
+
+	for _, test := range tests {
+		query, error := Parse(test.statement)
+		if error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+			continue
+		}
+		if query.IsDeterministic() != test.deterministic {
+			t.Errorf("%s: deterministic %v, expected %v", test.statement, query.IsDeterministic(), test.deterministic)
+		}
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"FIND ALL MATCHING a=1 AND b=2 SINCE YESTERDAY", "FIND ALL MATCHING b=2 AND a=1 SINCE YESTERDAY", true},
+		{"FIND ALL MATCHING a=1 AND b=2 OR c>3 SINCE YESTERDAY", "FIND ALL MATCHING c>3 OR b=2 AND a=1 SINCE YESTERDAY", true},
+		{"FIND ALL MATCHING a=1 AND c=3 OR b=2 AND c=3 SINCE YESTERDAY", "FIND ALL MATCHING c=3 AND b=2 OR a=1 AND c=3 SINCE YESTERDAY", true},
+		{"FIND ALL MATCHING a=1 AND a=1 OR b=2 OR b=2 SINCE YESTERDAY", "FIND ALL MATCHING b=2 OR a=1 SINCE YESTERDAY", true},
+		{"FIND ALL MATCHING name EQUALS-IGNORE-CASE 'Admin' SINCE YESTERDAY", "find all matching name equals-ignore-case 'ADMIN' since yesterday", true},
+		{"FIND x, COUNT(*) AS n SINCE YESTERDAY | GROUP x HAVING n > 1 AND n < 9", "FIND x, COUNT(*) AS n SINCE YESTERDAY | GROUP x HAVING n < 9 AND n > 1", true},
+		// Different after all
+		{"FIND ALL MATCHING a=1 AND b=2 OR c=3 SINCE YESTERDAY", "FIND ALL MATCHING a=1 OR b=2 AND c=3 SINCE YESTERDAY", false},
+		{"FIND ALL MATCHING a - b > 1 SINCE YESTERDAY", "FIND ALL MATCHING b - a > 1 SINCE YESTERDAY", false},
+		{"FIND ALL MATCHING path =~ '\\D' SINCE YESTERDAY", "FIND ALL MATCHING path =~ '\\d' SINCE YESTERDAY", false},
+	}
+
+	for _, test := range tests {
+		a, error := ParseWithOptions(test.a, options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.a, error)
+		}
+		b, error := ParseWithOptions(test.b, options)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", test.b, error)
+		}
+		if a.Canonicalize().Equal(b.Canonicalize()) != test.equal {
+			t.Errorf("%s and %s: canonically equal %v, expected %v\n%+v\n%+v", test.a, test.b, !test.equal, test.equal, a.Canonicalize().Conditions, b.Canonicalize().Conditions)
+		}
+	}
+
+	// The original is left as it was
+	query, _ := ParseWithOptions("FIND ALL MATCHING b=2 AND a=1 SINCE YESTERDAY", options)
+	query.Canonicalize()
+	if query.Conditions[0][0].Field != "b" {
+		t.Errorf("original conditions changed: %+v", query.Conditions)
+	}
+}
+
+func TestEstimateSelectivity(t *testing.T) {
+	estimate := func(statement string) float64 {
+		query, error := Parse(statement)
+		if error != nil {
+			t.Fatalf("%s: Parser error: %s", statement, error)
+		}
+		return query.EstimateSelectivity()
+	}
+
+	narrow := estimate("FIND ALL MATCHING src_ip='10.0.0.1' AND dest_port=443 AND proto='tcp' SINCE YESTERDAY")
+	broad := estimate("FIND ALL MATCHING bytes > 1024 SINCE YESTERDAY")
+	if narrow >= broad {
+		t.Errorf("equalities %g, not more selective than a range %g", narrow, broad)
+	}
+	if broad <= 0 || broad >= 1 {
+		t.Errorf("range %g, expected somewhere in between", broad)
+	}
+
+	tests := []struct {
+		statement string
+		expected  float64
+	}{
+		{"FIND ALL SINCE YESTERDAY", 1},
+		{"FIND ALL MATCHING 1=2 SINCE YESTERDAY", 0},
+		{"FIND ALL MATCHING dest_port=443 SINCE YESTERDAY", 0.01},
+		{"FIND ALL MATCHING dest_port=443 OR dest_port=80 SINCE YESTERDAY", 0.02},
+		{"FIND ALL MATCHING a != 1 OR b != 2 SINCE YESTERDAY", 1}, // adds up to more, but that's all there is
+		{"FIND ALL MATCHING dest_port MOD 2 = 0 SINCE YESTERDAY", 0.5},
+		{"FIND ALL MATCHING (a=1 OR b=2) AND c=3 SINCE YESTERDAY", 0.0002},
+	}
+	for _, test := range tests {
+		if s := estimate(test.statement); math.Abs(s-test.expected) > 1e-9 {
+			t.Errorf("%s: %g, expected %g", test.statement, s, test.expected)
+		}
+	}
+}
+
+// EOF
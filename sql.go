@@ -0,0 +1,229 @@
+// OpenActa - SQL WHERE clause
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Backends that keep their events in an SQL database can hand the MATCHING
+conditions and the time range over as a WHERE clause. Values never go into
+the SQL text itself, they're passed as arguments for ? placeholders, so
+whatever a user puts in a quoted string can't change the statement.
+*/
+
+// Column holding the event time in unix epoch nanoseconds, for the time range in ToSQLWhere()
+const SQLTimeColumn = "timestamp"
+
+// ToSQLWhere returns the time range and MATCHING conditions as an SQL WHERE clause (without
+// the WHERE), with a ? placeholder for every value and the values in args, in order:
+//
+//	FIND ALL MATCHING dest_port=443 AND src_ip!='10.0.0.1' OR bytes BETWEEN 10 AND 20 SINCE YESTERDAY
+//
+// gives
+//
+//	"timestamp" >= ? AND "timestamp" <= ? AND (("dest_port" = ? AND "src_ip" <> ?) OR "bytes" BETWEEN ? AND ?)
+//
+// The conditions go in as written, (a=1 OR b=2) AND c=3 isn't multiplied out.
+// Field names are quoted as SQL identifiers, a qualified field as "netflow"."src_ip", and so is
+// a field on the right-hand side: bytes_in > bytes_out compares the two columns.
+// CONTAINS becomes LIKE with % and _ escaped, MATCHES becomes REGEXP (MySQL, SQLite).
+// A query that is AlwaysEmpty gives 1 = 0, one without any condition at all 1 = 1.
+func (q *Query) ToSQLWhere() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+
+	if q.AlwaysEmpty {
+		return "1 = 0", nil
+	}
+
+	var ranges []string
+	for _, r := range q.ranges() {
+		var bounds []string
+		if r.FromBounded {
+			bounds = append(bounds, sql_ident("", SQLTimeColumn)+" >= ?")
+			args = append(args, r.From)
+		}
+		if r.ToBounded {
+			if r.ToExclusive {
+				bounds = append(bounds, sql_ident("", SQLTimeColumn)+" < ?")
+			} else {
+				bounds = append(bounds, sql_ident("", SQLTimeColumn)+" <= ?")
+			}
+			args = append(args, r.To)
+		}
+		if len(bounds) == 0 { // FOREVER both ways, the other ranges don't matter
+			ranges = nil
+			args = args[:0]
+			break
+		}
+		ranges = append(ranges, strings.Join(bounds, " AND "))
+	}
+	switch {
+	case len(ranges) > 1:
+		where = append(where, "(("+strings.Join(ranges, ") OR (")+"))")
+	case len(ranges) == 1:
+		where = append(where, ranges[0])
+	}
+
+	if tree := q.matching(); tree != nil {
+		condition := q.sql_condition(tree, &args)
+		if tree.Conjunction == ConjunctionOr { // it's ANDed with the time range
+			condition = "(" + condition + ")"
+		}
+		where = append(where, condition)
+	}
+
+	if len(where) == 0 {
+		return "1 = 1", nil
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// The conditions as written, with parentheses around every AND or OR inside another one:
+// AND binds tighter than OR, but the parentheses are for the reader
+func (q *Query) sql_condition(c *Condition, args *[]interface{}) string {
+	if c.Predicate != nil {
+		return q.sql_predicate(c.Predicate, args)
+	}
+
+	parts := make([]string, 0, len(c.Children))
+	for _, child := range c.Children {
+		if child.Predicate != nil {
+			parts = append(parts, q.sql_condition(child, args))
+		} else {
+			parts = append(parts, "("+q.sql_condition(child, args)+")")
+		}
+	}
+	return strings.Join(parts, " "+c.Conjunction.String()+" ")
+}
+
+// A single comparison, its values appended to args
+func (q *Query) sql_predicate(predicate *Predicate, args *[]interface{}) string {
+	left := sql_ident(predicate.Source, predicate.Field)
+	if predicate.Expr != nil {
+		left = sql_expr(predicate.Expr, args)
+	}
+
+	switch predicate.Op {
+	case OpExists:
+		return left + " IS NOT NULL"
+	case OpMissing:
+		return left + " IS NULL"
+	case OpMatches: // compiled with (?i) in front when case doesn't matter
+		pattern := predicate.Value
+		if compiled, ok := predicate.Typed.(*regexp.Regexp); ok {
+			pattern = compiled.String()
+		} else if predicate.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		*args = append(*args, pattern)
+		return left + " REGEXP ?"
+	case OpContains:
+		*args = append(*args, "%"+sql_like_escape(predicate.Value)+"%")
+		if predicate.IgnoreCase {
+			return "LOWER(" + left + ") LIKE LOWER(?) ESCAPE '\\'"
+		}
+		return left + " LIKE ? ESCAPE '\\'"
+	}
+
+	right := sql_value(predicate.Value, predicate.Typed, predicate.Kind, args)
+	if predicate.IgnoreCase {
+		left, right = "LOWER("+left+")", "LOWER("+right+")"
+	}
+
+	switch predicate.Op {
+	case OpNotEqual:
+		return left + " <> " + right
+	case OpBetween:
+		high := sql_value(predicate.High, nil, predicate.HighKind, args)
+		if predicate.Exclusive {
+			return "(" + left + " >= " + right + " AND " + left + " < " + high + ")"
+		}
+		return left + " BETWEEN " + right + " AND " + high
+	}
+	return left + " " + predicate.Op.String() + " " + right
+}
+
+// The right-hand side: a field as its identifier, a value as a placeholder with the value appended to args
+func sql_value(value string, typed interface{}, kind ValueKind, args *[]interface{}) string {
+	if kind == ValueField {
+		return sql_ident("", value)
+	}
+	*args = append(*args, sql_arg(value, typed, kind))
+	return "?"
+}
+
+// Arithmetic on the left-hand side, fully parenthesised as SQL operator precedence may differ
+func sql_expr(e *Expr, args *[]interface{}) string {
+	switch e.Op {
+	case OpNone:
+		if e.Field != "" {
+			return sql_ident("", e.Field)
+		}
+		*args = append(*args, sql_arg(e.Value, nil, e.Kind))
+		return "?"
+	case OpNegate:
+		return "-(" + sql_expr(e.Left, args) + ")"
+	}
+
+	return "(" + sql_expr(e.Left, args) + " " + e.Op.String() + " " + sql_expr(e.Right, args) + ")"
+}
+
+// The value as the database should get it, going by the literal rather than the field: a quoted
+// string stays a string, '007' too, durations and points in time go in nanoseconds, and an
+// unquoted literal that reads as a number is one.
+func sql_arg(value string, typed interface{}, kind ValueKind) interface{} {
+	if duration, ok := typed.(time.Duration); ok {
+		return int64(duration)
+	}
+	if t, ok := typed.(int64); ok { // a point in time, in the same nanoseconds as SQLTimeColumn
+		return t
+	}
+
+	if kind == ValueString {
+		return value
+	}
+	if number, error := strconv.ParseInt(value, 10, 64); error == nil {
+		return number
+	}
+	if number, error := strconv.ParseFloat(value, 64); error == nil {
+		return number
+	}
+	return value
+}
+
+// Double quoted SQL identifier, with any double quote in the name doubled
+func sql_ident(source string, field string) string {
+	quoted := `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+	if source != "" {
+		return sql_ident("", source) + "." + quoted
+	}
+	return quoted
+}
+
+// Escape the LIKE wildcards, with \ as the escape character
+func sql_like_escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// EOF
@@ -0,0 +1,112 @@
+// OpenActa - SQL WHERE clause tests
+// Copyright (C) 2023 Arjen Lentz & Lentz Pty Ltd; All Rights Reserved
+// <arjen (at) openacta (dot) dev>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openacta
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestToSQLWhere(t *testing.T) {
+	options := DefaultOptions()
+	options.Now = pinned_clock("2024-05-15 12:00:00")
+	yesterday := time.Date(2024, 5, 14, 0, 0, 0, 0, time.UTC).UnixNano()
+	today := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC).UnixNano()
+
+	tests := []struct {
+		statement string
+		where     string
+		args      []interface{}
+	}{
+		{
+			"FIND ALL MATCHING dest_port=443 AND src_ip!='10.0.0.1' OR bytes BETWEEN 10 AND 20 EXCLUSIVE AND netflow:proto='tcp' SINCE YESTERDAY",
+			`"timestamp" >= ? AND "timestamp" <= ? AND (("dest_port" = ? AND "src_ip" <> ?) OR (("bytes" >= ? AND "bytes" < ?) AND "netflow"."proto" = ?))`,
+			[]interface{}{yesterday, options.Now().UnixNano(), int64(443), "10.0.0.1", int64(10), int64(20), "tcp"},
+		},
+		{
+			"FIND ALL MATCHING message CONTAINS '100%_sure' AND name EQUALS-IGNORE-CASE 'Admin' AND path =~ '^/admin' BETWEEN YESTERDAY AND '2024-05-15' EXCLUSIVE",
+			`"timestamp" >= ? AND "timestamp" < ? AND "message" LIKE ? ESCAPE '\' AND LOWER("name") = LOWER(?) AND "path" REGEXP ?`,
+			[]interface{}{yesterday, today, `%100\%\_sure%`, "Admin", "^/admin"},
+		},
+		{
+			"FIND ALL MATCHING dest_port MOD 2 = 0 AND latency > 500ms AND [odd \"name\"] = '1; DROP TABLE events' SINCE FOREVER",
+			`"timestamp" <= ? AND ("dest_port" % ?) = ? AND "latency" > ? AND "odd ""name""" = ?`,
+			[]interface{}{options.Now().UnixNano(), int64(2), int64(0), int64(500 * time.Millisecond), "1; DROP TABLE events"},
+		},
+		{"FIND ALL MATCHING 1=2 SINCE YESTERDAY", "1 = 0", nil},
+		{"FIND ALL MATCHING EXISTS error_code AND MISSING user SINCE FOREVER UNTIL FOREVER", `"error_code" IS NOT NULL AND "user" IS NULL`, nil},
+		{
+			"FIND ALL MATCHING dest_port=443 ON YESTERDAY OR SINCE FOREVER UNTIL '2024-05-01' EXCLUSIVE",
+			`(("timestamp" >= ? AND "timestamp" <= ?) OR ("timestamp" < ?)) AND "dest_port" = ?`,
+			[]interface{}{yesterday, today - int64(time.Second), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC).UnixNano(), int64(443)},
+		},
+		{
+			"FIND ALL MATCHING (a=1 OR b=2) AND c=3 OR d=4 SINCE FOREVER UNTIL FOREVER",
+			`((("a" = ? OR "b" = ?) AND "c" = ?) OR "d" = ?)`,
+			[]interface{}{int64(1), int64(2), int64(3), int64(4)},
+		},
+		{
+			"FIND ALL MATCHING bytes_in > bytes_out AND c = '007' OR c = 1 OR bytes BETWEEN low AND 100 SINCE FOREVER UNTIL FOREVER",
+			`(("bytes_in" > "bytes_out" AND "c" = ?) OR "c" = ? OR "bytes" BETWEEN "low" AND ?)`,
+			[]interface{}{"007", int64(1), int64(100)},
+		},
+		{
+			"FIND ALL MATCHING 'abc' = y AND 5 < y AND '007' BETWEEN lo AND hi SINCE FOREVER UNTIL FOREVER",
+			`"y" = ? AND "y" > ? AND ? BETWEEN "lo" AND "hi"`,
+			[]interface{}{"abc", int64(5), "007"},
+		},
+	}
+
+	for _, test := range tests {
+		query, error := ParseWithOptions(test.statement, options)
+		if error != nil {
+			t.Errorf("%s: Parser error: %s", test.statement, error)
+			continue
+		}
+		where, args := query.ToSQLWhere()
+		if where != test.where {
+			t.Errorf("%s: WHERE\n%s\nexpected\n%s", test.statement, where, test.where)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: args %#v, expected %#v", test.statement, args, test.args)
+		}
+	}
+}
+
+func TestToSQLWhereIgnoreCase(t *testing.T) {
+	options := DefaultOptions()
+	options.CaseInsensitiveStrings = true
+
+	statement := "FIND ALL MATCHING path MATCHES '^/admin' AND user = 'Root' AND user = owner SINCE FOREVER UNTIL FOREVER"
+	query, error := ParseWithOptions(statement, options)
+	if error != nil {
+		t.Fatalf("%s: Parser error: %s", statement, error)
+	}
+
+	where, args := query.ToSQLWhere()
+	expected := `"path" REGEXP ? AND LOWER("user") = LOWER(?) AND "user" = "owner"`
+	if where != expected {
+		t.Errorf("%s: WHERE\n%s\nexpected\n%s", statement, where, expected)
+	}
+	if expected := []interface{}{"(?i)^/admin", "Root"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("%s: args %#v, expected %#v", statement, args, expected)
+	}
+}
+
+// EOF
@@ -33,11 +33,13 @@ var statements = []string{
 	"FIND src_ip BETWEEN DAY BEFORE YESTERDAY AND YESTERDAY",
 	"FIND src_ip,dest_ip BETWEEN LAST MONTH AND 1 FORTNIGHT AGO",
 	"FIND src_ip,dest_ip BETWEEN LAST MONTH AND LAST FORTNIGHT",
-	"FIND src_ip,dest_ip BETWEEN LAST MONTH AND FORTNIGHT AGO", // should error
+	"FIND src_ip,dest_ip BETWEEN LAST MONTH AND FORTNIGHT AGO", // same as 1 FORTNIGHT AGO
 	"FIND dest_ip MATCHING src_ip='192.168.0.1' SINCE LAST WEEK | SORT dest_ip",
 	"FIND dest_ip MATCHING src_ip='192.168.0.1' SINCE 2 WEEKS AGO",
 	"FIND dest_ip MATCHING src_ip='192.168.0.1' BETWEEN 3 MONTHS AGO AND 6 MONTHS AGO | SORT dest_ip",
 	"FIND [dest_ip] MATCHING src_ip='192.168.0.1' AND dest_port=80 SINCE YESTERDAY | DISTINCT src_ip",
 	"FIND src_ip,dest_ip MATCHING src_ip='192.168.0.1' OR src_ip='192.168.1.1' AND dest_port=80 SINCE LAST TUESDAY",
+	"FIND dest_ip MATCHING src_ip='192.168.0.1' SINCE LAST WEEK ORDER BY dest_ip DESC",
+}
 
 // EOF